@@ -0,0 +1,582 @@
+// ikuhuff encodes, decodes and inspects huffman encoded packets from the shell.
+//
+// Usage:
+//
+//	ikuhuff encode  [-o out] [-model file [-id]] [-embed] [-compact] [-adaptive] [-stream] [-checksum] [-index n] [-parallel n] [-coder name] [in]
+//	ikuhuff decode  [-o out] [-model file ...] [in]
+//	ikuhuff train   [-o out] [-maxlen n] [-smooth n] [sample ...]
+//	ikuhuff inspect [-model file ...] [in]
+//
+// Input is read from stdin and output written to stdout when no files are
+// given.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Stymphalian/iku_huffman/codec"
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+const usage = `Usage: ikuhuff <command> [flags] [files]
+
+Commands:
+  encode   Encode a file into a huffman encoded packet
+  decode   Decode a packet back into the original file
+  train    Build a model from sample files and save it
+  inspect  Print the header, code lengths and compression ratio of a packet
+
+Run 'ikuhuff <command> -h' for the flags of each command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Runs the command given by the args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "encode":
+		err = encodeCmd(args[1:], stdin, stdout, stderr)
+	case "decode":
+		err = decodeCmd(args[1:], stdin, stdout, stderr)
+	case "train":
+		err = trainCmd(args[1:], stdin, stdout, stderr)
+	case "inspect":
+		err = inspectCmd(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "ikuhuff: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "ikuhuff %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func encodeCmd(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "", "Write the packet to this file instead of stdout")
+	modelFile := fs.String("model", "", "Encode with a model saved by 'ikuhuff train'. Implies -embed unless -id is given")
+	useID := fs.Bool("id", false, "Write the ID of the -model instead of the model itself (HAS_MODEL_ID)")
+	embed := fs.Bool("embed", false, "Include the model in the packet (HAS_MODEL)")
+	compact := fs.Bool("compact", false, "Write the model with only the symbols it has and packed lengths (COMPACT_MODEL)")
+	adaptive := fs.Bool("adaptive", false, "Build the model from the input itself (ADAPTIVE_MODEL)")
+	stream := fs.Bool("stream", false, "Encode in blocks without reading the whole input into memory (STREAMED)")
+	checksum := fs.Bool("checksum", false, "Add CRC-32C checksums of the header and payload (HAS_CHECKSUM)")
+	index := fs.Uint("index", 0, "Add an index of blocks of this many bytes for random access (BLOCK_INDEX)")
+	parallel := fs.Uint("parallel", 0, "Encode chunks of this many bytes on every core (PARALLEL)")
+	coder := fs.String("coder", "huffman", "Entropy coder to use, huffman or rans (CODER_RANS)")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var flags uint16
+	if *embed {
+		flags |= codec.HAS_MODEL
+	}
+	if *compact {
+		flags |= codec.COMPACT_MODEL
+	}
+	if *adaptive {
+		flags |= codec.ADAPTIVE_MODEL
+	}
+	if *checksum {
+		flags |= codec.HAS_CHECKSUM
+	}
+	if *index > 0 {
+		flags |= codec.BLOCK_INDEX
+	}
+	if *parallel > 0 {
+		flags |= codec.PARALLEL
+	}
+	switch *coder {
+	case "huffman":
+		flags |= codec.CODER_HUFFMAN
+	case "rans":
+		// Models saved by 'ikuhuff train' are huffman models
+		if *modelFile != "" {
+			return errors.New("-coder rans can not be used with -model")
+		}
+		flags |= codec.CODER_RANS
+	default:
+		return fmt.Errorf("Unknown coder %q, expected huffman or rans", *coder)
+	}
+
+	in, closeIn, err := openInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+	w, closeOut, err := openOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+
+	if *stream {
+		if *modelFile != "" || *adaptive || *index > 0 || *parallel > 0 {
+			closeOut()
+			return errors.New("-stream can not be used with -model, -adaptive, -index or -parallel")
+		}
+		err = encodeStream(w, in, flags)
+	} else {
+		err = encodePacket(w, in, encodeOptions{flags, *modelFile, *useID, uint32(*index), uint32(*parallel)})
+	}
+	if err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+func encodeStream(w io.Writer, in io.Reader, flags uint16) error {
+	encoder, err := codec.NewStreamEncoder(w, flags)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(encoder, in)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+type encodeOptions struct {
+	flags        uint16
+	modelFile    string
+	useID        bool
+	blockSymbols uint32
+	chunkSymbols uint32
+}
+
+func encodePacket(w io.Writer, in io.Reader, opts encodeOptions) error {
+	if opts.useID && opts.modelFile == "" {
+		return errors.New("-id requires a -model")
+	}
+
+	flags := opts.flags
+	encoder, err := codec.NewEncoder(w)
+	if err != nil {
+		return err
+	}
+	if opts.modelFile != "" {
+		m, err := loadModel(opts.modelFile)
+		if err != nil {
+			return err
+		}
+		if opts.useID {
+			// The decoder finds the model from its ID with 'decode -model'
+			registry := codec.NewModelRegistry()
+			id, err := registry.RegisterModel(m)
+			if err != nil {
+				return err
+			}
+			encoder, err = codec.NewEncoderWithRegistry(w, registry, id)
+			if err != nil {
+				return err
+			}
+			flags |= codec.HAS_MODEL_ID
+		} else {
+			encoder, err = codec.NewEncoderWithModel(w, m)
+			if err != nil {
+				return err
+			}
+			// The decoder has no other way of knowing about the model
+			flags |= codec.HAS_MODEL
+		}
+	}
+
+	src, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if flags&codec.BLOCK_INDEX > 0 {
+		err = encoder.SetIndexBlockSize(opts.blockSymbols)
+		if err != nil {
+			return err
+		}
+	}
+	if flags&codec.PARALLEL > 0 {
+		err = encoder.SetParallelChunkSize(opts.chunkSymbols)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = encoder.Write(src, flags)
+	return err
+}
+
+func decodeCmd(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "", "Write the payload to this file instead of stdout")
+	var modelFiles fileList
+	fs.Var(&modelFiles, "model", "Model saved by 'ikuhuff train' to look up the ID of a HAS_MODEL_ID packet in. Can be repeated")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	registry, err := loadRegistry(modelFiles)
+	if err != nil {
+		return err
+	}
+
+	in, closeIn, err := openInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+
+	// Read the header once to pick the decoder, which then reads it again
+	header := bytes.NewBuffer([]byte{})
+	h, err := codec.ReadHeaderWithRegistry(io.TeeReader(in, header), registry)
+	if err != nil {
+		return err
+	}
+	packet := io.MultiReader(header, in)
+	if h.Flags&codec.STREAMED > 0 {
+		return decodeStream(packet, *out, stdout)
+	}
+
+	decoder, err := codec.NewDecoderWithRegistry(packet, registry)
+	if err != nil {
+		return err
+	}
+	p, err := decoder.Read()
+	if err != nil {
+		return err
+	}
+
+	w, closeOut, err := openOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	if err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+// Decode a STREAMED packet block by block, so the payload is never held in
+// memory.
+func decodeStream(packet io.Reader, out string, stdout io.Writer) error {
+	decoder, err := codec.NewStreamDecoder(packet)
+	if err != nil {
+		return err
+	}
+	w, closeOut, err := openOutput(out, stdout)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, decoder)
+	if err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+func trainCmd(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("train", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "", "Write the model to this file instead of stdout")
+	maxLen := fs.Uint("maxlen", 0, "Limit the length of every pattern to this many bits")
+	smoothing := fs.Uint64("smooth", 1, "Count added to every byte so bytes missing from the samples still get a pattern")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	trainer := huffman.NewTrainer()
+	trainer.SetSmoothing(*smoothing)
+	if fs.NArg() == 0 {
+		_, err = trainer.AddReader(stdin, 1)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		_, err = trainer.AddReader(f, 1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var m *huffman.Model
+	if *maxLen > 0 {
+		m, err = trainer.ModelWithMaxLen(*maxLen)
+	} else {
+		m, err = trainer.Model()
+	}
+	if err != nil {
+		return err
+	}
+	b, err := m.MarshalModel()
+	if err != nil {
+		return err
+	}
+
+	w, closeOut, err := openOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+func inspectCmd(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var modelFiles fileList
+	fs.Var(&modelFiles, "model", "Model saved by 'ikuhuff train' to look up the ID of a HAS_MODEL_ID packet in. Can be repeated")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	registry, err := loadRegistry(modelFiles)
+	if err != nil {
+		return err
+	}
+
+	in, closeIn, err := openInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+	packet, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	h, err := codec.ReadHeaderWithRegistry(bytes.NewReader(packet), registry)
+	if err != nil {
+		return err
+	}
+	decoder, err := codec.NewDecoderWithRegistry(bytes.NewReader(packet), registry)
+	if err != nil {
+		return err
+	}
+	payload, err := decoder.Read()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Version:    %#x\n", h.Version)
+	fmt.Fprintf(stdout, "Flags:      0x%04x %s\n", h.Flags, flagNames(h.Flags))
+	fmt.Fprintf(stdout, "Coder:      %s\n", coderName(h.Flags))
+	fmt.Fprintf(stdout, "PayloadLen: %d\n", h.PayloadLen)
+	if h.Flags&codec.BLOCK_INDEX > 0 {
+		fmt.Fprintf(stdout, "BlockSize:  %d\n", h.BlockSymbols)
+	}
+	if h.Flags&codec.PARALLEL > 0 {
+		fmt.Fprintf(stdout, "ChunkSize:  %d\n", h.ChunkSymbols)
+	}
+	if h.Flags&codec.HAS_MODEL_ID > 0 {
+		fmt.Fprintf(stdout, "ModelID:    0x%08x\n", h.ModelID)
+	}
+	fmt.Fprintf(stdout, "Packet:     %d bytes\n", len(packet))
+	fmt.Fprintf(stdout, "Payload:    %d bytes\n", len(payload))
+	if len(payload) > 0 {
+		fmt.Fprintf(stdout, "Ratio:      %.3f\n", float64(len(packet))/float64(len(payload)))
+	}
+
+	// Code lengths for huffman, frequencies out of 32768 for rANS
+	values, err := h.Model.MarshalAlphabet(huffman.DefaultAlphabet())
+	if err != nil {
+		return err
+	}
+	title := "Code lengths"
+	if h.Flags&codec.CODER_MASK == codec.CODER_RANS {
+		title = "Frequencies"
+	}
+	if h.Flags&codec.HAS_MODEL > 0 {
+		fmt.Fprintf(stdout, "\n%s (from packet):\n", title)
+	} else if h.Flags&codec.HAS_MODEL_ID > 0 {
+		fmt.Fprintf(stdout, "\n%s (model 0x%08x):\n", title, h.ModelID)
+	} else {
+		fmt.Fprintf(stdout, "\n%s (default model):\n", title)
+	}
+	for symbol, v := range modelValues(h.Flags, values) {
+		if v == 0 {
+			continue
+		}
+		fmt.Fprintf(stdout, "  0x%02x %-6s %d\n", symbol, printable(byte(symbol)), v)
+	}
+	return nil
+}
+
+// The code length or frequency of each symbol from the marshalled model.
+func modelValues(flags uint16, p []byte) []int {
+	if flags&codec.CODER_MASK == codec.CODER_RANS {
+		values := make([]int, len(p)/2)
+		for i := range values {
+			values[i] = int(binary.LittleEndian.Uint16(p[2*i:]))
+		}
+		return values
+	}
+	values := make([]int, len(p))
+	for i, l := range p {
+		values[i] = int(l)
+	}
+	return values
+}
+
+func coderName(flags uint16) string {
+	if flags&codec.CODER_MASK == codec.CODER_RANS {
+		return "rans"
+	}
+	return "huffman"
+}
+
+// The names of the set flags, e.g. "HAS_MODEL|STREAMED"
+func flagNames(flags uint16) string {
+	names := []struct {
+		flag uint16
+		name string
+	}{
+		{codec.HAS_MODEL, "HAS_MODEL"},
+		{codec.ADAPTIVE_MODEL, "ADAPTIVE_MODEL"},
+		{codec.STREAMED, "STREAMED"},
+		{codec.HAS_CHECKSUM, "HAS_CHECKSUM"},
+		{codec.BLOCK_INDEX, "BLOCK_INDEX"},
+		{codec.PARALLEL, "PARALLEL"},
+		{codec.HAS_MODEL_ID, "HAS_MODEL_ID"},
+		{codec.COMPACT_MODEL, "COMPACT_MODEL"},
+		{codec.CODER_RANS, "CODER_RANS"},
+	}
+
+	s := ""
+	for _, n := range names {
+		if flags&n.flag == 0 {
+			continue
+		}
+		if s != "" {
+			s += "|"
+		}
+		s += n.name
+		flags &^= n.flag
+	}
+	if flags != 0 {
+		if s != "" {
+			s += "|"
+		}
+		s += fmt.Sprintf("0x%04x", flags)
+	}
+	return s
+}
+
+func printable(b byte) string {
+	if b >= 0x20 && b < 0x7f {
+		return fmt.Sprintf("'%c'", b)
+	}
+	return ""
+}
+
+func loadModel(name string) (*huffman.Model, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// Either the output of train or a list of 256 lengths as in the
+	// HuffmanTree of a packet
+	m := &huffman.Model{}
+	if huffman.IsMarshalledModel(b) {
+		err = m.UnmarshalModel(b)
+	} else {
+		err = m.UnmarshalBinary(huffman.DefaultAlphabet(), b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load model %s: %v", name, err)
+	}
+	return m, nil
+}
+
+// Load each model and register it under its hashed ID, see codec.ModelID.
+func loadRegistry(names []string) (*codec.ModelRegistry, error) {
+	registry := codec.NewModelRegistry()
+	for _, name := range names {
+		m, err := loadModel(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = registry.RegisterModel(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// A flag which can be given more than once
+type fileList []string
+
+func (this *fileList) String() string {
+	return fmt.Sprint(*this)
+}
+
+func (this *fileList) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
+// Open the single input file, or stdin if no file is given.
+func openInput(args []string, stdin io.Reader) (io.Reader, func() error, error) {
+	switch len(args) {
+	case 0:
+		return stdin, func() error { return nil }, nil
+	case 1:
+		f, err := os.Open(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("Expected at most one input file, got %d", len(args))
+	}
+}
+
+// Create the output file, or use stdout if no file is given.
+func openOutput(name string, stdout io.Writer) (io.Writer, func() error, error) {
+	if name == "" {
+		return stdout, func() error { return nil }, nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const mainTestText = `{"level":"info","msg":"request served","status":200}
+{"level":"warn","msg":"request slow","status":200}
+{"level":"info","msg":"request served","status":404}
+`
+
+func runCmd(t *testing.T, stdin []byte, args ...string) []byte {
+	stdout := bytes.NewBuffer([]byte{})
+	stderr := bytes.NewBuffer([]byte{})
+	code := run(args, bytes.NewReader(stdin), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("ikuhuff %v exited with %d: %s", args, code, stderr.String())
+	}
+	return stdout.Bytes()
+}
+
+func TestMain_EncodeDecode(t *testing.T) {
+	for _, flags := range [][]string{
+		{},
+		{"-embed"},
+		{"-adaptive"},
+		{"-stream"},
+		{"-checksum"},
+		{"-stream", "-checksum"},
+		{"-index", "7"},
+		{"-index", "7", "-adaptive", "-checksum"},
+		{"-parallel", "5", "-checksum"},
+		{"-coder", "rans", "-adaptive", "-embed"},
+		{"-coder", "rans", "-stream"},
+		{"-adaptive", "-compact", "-checksum"},
+	} {
+		args := append([]string{"encode"}, flags...)
+		packet := runCmd(t, []byte(mainTestText), args...)
+		got := runCmd(t, packet, "decode")
+		if string(got) != mainTestText {
+			t.Errorf("Failed to decode with %v, got %q", flags, got)
+		}
+	}
+}
+
+func TestMain_DecodeStream(t *testing.T) {
+	src := bytes.Repeat([]byte(mainTestText), 1<<16)
+	packet := runCmd(t, src, "encode", "-stream", "-checksum")
+
+	// Hash the output as it is written rather than keeping it
+	got := crc32.NewIEEE()
+	stderr := bytes.NewBuffer([]byte{})
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	code := run([]string{"decode"}, bytes.NewReader(packet), got, stderr)
+	runtime.ReadMemStats(&after)
+	if code != 0 {
+		t.Fatalf("ikuhuff decode exited with %d: %s", code, stderr.String())
+	}
+	if got.Sum32() != crc32.ChecksumIEEE(src) {
+		t.Errorf("Streamed payload does not match")
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(src))/4 {
+		t.Errorf("Decoding a %d byte stream allocated %d bytes", len(src), alloc)
+	}
+}
+
+func TestMain_TrainEncodeInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikuhuff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sample := filepath.Join(dir, "sample.json")
+	model := filepath.Join(dir, "model.bin")
+	packet := filepath.Join(dir, "packet.iku")
+	decoded := filepath.Join(dir, "decoded.json")
+	err = ioutil.WriteFile(sample, []byte(mainTestText), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, nil, "train", "-maxlen", "15", "-o", model, sample)
+	runCmd(t, nil, "encode", "-model", model, "-o", packet, sample)
+	runCmd(t, nil, "decode", "-o", decoded, packet)
+
+	got, err := ioutil.ReadFile(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != mainTestText {
+		t.Errorf("Failed to decode with the trained model, got %q", got)
+	}
+
+	out := string(runCmd(t, nil, "inspect", packet))
+	for _, want := range []string{
+		"Version:    0x54",
+		"HAS_MODEL",
+		"PayloadLen: " + "157",
+		"Ratio:",
+		"Code lengths (from packet):",
+		"0x7b '{'",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inspect output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMain_TrainWithoutSmoothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikuhuff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only the bytes of the sample get a pattern, so the model is narrow
+	sample := filepath.Join(dir, "sample.json")
+	model := filepath.Join(dir, "model.bin")
+	err = ioutil.WriteFile(sample, []byte(mainTestText), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range [][]string{{"-smooth", "0"}, {"-smooth", "0", "-maxlen", "9"}} {
+		runCmd(t, nil, append(append([]string{"train"}, flags...), "-o", model, sample)...)
+		for _, encodeFlags := range [][]string{{"-model", model}, {"-model", model, "-compact"}, {"-model", model, "-id"}} {
+			packet := runCmd(t, nil, append(append([]string{"encode"}, encodeFlags...), sample)...)
+			got := runCmd(t, packet, "decode", "-model", model)
+			if string(got) != mainTestText {
+				t.Errorf("Failed to decode with train %v and encode %v, got %q", flags, encodeFlags, got)
+			}
+		}
+	}
+}
+
+func TestMain_InspectRANS(t *testing.T) {
+	packet := runCmd(t, []byte(mainTestText), "encode", "-coder", "rans", "-adaptive", "-embed")
+	out := string(runCmd(t, packet, "inspect"))
+	for _, want := range []string{"CODER_RANS", "Coder:      rans", "Frequencies (from packet):", "0x7b '{'"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inspect output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMain_ModelID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikuhuff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sample := filepath.Join(dir, "sample.json")
+	model := filepath.Join(dir, "model.bin")
+	err = ioutil.WriteFile(sample, []byte(mainTestText), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, nil, "train", "-o", model, sample)
+	packet := runCmd(t, nil, "encode", "-model", model, "-id", sample)
+
+	got := runCmd(t, packet, "decode", "-model", model)
+	if string(got) != mainTestText {
+		t.Errorf("Failed to decode with the model ID, got %q", got)
+	}
+	out := string(runCmd(t, packet, "inspect", "-model", model))
+	for _, want := range []string{"HAS_MODEL_ID", "ModelID:    0x", "Code lengths (model 0x"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inspect output is missing %q:\n%s", want, out)
+		}
+	}
+
+	// Without the model the ID can not be resolved
+	code := run([]string{"decode"}, bytes.NewReader(packet), ioutil.Discard, ioutil.Discard)
+	if code == 0 {
+		t.Errorf("Expected decode to fail without the model")
+	}
+}
+
+func TestMain_Errors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"encode", "-stream", "-adaptive"},
+		{"decode", "/does/not/exist"},
+		{"encode", "-model", "/does/not/exist"},
+		{"encode", "-id"},
+		{"encode", "-coder", "arithmetic"},
+	} {
+		stderr := bytes.NewBuffer([]byte{})
+		code := run(args, bytes.NewReader(nil), ioutil.Discard, stderr)
+		if code == 0 {
+			t.Errorf("Expected ikuhuff %v to fail", args)
+		}
+		if stderr.Len() == 0 {
+			t.Errorf("Expected ikuhuff %v to print an error", args)
+		}
+	}
+}
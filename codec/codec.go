@@ -1,127 +1,527 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/Stymphalian/iku_huffman/huffman"
 )
 
 const (
-	VERSION   = uint16(0x53)
+	// Current version, the model covers all 256 byte values
+	VERSION = uint16(0x54)
+	// Original version, the model only covers the 128 ASCII characters
+	VERSION_ASCII = uint16(0x53)
+
 	HAS_MODEL = 0x0001
+	// Build a model from the payload itself and store it in the packet.
+	// Always written together with HAS_MODEL so that decoders only need to
+	// look at HAS_MODEL to know a model follows the header.
+	ADAPTIVE_MODEL = 0x0002
+	// The payload is split into blocks which are each prefixed by their
+	// length. Written by a StreamEncoder when the length is not known up front.
+	STREAMED = 0x0004
+	// The packet has a CRC-32C of the uncompressed payload and of the header.
+	HAS_CHECKSUM = 0x0008
+	// The payload is written in fixed size blocks which each start on a byte
+	// boundary, followed by an index of where each block starts. Lets an
+	// IndexedDecoder read from the middle of the payload.
+	BLOCK_INDEX = 0x0010
+	// The payload is split into chunks which are encoded and decoded on
+	// separate goroutines. A table of the encoded size of each chunk comes
+	// before the chunks.
+	PARALLEL = 0x0020
+	// The packet has the ID of the model it was encoded with, which the
+	// decoder looks up in its ModelRegistry. Can not be used with HAS_MODEL.
+	HAS_MODEL_ID = 0x0040
+	// The model after the header is written with huffman.MarshalCompact, a
+	// list of the symbols in it and their packed lengths, instead of a length
+	// for every symbol. Only for the huffman coder.
+	COMPACT_MODEL = 0x0080
+	// Bits 8 and 9 of the flags hold the entropy coder the payload and model
+	// are for. Huffman is 0 so packets from before there was a choice still
+	// decode.
+	CODER_MASK    = 0x0300
+	CODER_HUFFMAN = 0x0000
+	// Range asymmetric numeral system, see huffman.RANSModel
+	CODER_RANS = 0x0100
 )
 
+const (
+	// The largest payload a Decoder accepts unless SetOptions says otherwise
+	kDEFAULT_MAX_PAYLOAD_LEN = 1 << 30
+	// Payloads are decoded this many bytes at a time
+	kDECODE_CHUNK_LEN = 64 * 1024
+)
+
+// Checksums use CRC-32C (Castagnoli)
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Encoder struct {
-	w  io.Writer
-	m  *huffman.Model
-	hw *huffman.Writer
+	w io.Writer
+	// nil to use the default model of whichever coder the flags select
+	m huffman.Coder
+	// Number of symbols in each block when writing a BLOCK_INDEX packet
+	blockSymbols uint32
+	// Number of symbols in each chunk when writing a PARALLEL packet
+	chunkSymbols uint32
+	// Maximum number of goroutines used for a PARALLEL packet, 0 for
+	// GOMAXPROCS
+	workers int
+	// ID of the model written with HAS_MODEL_ID, only set when created from a
+	// registry
+	modelID    uint32
+	hasModelID bool
+	// Write MAGIC before every packet, see SetMagic
+	magic bool
 }
 
+// Create an Encoder which encodes payloads with the default model of the
+// entropy coder selected by the flags passed to Write.
 func NewEncoder(w io.Writer) (*Encoder, error) {
-	m := huffman.DefaultModel()
-	hw, err := huffman.NewWriter(w, m)
+	return newEncoder(w, nil), nil
+}
+
+// Create an Encoder which encodes payloads with the given model, a
+// *huffman.Model or a *huffman.RANSModel. Write must be given the flags of
+// the model's entropy coder. Decoders assume the default model, so the model
+// must be included in the packet with HAS_MODEL unless the decoder is told
+// about it some other way. Fails with huffman.ErrInvalidModel for a model a
+// Decoder would refuse.
+func NewEncoderWithModel(w io.Writer, m huffman.Coder) (*Encoder, error) {
+	if m == nil {
+		return nil, errors.New("Encoder requires a model")
+	}
+	_, err := coderFlags(m)
+	if err != nil {
+		return nil, err
+	}
+	err = checkModel(m)
+	if err != nil {
+		return nil, err
+	}
+	return newEncoder(w, m), nil
+}
+
+func newEncoder(w io.Writer, m huffman.Coder) *Encoder {
+	return &Encoder{
+		w:            w,
+		m:            m,
+		blockSymbols: kDEFAULT_INDEX_BLOCK_SYMBOLS,
+		chunkSymbols: kDEFAULT_PARALLEL_CHUNK_SYMBOLS,
+	}
+}
+
+// Create an Encoder which encodes payloads with the model registered under the
+// ID. Packets written with HAS_MODEL_ID carry the ID instead of the model.
+func NewEncoderWithRegistry(w io.Writer, registry *ModelRegistry, id uint32) (*Encoder, error) {
+	m, err := registry.Lookup(id)
 	if err != nil {
 		return nil, err
 	}
-	return &Encoder{w, m, hw}, nil
+	e, err := NewEncoderWithModel(w, m)
+	if err != nil {
+		return nil, err
+	}
+	e.modelID = id
+	e.hasModelID = true
+	return e, nil
+}
+
+// Set the number of symbols in each block of a BLOCK_INDEX packet. Smaller
+// blocks mean less has to be decoded to reach any offset but a larger index.
+func (this *Encoder) SetIndexBlockSize(symbols uint32) error {
+	if symbols == 0 {
+		return errors.New("Index block size must be at least 1 symbol")
+	}
+	this.blockSymbols = symbols
+	return nil
 }
 
+// Set the number of symbols in each chunk of a PARALLEL packet. The chunks
+// only depend on this size, so the packet is the same however many goroutines
+// are used.
+func (this *Encoder) SetParallelChunkSize(symbols uint32) error {
+	if symbols == 0 {
+		return errors.New("Parallel chunk size must be at least 1 symbol")
+	}
+	this.chunkSymbols = symbols
+	return nil
+}
+
+// Set the maximum number of goroutines used to encode a PARALLEL packet.
+// 0 uses GOMAXPROCS.
+func (this *Encoder) SetWorkers(n int) {
+	this.workers = n
+}
+
+// Write p as one packet with the flags. Nothing is written to the underlying
+// io.Writer if the packet can not be encoded.
 func (this *Encoder) Write(p []byte, flags uint16) (int, error) {
-	err := binary.Write(this.w, binary.LittleEndian, VERSION)
+	if flags&STREAMED > 0 {
+		return 0, fmt.Errorf("STREAMED packets must be written with a StreamEncoder")
+	}
+	if flags&BLOCK_INDEX > 0 && this.blockSymbols == 0 {
+		return 0, errors.New("Index block size must be at least 1 symbol")
+	}
+	if flags&PARALLEL > 0 && flags&BLOCK_INDEX > 0 {
+		return 0, fmt.Errorf("%w, PARALLEL can not be used with BLOCK_INDEX", ErrInvalidFlags)
+	}
+	if flags&HAS_MODEL_ID > 0 {
+		if !this.hasModelID {
+			return 0, errors.New("HAS_MODEL_ID requires an Encoder created with NewEncoderWithRegistry")
+		}
+		if flags&(HAS_MODEL|ADAPTIVE_MODEL) > 0 {
+			return 0, fmt.Errorf("%w, HAS_MODEL_ID can not be used with HAS_MODEL or ADAPTIVE_MODEL", ErrInvalidFlags)
+		}
+	}
+
+	coder, err := findCoder(flags)
+	if err != nil {
+		return 0, err
+	}
+	err = checkCompact(flags)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(this.w, binary.LittleEndian, flags)
+	m := this.m
+	if m == nil {
+		m = coder.defaultModel()
+	}
+	err = checkCoder(m, flags)
 	if err != nil {
 		return 0, err
 	}
+	if flags&ADAPTIVE_MODEL > 0 {
+		// An empty payload has no symbols to build a model from, so it falls
+		// back to the default model.
+		if len(p) > 0 {
+			m, err = coder.createModel(p)
+			if err != nil {
+				return 0, err
+			}
+		}
+		flags |= HAS_MODEL
+	}
 
-	err = binary.Write(this.w, binary.LittleEndian, uint64(len(p)))
+	h := &Header{Version: VERSION, Flags: flags, PayloadLen: uint64(len(p)), Model: m}
+	if flags&HAS_CHECKSUM > 0 {
+		h.Checksum = crc32.Checksum(p, castagnoliTable)
+	}
+	if flags&BLOCK_INDEX > 0 {
+		h.BlockSymbols = this.blockSymbols
+	}
+	if flags&PARALLEL > 0 {
+		h.ChunkSymbols = this.chunkSymbols
+	}
+	if flags&HAS_MODEL_ID > 0 {
+		h.ModelID = this.modelID
+	}
+
+	// The packet is built up first so that nothing is written if it fails,
+	// a stray MAGIC would look like a broken packet to a Decoder.
+	buf := bytes.NewBuffer([]byte{})
+	if this.magic {
+		binary.Write(buf, binary.LittleEndian, MAGIC)
+	}
+	err = writeHeader(buf, h)
+	if err != nil {
+		return 0, err
+	}
+	n, err := this.writePayload(buf, h, p)
+	if err != nil {
+		return 0, err
+	}
+	_, err = this.w.Write(buf.Bytes())
 	if err != nil {
 		return 0, err
 	}
+	return n, nil
+}
 
-	// Optionally write the huffman tree model
-	// not needed assuming that the Decoder know what model to use.
-	if flags&HAS_MODEL > 0 {
-		bs, err := this.m.MarshalBinary()
-		if err != nil {
-			return 0, nil
-		}
-		this.w.Write(bs)
+func (this *Encoder) writePayload(w io.Writer, h *Header, p []byte) (int, error) {
+	if h.Flags&BLOCK_INDEX > 0 {
+		return writeIndexedPayload(w, h.Model, p, h.BlockSymbols)
+	}
+	if h.Flags&PARALLEL > 0 {
+		return writeParallelPayload(w, h.Model, p, h.ChunkSymbols, this.workers)
 	}
 
 	// Write the paylaod
-	n, err := this.hw.Write(p)
+	hw, err := h.Model.NewSymbolWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	n, err := hw.Write(p)
 	if err != nil {
 		return n, err
 	}
-	err = this.hw.Close()
+	err = hw.Close()
 	return n, err
 }
 
+// Limits on the packets a Decoder accepts, for streams from untrusted
+// sources. The zero value has no limits.
+type DecoderOptions struct {
+	// Largest payload decoded, 0 for no limit
+	MaxPayloadLen uint64
+	// Largest ratio of the decoded payload to the encoded packet, 0 for no
+	// limit. A huffman code takes at least 1 bit per symbol, but a rANS code
+	// can take far less, so a tiny packet can decode to a huge payload.
+	MaxExpansionRatio uint64
+	// Fail if anything follows the packet in the stream. Only for Read, as
+	// with Next the next packet follows. Next reads whatever follows the
+	// last packet as another packet, so it fails on trailing data anyway
+	// unless Resync skips it.
+	RejectTrailingData bool
+	// Every packet is preceded by MAGIC (Encoder.SetMagic). Anything before
+	// a MAGIC is skipped, so after a packet fails to decode the Decoder picks
+	// up again at the next MAGIC.
+	Resync bool
+}
+
+// The options of a new Decoder, payloads of up to 1 GiB.
+func DefaultDecoderOptions() DecoderOptions {
+	return DecoderOptions{MaxPayloadLen: kDEFAULT_MAX_PAYLOAD_LEN}
+}
+
+// Fail if the PayloadLen of a header is over the limit.
+func (this DecoderOptions) checkPayloadLen(n uint64) error {
+	if this.MaxPayloadLen > 0 && n > this.MaxPayloadLen {
+		return fmt.Errorf("%w, %d bytes is over the limit of %d", ErrPayloadTooLarge, n, this.MaxPayloadLen)
+	}
+	return nil
+}
+
+// Fail if the decoded bytes of a payload are over the limits, where encoded
+// is how much of the packet has been read to decode them.
+func (this DecoderOptions) check(decoded uint64, encoded uint64) error {
+	err := this.checkPayloadLen(decoded)
+	if err != nil {
+		return err
+	}
+	// decoded > ratio*encoded without the multiplication overflowing
+	if this.MaxExpansionRatio > 0 && decoded > 0 && (decoded-1)/this.MaxExpansionRatio >= encoded {
+		return fmt.Errorf("%w, %d bytes decoded from %d is over the ratio of %d",
+			ErrTooMuchExpansion, decoded, encoded, this.MaxExpansionRatio)
+	}
+	return nil
+}
+
 type Decoder struct {
 	r io.Reader
+	// Maximum number of goroutines used for a PARALLEL packet, 0 for
+	// GOMAXPROCS
+	workers int
+	// Resolves the model of HAS_MODEL_ID packets, may be nil
+	registry *ModelRegistry
+	opts     DecoderOptions
+
+	// Keeps the bytes of the current packet when resyncing, created on the
+	// first Read with DecoderOptions.Resync
+	replay *replayReader
+	// The last packet read by Next and why Next stopped
+	payload []byte
+	err     error
+	// Number of packets Next skipped with DecoderOptions.Resync
+	skipped int
 }
 
 func NewDecoder(r io.Reader) (*Decoder, error) {
-	return &Decoder{r}, nil
+	return NewDecoderWithRegistry(r, nil)
+}
+
+// Create a Decoder which looks up the model of HAS_MODEL_ID packets in the
+// registry.
+func NewDecoderWithRegistry(r io.Reader, registry *ModelRegistry) (*Decoder, error) {
+	return &Decoder{r: r, registry: registry, opts: DefaultDecoderOptions()}, nil
+}
+
+// Set the maximum number of goroutines used to decode a PARALLEL packet.
+// 0 uses GOMAXPROCS.
+func (this *Decoder) SetWorkers(n int) {
+	this.workers = n
 }
 
+// Set the limits on the packets read, DefaultDecoderOptions until then.
+func (this *Decoder) SetOptions(opts DecoderOptions) {
+	this.opts = opts
+}
+
+// Read the next packet of the stream and return its payload. Returns io.EOF
+// only when the stream ends cleanly between packets, a packet cut short
+// fails with io.ErrUnexpectedEOF. With DecoderOptions.Resync the next Read
+// after an error starts looking for a MAGIC just after the one of the
+// packet which failed.
 func (this *Decoder) Read() ([]byte, error) {
-	var version uint16
-	var flags uint16
-	var payloadLen uint64
+	return this.read(this.opts.RejectTrailingData)
+}
+
+func (this *Decoder) read(rejectTrailing bool) ([]byte, error) {
+	if !this.opts.Resync {
+		return this.readPacket(this.r, rejectTrailing)
+	}
 
-	err := binary.Read(this.r, binary.LittleEndian, &version)
+	if this.replay == nil {
+		this.replay = &replayReader{r: this.r}
+	}
+	err := findMagic(this.replay)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(this.r, binary.LittleEndian, &flags)
+	this.replay.mark()
+	p, err := this.readPacket(this.replay, rejectTrailing)
+	if err == io.EOF {
+		// A MAGIC is always followed by a packet
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
+		this.replay.rewind()
 		return nil, err
 	}
-	err = binary.Read(this.r, binary.LittleEndian, &payloadLen)
+	return p, nil
+}
+
+func (this *Decoder) readPacket(r io.Reader, rejectTrailing bool) ([]byte, error) {
+	packet := &countingReader{r: r}
+	h, err := ReadHeaderWithRegistry(packet, this.registry)
 	if err != nil {
 		return nil, err
 	}
+	check := func(decoded uint64) error {
+		return this.opts.check(decoded, packet.n)
+	}
 
-	var m *huffman.Model
-	// Optionally write the huffman tree
-	if flags&HAS_MODEL > 0 {
-		m = &huffman.Model{}
-		alphabet := huffman.DefaultAlphabet()
-		tree := make([]byte, 0)
-		for i := 0; i < len(alphabet); i++ {
-			var b byte
-			err := binary.Read(this.r, binary.LittleEndian, &b)
-			if err != nil {
-				return nil, err
-			}
-			tree = append(tree, b)
+	if h.Flags&STREAMED == 0 {
+		err = this.opts.checkPayloadLen(h.PayloadLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var p []byte
+	if h.Flags&STREAMED > 0 {
+		// The length is not known up front, read all of the blocks.
+		p, err = readAllLimited(newStreamDecoder(packet, h), check)
+		if err != nil {
+			return nil, err
 		}
-		err := m.UnmarshalBinary(alphabet, tree)
+	} else if h.Flags&BLOCK_INDEX > 0 {
+		p, err = readIndexedPayload(packet, h, check)
+		if err != nil {
+			return nil, err
+		}
+	} else if h.Flags&PARALLEL > 0 {
+		p, err = readParallelPayload(packet, h, this.workers, check)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		m = huffman.DefaultModel()
+		hr, err := h.Model.NewSymbolReader(packet)
+		if err != nil {
+			return nil, err
+		}
+		p, err = readSymbols(nil, hr, h.PayloadLen, check)
+		if err != nil {
+			return nil, err
+		}
+		err = hr.Finish()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	hr, err := huffman.NewReader(this.r, m)
-	if err != nil {
-		return nil, err
+	// STREAMED packets check their blocks and total as they are read
+	if h.Flags&(HAS_CHECKSUM|STREAMED) == HAS_CHECKSUM && crc32.Checksum(p, castagnoliTable) != h.Checksum {
+		return nil, ErrChecksumMismatch
 	}
-
-	p := make([]byte, payloadLen)
-	n, err := hr.Read(p)
-	if err != nil {
-		return nil, err
+	if rejectTrailing {
+		n, err := r.Read(make([]byte, 1))
+		if n > 0 {
+			return nil, ErrTrailingData
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
 	}
-	if uint64(n) != payloadLen {
-		return nil, fmt.Errorf("Failed to read %d symbols from the stream.", n)
+	return p, nil
+}
+
+// Decode n symbols and append them to p a chunk at a time, so that memory
+// only grows with the symbols the packet really holds rather than with the
+// PayloadLen it claims. The decoded length is checked after each chunk.
+func readSymbols(p []byte, hr io.Reader, n uint64, check func(decoded uint64) error) ([]byte, error) {
+	for n > 0 {
+		size := n
+		if size > kDECODE_CHUNK_LEN {
+			size = kDECODE_CHUNK_LEN
+		}
+		start := len(p)
+		p = append(p, make([]byte, size)...)
+		_, err := hr.Read(p[start:])
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		n -= size
+		err = check(uint64(len(p)))
+		if err != nil {
+			return nil, err
+		}
 	}
 	return p, nil
 }
+
+// Read everything up to io.EOF a chunk at a time, checking the decoded length
+// after each chunk.
+func readAllLimited(r io.Reader, check func(decoded uint64) error) ([]byte, error) {
+	p := make([]byte, 0)
+	buf := make([]byte, kDECODE_CHUNK_LEN)
+	for {
+		n, err := r.Read(buf)
+		p = append(p, buf[:n]...)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = check(uint64(len(p)))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Read exactly n bytes, growing the buffer as the bytes arrive instead of
+// trusting n up front.
+func readLimited(r io.Reader, n uint64) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	for n > 0 {
+		size := n
+		if size > kDECODE_CHUNK_LEN {
+			size = kDECODE_CHUNK_LEN
+		}
+		_, err := io.CopyN(buf, r, int64(size))
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		n -= size
+	}
+	return buf.Bytes(), nil
+}
+
+// Counts the bytes read from a packet, for DecoderOptions.MaxExpansionRatio.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += uint64(n)
+	return n, err
+}
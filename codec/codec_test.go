@@ -2,10 +2,14 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
 )
 
 func TestCodec_Simple(t *testing.T) {
@@ -53,3 +57,398 @@ func TestCodec_Simple(t *testing.T) {
 		t.Errorf("payload was not retrieved. got = %v, want = %v\n", got, src)
 	}
 }
+
+func TestCodec_BinaryPayload(t *testing.T) {
+	src := make([]byte, 0)
+	for i := 0; i < 256; i++ {
+		src = append(src, byte(i), byte(255-i))
+	}
+
+	for _, flags := range []uint16{0, HAS_MODEL} {
+		buf := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := encoder.Write(src, flags)
+		if err != nil {
+			t.Fatalf("Failed to write binary payload with flags %#x: %v", flags, err)
+		}
+		if n != len(src) {
+			t.Errorf("Failed to write payload, only wrote %d bytes out of %d",
+				n, len(src))
+		}
+
+		decoder, err := NewDecoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoder.Read()
+		if err != nil {
+			t.Fatalf("Failed to read binary payload with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %v, want = %v\n", got, src)
+		}
+	}
+}
+
+func TestCodec_ReadASCIIVersion(t *testing.T) {
+	// Hand build a packet the way the original 128 symbol encoder did.
+	src := []byte("hello world")
+	m := huffman.ASCIIModel()
+	for _, flags := range []uint16{0, HAS_MODEL} {
+		buf := bytes.NewBuffer([]byte{})
+		binary.Write(buf, binary.LittleEndian, VERSION_ASCII)
+		binary.Write(buf, binary.LittleEndian, flags)
+		binary.Write(buf, binary.LittleEndian, uint64(len(src)))
+		if flags&HAS_MODEL > 0 {
+			bs, err := m.MarshalAlphabet(huffman.ASCIIAlphabet())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bs) != 128 {
+				t.Fatalf("ASCII model should have 128 symbols but has %d", len(bs))
+			}
+			buf.Write(bs)
+		}
+		hw, err := huffman.NewWriter(buf, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hw.Write(src)
+		hw.Close()
+
+		decoder, err := NewDecoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoder.Read()
+		if err != nil {
+			t.Fatalf("Failed to read ASCII packet with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %v, want = %v\n", got, src)
+		}
+	}
+}
+
+func TestCodec_UnsupportedVersion(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, uint16(0x01))
+	binary.Write(buf, binary.LittleEndian, uint16(0))
+	binary.Write(buf, binary.LittleEndian, uint64(1))
+	buf.WriteByte(0x00)
+
+	decoder, err := NewDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decoder.Read()
+	if err == nil {
+		t.Errorf("Expected an error for an unknown version")
+	}
+}
+
+func TestCodec_AdaptiveModel(t *testing.T) {
+	src := []byte(`{"level":"info","msg":"request served","status":200}` +
+		`{"level":"warn","msg":"request slow","status":200}`)
+
+	sizes := make(map[uint16]int)
+	for _, flags := range []uint16{HAS_MODEL, ADAPTIVE_MODEL} {
+		buf := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encoder.Write(src, flags)
+		if err != nil {
+			t.Fatalf("Failed to write payload with flags %#x: %v", flags, err)
+		}
+		sizes[flags] = buf.Len()
+
+		decoder, err := NewDecoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoder.Read()
+		if err != nil {
+			t.Fatalf("Failed to read payload with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %s, want = %s\n", got, src)
+		}
+	}
+
+	if sizes[ADAPTIVE_MODEL] >= sizes[HAS_MODEL] {
+		t.Errorf("Adaptive model did not compress better than the default: %d >= %d",
+			sizes[ADAPTIVE_MODEL], sizes[HAS_MODEL])
+	}
+}
+
+func TestCodec_AdaptiveModelEdgeCases(t *testing.T) {
+	for _, src := range [][]byte{
+		[]byte{},
+		[]byte("a"),
+		[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		[]byte{0xff, 0x00, 0xff},
+	} {
+		buf := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encoder.Write(src, ADAPTIVE_MODEL)
+		if err != nil {
+			t.Fatalf("Failed to write payload %v: %v", src, err)
+		}
+
+		decoder, err := NewDecoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoder.Read()
+		if err != nil {
+			t.Fatalf("Failed to read payload %v: %v", src, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %v, want = %v\n", got, src)
+		}
+	}
+}
+
+// Configures the Encoder of encodePacket
+type encodeOption func(encoder *Encoder) error
+
+func withIndexBlockSize(symbols uint32) encodeOption {
+	return func(encoder *Encoder) error {
+		return encoder.SetIndexBlockSize(symbols)
+	}
+}
+
+func withParallelChunkSize(symbols uint32) encodeOption {
+	return func(encoder *Encoder) error {
+		return encoder.SetParallelChunkSize(symbols)
+	}
+}
+
+func withWorkers(n int) encodeOption {
+	return func(encoder *Encoder) error {
+		encoder.SetWorkers(n)
+		return nil
+	}
+}
+
+func withMagic(enabled bool) encodeOption {
+	return func(encoder *Encoder) error {
+		encoder.SetMagic(enabled)
+		return nil
+	}
+}
+
+// Encode src as a single packet with the default model
+func encodePacket(t *testing.T, src []byte, flags uint16, opts ...encodeOption) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	encoder, err := NewEncoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range opts {
+		err = opt(encoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = encoder.Write(src, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeBytes(packet []byte) ([]byte, error) {
+	decoder, err := NewDecoder(bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.Read()
+}
+
+func TestCodec_Checksum(t *testing.T) {
+	src := []byte("hello world, hello checksums")
+	for _, flags := range []uint16{0, HAS_MODEL, ADAPTIVE_MODEL} {
+		packet := encodePacket(t, src, flags|HAS_CHECKSUM)
+		got, err := decodeBytes(packet)
+		if err != nil {
+			t.Fatalf("Failed to decode with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %s, want = %s\n", got, src)
+		}
+	}
+}
+
+func TestCodec_HeaderChecksumMismatch(t *testing.T) {
+	src := []byte("hello world, hello checksums")
+	packet := encodePacket(t, src, HAS_CHECKSUM)
+
+	// Any change to the header is caught by the header checksum
+	for _, offset := range []int{3, 5, 12} {
+		corrupt := append([]byte{}, packet...)
+		corrupt[offset] ^= 0x01
+		_, err := decodeBytes(corrupt)
+		if err != ErrHeaderChecksumMismatch {
+			t.Errorf("Expected ErrHeaderChecksumMismatch for byte %d, got %v", offset, err)
+		}
+	}
+}
+
+func TestCodec_ChecksumMismatchPayload(t *testing.T) {
+	// A model where every symbol has the same length, so any bit flip in the
+	// payload still decodes to the same number of symbols.
+	src := []byte("abcdabcdabcdabcd")
+	packet := encodePacket(t, src, ADAPTIVE_MODEL|HAS_CHECKSUM)
+	packet[len(packet)-1] ^= 0x01
+
+	_, err := decodeBytes(packet)
+	if err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestCodec_CompactModel(t *testing.T) {
+	src := []byte(`{"level":"info","msg":"ok"}`)
+
+	sizes := make(map[uint16]int)
+	for _, flags := range []uint16{
+		ADAPTIVE_MODEL, ADAPTIVE_MODEL | COMPACT_MODEL, ADAPTIVE_MODEL | COMPACT_MODEL | HAS_CHECKSUM,
+		HAS_MODEL | COMPACT_MODEL, COMPACT_MODEL,
+	} {
+		buf := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encoder.Write(src, flags)
+		if err != nil {
+			t.Fatalf("Failed to write payload with flags %#x: %v", flags, err)
+		}
+		sizes[flags] = buf.Len()
+
+		got, err := decodeBytes(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to read payload with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved. got = %s, want = %s\n", got, src)
+		}
+	}
+
+	// The model is most of an adaptive packet of a short message
+	if sizes[ADAPTIVE_MODEL|COMPACT_MODEL]*3 > sizes[ADAPTIVE_MODEL] {
+		t.Errorf("Compact packet is %d bytes, full is %d",
+			sizes[ADAPTIVE_MODEL|COMPACT_MODEL], sizes[ADAPTIVE_MODEL])
+	}
+
+	encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(src, ADAPTIVE_MODEL|COMPACT_MODEL|CODER_RANS); err == nil {
+		t.Errorf("Expected an error for COMPACT_MODEL with the rANS coder")
+	}
+}
+
+func decodeWithOptions(packet []byte, opts DecoderOptions) ([]byte, error) {
+	decoder, err := NewDecoder(bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+	decoder.SetOptions(opts)
+	return decoder.Read()
+}
+
+func TestCodec_HugePayloadLen(t *testing.T) {
+	// Tiny packets which claim a payload of 2^63 bytes
+	for _, flags := range []uint16{0, BLOCK_INDEX, PARALLEL, CODER_RANS} {
+		buf := bytes.NewBuffer([]byte{})
+		binary.Write(buf, binary.LittleEndian, VERSION)
+		binary.Write(buf, binary.LittleEndian, flags)
+		binary.Write(buf, binary.LittleEndian, uint64(1)<<63)
+		if flags&(BLOCK_INDEX|PARALLEL) > 0 {
+			binary.Write(buf, binary.LittleEndian, uint32(1))
+		}
+		buf.Write([]byte{0x00, 0x00, 0x80, 0x00})
+
+		if _, err := decodeBytes(buf.Bytes()); !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("Expected ErrPayloadTooLarge with flags %#x, got %v", flags, err)
+		}
+		// Without any limits the packet runs out long before the payload
+		if _, err := decodeWithOptions(buf.Bytes(), DecoderOptions{}); err == nil {
+			t.Errorf("Expected an error with flags %#x", flags)
+		}
+	}
+}
+
+func TestCodec_DecoderOptions(t *testing.T) {
+	// A payload of one symbol takes no bits at all with rANS
+	src := make([]byte, 100000)
+	for _, flags := range []uint16{ADAPTIVE_MODEL | CODER_RANS, ADAPTIVE_MODEL | CODER_RANS | PARALLEL} {
+		packet := encodePacket(t, src, flags)
+		if _, err := decodeWithOptions(packet, DecoderOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := decodeWithOptions(packet, DecoderOptions{MaxExpansionRatio: 100})
+		if !errors.Is(err, ErrTooMuchExpansion) {
+			t.Errorf("Expected ErrTooMuchExpansion with flags %#x, got %v", flags, err)
+		}
+		_, err = decodeWithOptions(packet, DecoderOptions{MaxPayloadLen: 1000})
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("Expected ErrPayloadTooLarge with flags %#x, got %v", flags, err)
+		}
+	}
+
+	packet := encodePacket(t, []byte("hello world"), HAS_MODEL)
+	opts := DecoderOptions{RejectTrailingData: true}
+	if _, err := decodeWithOptions(packet, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeWithOptions(append(packet, 0), opts); err != ErrTrailingData {
+		t.Errorf("Expected ErrTrailingData, got %v", err)
+	}
+}
+
+func TestCodec_Padding(t *testing.T) {
+	// 'a' = 0, 'b' = 10 and 'c' = 11, so "abc" leaves 3 bits of padding
+	m, err := huffman.CreateModelFromText([]byte("aaaaaaaaaabbbbbccccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range []uint16{HAS_MODEL, HAS_MODEL | BLOCK_INDEX, HAS_MODEL | PARALLEL} {
+		buf := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoderWithModel(buf, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.SetIndexBlockSize(3)
+		encoder.SetParallelChunkSize(3)
+		_, err = encoder.Write([]byte("abcabc"), flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := buf.Bytes()
+		if _, err := decodeBytes(packet); err != nil {
+			t.Fatalf("Failed to decode with flags %#x: %v", flags, err)
+		}
+
+		// Set a padding bit of the last byte of the payload
+		offset := len(packet) - 1
+		if flags&BLOCK_INDEX > 0 {
+			offset -= 2*kINDEX_ENTRY_LEN + 4
+		}
+		packet[offset] |= 0x01
+		if _, err := decodeBytes(packet); !errors.Is(err, huffman.ErrInvalidPadding) {
+			t.Errorf("Expected ErrInvalidPadding with flags %#x, got %v", flags, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+// An entropy coder which a payload can be encoded with, selected by the
+// CODER_MASK bits of the flags.
+type coderInfo struct {
+	name string
+	// Name of the model after the header in the spec
+	modelField string
+	// Number of bytes each symbol of the alphabet takes in the model after
+	// the header
+	symbolLen int
+	// An empty model to unmarshal into
+	newModel func() huffman.Coder
+	// The model used when the packet does not have one
+	defaultModel func() huffman.Coder
+	// Build a model from the payload for ADAPTIVE_MODEL
+	createModel func(p []byte) (huffman.Coder, error)
+	// The fewest encoded bytes which can hold n > 0 symbols
+	minEncodedLen func(n uint64) uint64
+}
+
+var coders = map[uint16]coderInfo{
+	CODER_HUFFMAN: {
+		name:         "huffman",
+		modelField:   "HuffmanTree",
+		symbolLen:    1,
+		newModel:     func() huffman.Coder { return &huffman.Model{} },
+		defaultModel: func() huffman.Coder { return huffman.DefaultModel() },
+		createModel: func(p []byte) (huffman.Coder, error) {
+			return huffman.CreateModelFromText(p)
+		},
+		// Every pattern is at least 1 bit
+		minEncodedLen: func(n uint64) uint64 { return (n-1)/8 + 1 },
+	},
+	CODER_RANS: {
+		name:         "rans",
+		modelField:   "FreqTable",
+		symbolLen:    2,
+		newModel:     func() huffman.Coder { return &huffman.RANSModel{} },
+		defaultModel: func() huffman.Coder { return huffman.DefaultRANSModel() },
+		createModel: func(p []byte) (huffman.Coder, error) {
+			return huffman.CreateRANSModelFromText(p)
+		},
+		// Symbols may take almost no bits, but the 32 bit state is always
+		// written
+		minEncodedLen: func(n uint64) uint64 { return 4 },
+	},
+}
+
+// Find the entropy coder selected by the flags.
+func findCoder(flags uint16) (coderInfo, error) {
+	coder, ok := coders[flags&CODER_MASK]
+	if !ok {
+		return coderInfo{}, fmt.Errorf("%w %#x", ErrUnsupportedCoder, flags&CODER_MASK)
+	}
+	return coder, nil
+}
+
+// The CODER_MASK bits for the entropy coder of the model.
+func coderFlags(m huffman.Coder) (uint16, error) {
+	switch m.(type) {
+	case *huffman.Model:
+		return CODER_HUFFMAN, nil
+	case *huffman.RANSModel:
+		return CODER_RANS, nil
+	}
+	return 0, fmt.Errorf("%w %T", ErrUnsupportedCoder, m)
+}
+
+// Fail if the model is not for the entropy coder selected by the flags.
+func checkCoder(m huffman.Coder, flags uint16) error {
+	got, err := coderFlags(m)
+	if err != nil {
+		return err
+	}
+	if got != flags&CODER_MASK {
+		return fmt.Errorf("Model is for the %s coder but the flags select the %s coder",
+			coders[got].name, coders[flags&CODER_MASK].name)
+	}
+	return nil
+}
+
+// Fail if COMPACT_MODEL is set for a coder whose model is not code lengths.
+func checkCompact(flags uint16) error {
+	if flags&COMPACT_MODEL > 0 && flags&CODER_MASK != CODER_HUFFMAN {
+		return fmt.Errorf("%w, COMPACT_MODEL can only be used with the huffman coder", ErrInvalidFlags)
+	}
+	return nil
+}
+
+// Fail if a Decoder would refuse a packet with this model, e.g. a huffman
+// model whose code is not complete or which ends its streams with EOB.
+func checkModel(m huffman.Coder) error {
+	hm, ok := m.(*huffman.Model)
+	if !ok {
+		return nil
+	}
+	if hm.HasEOB() {
+		return ErrEOBNotSupported
+	}
+	return hm.Validate()
+}
@@ -0,0 +1,152 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+func TestCoder_EncodeDecode(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 20)
+
+	for _, coder := range []uint16{CODER_HUFFMAN, CODER_RANS} {
+		for _, flags := range []uint16{
+			0, HAS_MODEL, ADAPTIVE_MODEL, HAS_CHECKSUM, BLOCK_INDEX | ADAPTIVE_MODEL, PARALLEL,
+		} {
+			for _, p := range [][]byte{src, []byte{}} {
+				packet := encodePacket(t, p, coder|flags)
+
+				// Followed by a second packet to check only this one is read
+				r := bytes.NewReader(append(packet, packet...))
+				for i := 0; i < 2; i++ {
+					decoder, err := NewDecoder(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := decoder.Read()
+					if err != nil {
+						t.Fatalf("Failed to decode flags %#x: %v", coder|flags, err)
+					}
+					if bytes.Compare(p, got) != 0 {
+						t.Errorf("Payload differs with flags %#x. got = %s", coder|flags, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCoder_StreamAndIndex(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 20)
+
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoderSize(encoded, CODER_RANS|HAS_CHECKSUM, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := NewStreamDecoder(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("Streamed payload differs")
+	}
+
+	packet := encodePacket(t, src, CODER_RANS|ADAPTIVE_MODEL|BLOCK_INDEX, withIndexBlockSize(64))
+	indexed, err := NewIndexedDecoder(bytes.NewReader(packet), int64(len(packet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 100)
+	_, err = indexed.ReadAt(p, 50)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src[50:150], p) != 0 {
+		t.Errorf("ReadAt differs, got = %s", p)
+	}
+}
+
+func TestCoder_Skewed(t *testing.T) {
+	// Readings from a sensor which is nearly always off
+	src := make([]byte, 100000)
+	for i := 0; i < len(src); i += 50 {
+		src[i] = 1
+	}
+	rans := encodePacket(t, src, CODER_RANS|ADAPTIVE_MODEL)
+	huff := encodePacket(t, src, CODER_HUFFMAN|ADAPTIVE_MODEL)
+
+	// Huffman can not do better than a bit per symbol
+	if len(rans)*4 > len(huff) {
+		t.Errorf("rANS packet is %d bytes, huffman is %d", len(rans), len(huff))
+	}
+	got, err := decodeBytes(rans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("Failed to decode the skewed payload")
+	}
+}
+
+func TestCoder_Errors(t *testing.T) {
+	encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write([]byte("abc"), 0x0200); err == nil {
+		t.Errorf("Expected an error for an unknown coder")
+	}
+
+	encoder, err = NewEncoderWithModel(bytes.NewBuffer([]byte{}), huffman.DefaultRANSModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write([]byte("abc"), HAS_MODEL); err == nil {
+		t.Errorf("Expected an error writing a rANS model without CODER_RANS")
+	}
+
+	// The registry has a huffman model under the ID of a rANS packet
+	rm := huffman.DefaultRANSModel()
+	sender := NewModelRegistry()
+	id, err := sender.RegisterModel(rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := bytes.NewBuffer([]byte{})
+	encoder, err = NewEncoderWithRegistry(packet, sender, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write([]byte("abc"), HAS_MODEL_ID|CODER_RANS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewModelRegistry()
+	err = receiver.Register(id, huffman.DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := NewDecoderWithRegistry(packet, receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.Read(); err == nil {
+		t.Errorf("Expected an error for a model of the wrong coder")
+	}
+}
@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+var (
+	// The decoded payload does not match the checksum in the packet
+	ErrChecksumMismatch = errors.New("Payload checksum mismatch")
+	// The header does not match the header checksum in the packet
+	ErrHeaderChecksumMismatch = errors.New("Header checksum mismatch")
+	// The Version of the packet is not one this package can read
+	ErrUnsupportedVersion = errors.New("Unsupported packet version")
+	// The CODER_MASK bits of the flags, or the type of a model, do not name a
+	// known entropy coder
+	ErrUnsupportedCoder = errors.New("Unsupported entropy coder")
+	// The flags of a packet are a combination which can not be written or
+	// read, e.g. BLOCK_INDEX with STREAMED
+	ErrInvalidFlags = errors.New("Invalid combination of flags")
+	// A HAS_MODEL_ID packet uses a model which is not in the registry
+	ErrUnknownModelID = errors.New("Unknown model ID")
+	// The payload is larger than DecoderOptions.MaxPayloadLen
+	ErrPayloadTooLarge = errors.New("Payload is too large")
+	// The payload is larger than DecoderOptions.MaxExpansionRatio times the
+	// packet it was decoded from
+	ErrTooMuchExpansion = errors.New("Payload expands too much")
+	// Bytes were left over after the end of a packet, block or chunk
+	ErrTrailingData = errors.New("Trailing data after the end of the encoded payload")
+	// The block index of a BLOCK_INDEX packet does not match its payload
+	ErrInvalidIndex = errors.New("Invalid block index")
+	// A huffman model with an EOB pattern was given for packets. Payloads are
+	// read by their PayloadLen, so the EOB which ends each stream would be
+	// read as padding.
+	ErrEOBNotSupported = fmt.Errorf("%w, packets can not use a model with EOB", huffman.ErrInvalidModel)
+)
+
+// HeaderError is returned by ReadHeader when a field of the header can not be
+// read or holds a value which can not be decoded. Field is the name of the
+// field as in the spec, e.g. "PayloadLen" or "HuffmanTree". Errors from the
+// io.Reader are kept in Err, so errors.Is(err, io.ErrUnexpectedEOF) still
+// works on a truncated header.
+type HeaderError struct {
+	Field string
+	Err   error
+}
+
+func (this *HeaderError) Error() string {
+	return fmt.Sprintf("Failed to read header field %s: %v", this.Field, this.Err)
+}
+
+func (this *HeaderError) Unwrap() error {
+	return this.Err
+}
@@ -0,0 +1,163 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+func TestErrors_TruncatedHeader(t *testing.T) {
+	packet := encodePacket(t, []byte("hello world"), HAS_MODEL|COMPACT_MODEL|HAS_CHECKSUM)
+	h, err := ReadHeader(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := bytes.NewBuffer([]byte{})
+	w, _ := h.Model.NewSymbolWriter(encoded)
+	w.Write([]byte("hello world"))
+	w.Close()
+	headerLen := len(packet) - encoded.Len()
+
+	if _, err := ReadHeader(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("Expected io.EOF for an empty stream, got %v", err)
+	}
+	// The field holding the n-th byte fails
+	fields := map[int]string{1: "Version", 2: "Flags", 4: "PayloadLen", 11: "PayloadLen", 12: "Checksum", 16: "CompactTree"}
+	for n := 1; n < headerLen; n++ {
+		_, err := ReadHeader(bytes.NewReader(packet[:n]))
+		var herr *HeaderError
+		if !errors.As(err, &herr) {
+			t.Fatalf("Expected a HeaderError reading %d bytes, got %v", n, err)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Errorf("Expected an EOF reading %d bytes, got %v", n, err)
+		}
+		if field, ok := fields[n]; ok && herr.Field != field {
+			t.Errorf("Reading %d bytes failed in field %s, want %s", n, herr.Field, field)
+		}
+	}
+}
+
+func TestErrors_InvalidHeader(t *testing.T) {
+	header := func(version uint16, flags uint16) []byte {
+		buf := bytes.NewBuffer([]byte{})
+		binary.Write(buf, binary.LittleEndian, version)
+		binary.Write(buf, binary.LittleEndian, flags)
+		binary.Write(buf, binary.LittleEndian, uint64(1))
+		binary.Write(buf, binary.LittleEndian, uint32(1))
+		return buf.Bytes()
+	}
+	tests := []struct {
+		packet []byte
+		field  string
+		err    error
+	}{
+		{header(0x01, 0), "Version", ErrUnsupportedVersion},
+		{header(VERSION, 0x0200), "Flags", ErrUnsupportedCoder},
+		{header(VERSION_ASCII, CODER_RANS), "Flags", ErrUnsupportedCoder},
+		{header(VERSION, STREAMED|BLOCK_INDEX), "Flags", ErrInvalidFlags},
+		{header(VERSION, CODER_RANS|HAS_MODEL|COMPACT_MODEL), "Flags", ErrInvalidFlags},
+		{header(VERSION, HAS_MODEL_ID), "ModelID", ErrUnknownModelID},
+		{append(header(VERSION, HAS_MODEL)[:12], make([]byte, 256)...), "HuffmanTree", huffman.ErrNoSymbols},
+	}
+	for _, test := range tests {
+		_, err := ReadHeader(bytes.NewReader(test.packet))
+		var herr *HeaderError
+		if !errors.As(err, &herr) || herr.Field != test.field {
+			t.Errorf("Expected a HeaderError for field %s, got %v", test.field, err)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("Expected %v, got %v", test.err, err)
+		}
+	}
+}
+
+func TestErrors_Encoder(t *testing.T) {
+	m, err := huffman.CreateModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := NewEncoderWithModel(bytes.NewBuffer([]byte{}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write([]byte("abcd"), HAS_MODEL)
+	var serr *huffman.SymbolError
+	if !errors.As(err, &serr) || serr.Symbol != 'd' || serr.Index != 3 {
+		t.Errorf("Expected a SymbolError for 'd' at index 3, got %v", err)
+	}
+	if !errors.Is(err, huffman.ErrSymbolNotInModel) {
+		t.Errorf("Expected ErrSymbolNotInModel, got %v", err)
+	}
+
+	_, err = encoder.Write([]byte("abc"), CODER_RANS)
+	if err == nil {
+		t.Errorf("Expected an error for a huffman model with the rANS coder")
+	}
+
+	// The JPEG code is not complete, so a Decoder would refuse its packets
+	jpeg := huffman.JPEGLuminanceDCModel()
+	if _, err := NewEncoderWithModel(bytes.NewBuffer([]byte{}), jpeg); !errors.Is(err, huffman.ErrInvalidModel) {
+		t.Errorf("Expected ErrInvalidModel for the JPEG model, got %v", err)
+	}
+	// HeaderError is only for reading
+	err = writeHeader(bytes.NewBuffer([]byte{}), &Header{Flags: HAS_MODEL, Model: jpeg})
+	var herr *HeaderError
+	if errors.As(err, &herr) || !errors.Is(err, huffman.ErrInvalidModel) {
+		t.Errorf("Expected ErrInvalidModel writing the HuffmanTree, got %v", err)
+	}
+}
+
+func TestErrors_EncoderWritesNothing(t *testing.T) {
+	m, err := huffman.CreateModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ESCAPE has no length in a HuffmanTree
+	escape, err := huffman.CreateModelWithEscape([]byte("abc"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		m     huffman.Coder
+		src   string
+		flags uint16
+	}{
+		{"symbol not in the model", m, "abcd", HAS_MODEL},
+		{"escape model", escape, "abc", HAS_MODEL},
+	} {
+		encoded := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoderWithModel(encoded, tc.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.SetMagic(true)
+		if _, err := encoder.Write([]byte(tc.src), tc.flags); err == nil {
+			t.Fatalf("%s: expected an error", tc.name)
+		}
+		if encoded.Len() != 0 {
+			t.Errorf("%s: a failed Write wrote %d bytes", tc.name, encoded.Len())
+		}
+
+		// The next packet is read without skipping anything
+		next, _ := NewEncoder(encoded)
+		next.SetMagic(true)
+		_, err = next.Write([]byte("abc"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := NewDecoder(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder.SetOptions(DecoderOptions{Resync: true})
+		if !decoder.Next() || decoder.Skipped() != 0 {
+			t.Errorf("%s: skipped %d packets, %v", tc.name, decoder.Skipped(), decoder.Err())
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+// The fixed fields at the start of every packet along with the model used
+// to encode the payload.
+type Header struct {
+	Version    uint16
+	Flags      uint16
+	PayloadLen uint64
+	// CRC-32C of the uncompressed payload, only set with HAS_CHECKSUM
+	Checksum uint32
+	// Number of symbols in each block, only set with BLOCK_INDEX
+	BlockSymbols uint32
+	// Number of symbols in each chunk, only set with PARALLEL
+	ChunkSymbols uint32
+	// ID of the model in a ModelRegistry, only set with HAS_MODEL_ID
+	ModelID uint32
+	// A *huffman.Model or *huffman.RANSModel depending on the CODER_MASK
+	// bits of the flags
+	Model huffman.Coder
+}
+
+// Write out the packet header. The model is only written if the HAS_MODEL
+// flag is set. The Version of the header is ignored, it is always written as
+// the current VERSION.
+func writeHeader(w io.Writer, h *Header) error {
+	// Buffer the header so that it can be checksummed
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, VERSION)
+	binary.Write(buf, binary.LittleEndian, h.Flags)
+	binary.Write(buf, binary.LittleEndian, h.PayloadLen)
+	if h.Flags&HAS_CHECKSUM > 0 {
+		binary.Write(buf, binary.LittleEndian, h.Checksum)
+	}
+	if h.Flags&BLOCK_INDEX > 0 {
+		binary.Write(buf, binary.LittleEndian, h.BlockSymbols)
+	}
+	if h.Flags&PARALLEL > 0 {
+		binary.Write(buf, binary.LittleEndian, h.ChunkSymbols)
+	}
+	if h.Flags&HAS_MODEL_ID > 0 {
+		binary.Write(buf, binary.LittleEndian, h.ModelID)
+	}
+
+	// Optionally write the huffman tree model
+	// not needed assuming that the Decoder know what model to use.
+	if h.Flags&HAS_MODEL > 0 {
+		coder, err := findCoder(h.Flags)
+		if err != nil {
+			return err
+		}
+		modelField := coder.modelField
+		if h.Flags&COMPACT_MODEL > 0 {
+			modelField = "CompactTree"
+		}
+		err = checkModel(h.Model)
+		if err != nil {
+			return fmt.Errorf("Failed to write header field %s: %w", modelField, err)
+		}
+
+		var bs []byte
+		if h.Flags&COMPACT_MODEL > 0 {
+			m, ok := h.Model.(*huffman.Model)
+			if !ok {
+				return errors.New("COMPACT_MODEL can only be used with the huffman coder")
+			}
+			bs, err = m.MarshalCompact(huffman.DefaultAlphabet())
+		} else {
+			bs, err = h.Model.MarshalAlphabet(huffman.DefaultAlphabet())
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to write header field %s: %w", modelField, err)
+		}
+		buf.Write(bs)
+	}
+
+	if h.Flags&HAS_CHECKSUM > 0 {
+		headerChecksum := crc32.Checksum(buf.Bytes(), castagnoliTable)
+		binary.Write(buf, binary.LittleEndian, headerChecksum)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Read the packet header, resolving which model the payload was encoded with.
+// The reader is left at the start of the payload. Fails on HAS_MODEL_ID
+// packets, use ReadHeaderWithRegistry for those.
+func ReadHeader(r io.Reader) (*Header, error) {
+	return ReadHeaderWithRegistry(r, nil)
+}
+
+// Read the packet header, looking up the model of HAS_MODEL_ID packets in the
+// registry.
+func ReadHeaderWithRegistry(r io.Reader, registry *ModelRegistry) (*Header, error) {
+	// Everything read is also fed to the checksum
+	headerHash := crc32.New(castagnoliTable)
+	tr := io.TeeReader(r, headerHash)
+
+	h := &Header{}
+	err := binary.Read(tr, binary.LittleEndian, &h.Version)
+	if err == io.EOF {
+		// Nothing left at all, the stream ended cleanly between packets
+		return nil, err
+	}
+	if err != nil {
+		return nil, &HeaderError{"Version", unexpectedEOF(err)}
+	}
+	err = binary.Read(tr, binary.LittleEndian, &h.Flags)
+	if err != nil {
+		return nil, &HeaderError{"Flags", unexpectedEOF(err)}
+	}
+	err = binary.Read(tr, binary.LittleEndian, &h.PayloadLen)
+	if err != nil {
+		return nil, &HeaderError{"PayloadLen", unexpectedEOF(err)}
+	}
+	if h.Flags&HAS_CHECKSUM > 0 {
+		err = binary.Read(tr, binary.LittleEndian, &h.Checksum)
+		if err != nil {
+			return nil, &HeaderError{"Checksum", unexpectedEOF(err)}
+		}
+	}
+	if h.Flags&BLOCK_INDEX > 0 {
+		if h.Flags&STREAMED > 0 {
+			return nil, &HeaderError{"Flags", fmt.Errorf("%w, BLOCK_INDEX can not be used with STREAMED", ErrInvalidFlags)}
+		}
+		err = binary.Read(tr, binary.LittleEndian, &h.BlockSymbols)
+		if err != nil {
+			return nil, &HeaderError{"BlockSymbols", unexpectedEOF(err)}
+		}
+		if h.BlockSymbols == 0 {
+			return nil, &HeaderError{"BlockSymbols", errors.New("BLOCK_INDEX packet has a block size of 0")}
+		}
+	}
+	if h.Flags&PARALLEL > 0 {
+		if h.Flags&(STREAMED|BLOCK_INDEX) > 0 {
+			return nil, &HeaderError{"Flags", fmt.Errorf("%w, PARALLEL can not be used with STREAMED or BLOCK_INDEX", ErrInvalidFlags)}
+		}
+		err = binary.Read(tr, binary.LittleEndian, &h.ChunkSymbols)
+		if err != nil {
+			return nil, &HeaderError{"ChunkSymbols", unexpectedEOF(err)}
+		}
+		if h.ChunkSymbols == 0 {
+			return nil, &HeaderError{"ChunkSymbols", errors.New("PARALLEL packet has a chunk size of 0")}
+		}
+	}
+	if h.Flags&HAS_MODEL_ID > 0 {
+		if h.Flags&HAS_MODEL > 0 {
+			return nil, &HeaderError{"Flags", fmt.Errorf("%w, HAS_MODEL_ID can not be used with HAS_MODEL", ErrInvalidFlags)}
+		}
+		err = binary.Read(tr, binary.LittleEndian, &h.ModelID)
+		if err != nil {
+			return nil, &HeaderError{"ModelID", unexpectedEOF(err)}
+		}
+	}
+
+	coder, err := findCoder(h.Flags)
+	if err != nil {
+		return nil, &HeaderError{"Flags", err}
+	}
+	err = checkCompact(h.Flags)
+	if err != nil {
+		return nil, &HeaderError{"Flags", err}
+	}
+	var alphabet []byte
+	defaultModel := coder.defaultModel
+	switch h.Version {
+	case VERSION:
+		alphabet = huffman.DefaultAlphabet()
+	case VERSION_ASCII:
+		if h.Flags&CODER_MASK != CODER_HUFFMAN {
+			return nil, &HeaderError{"Flags", fmt.Errorf("%w, version %#x packets can only use the huffman coder",
+				ErrUnsupportedCoder, h.Version)}
+		}
+		alphabet = huffman.ASCIIAlphabet()
+		defaultModel = func() huffman.Coder { return huffman.ASCIIModel() }
+	default:
+		return nil, &HeaderError{"Version", fmt.Errorf("%w %#x", ErrUnsupportedVersion, h.Version)}
+	}
+
+	// Optionally read the model, the HuffmanTree, CompactTree or FreqTable.
+	// The CompactTree is expanded to the HuffmanTree it stands for.
+	var tree []byte
+	modelField := coder.modelField
+	if h.Flags&HAS_MODEL > 0 && h.Flags&COMPACT_MODEL > 0 {
+		modelField = "CompactTree"
+		tree, err = huffman.ReadCompactLengths(alphabet, tr)
+		if err != nil {
+			return nil, &HeaderError{modelField, unexpectedEOF(err)}
+		}
+	} else if h.Flags&HAS_MODEL > 0 {
+		tree = make([]byte, len(alphabet)*coder.symbolLen)
+		_, err := io.ReadFull(tr, tree)
+		if err != nil {
+			return nil, &HeaderError{modelField, unexpectedEOF(err)}
+		}
+	}
+
+	// Check the header before trusting the model
+	if h.Flags&HAS_CHECKSUM > 0 {
+		want := headerHash.Sum32()
+		var got uint32
+		err = binary.Read(r, binary.LittleEndian, &got)
+		if err != nil {
+			return nil, &HeaderError{"HeaderChecksum", unexpectedEOF(err)}
+		}
+		if got != want {
+			return nil, ErrHeaderChecksumMismatch
+		}
+	}
+
+	if tree != nil {
+		h.Model = coder.newModel()
+		err = h.Model.UnmarshalBinary(alphabet, tree)
+		if err != nil {
+			return nil, &HeaderError{modelField, err}
+		}
+	} else if h.Flags&HAS_MODEL_ID > 0 {
+		h.Model, err = registry.Lookup(h.ModelID)
+		if err != nil {
+			return nil, &HeaderError{"ModelID", err}
+		}
+		err = checkCoder(h.Model, h.Flags)
+		if err != nil {
+			return nil, &HeaderError{"ModelID", err}
+		}
+	} else {
+		h.Model = defaultModel()
+	}
+	return h, nil
+}
@@ -0,0 +1,288 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+const (
+	// The default number of symbols in each block of a BLOCK_INDEX packet
+	kDEFAULT_INDEX_BLOCK_SYMBOLS = 4096
+	// Size in bytes of a single entry in the index trailer
+	kINDEX_ENTRY_LEN = 16
+)
+
+// Where a block starts, both in the original payload and in the encoded
+// payload. The byte offset is counted from the start of the encoded payload.
+type blockIndexEntry struct {
+	symbolOffset uint64
+	byteOffset   uint64
+}
+
+// Counts the number of bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += uint64(n)
+	return n, err
+}
+
+// Write the payload in blocks of blockSymbols symbols, flushing to a byte
+// boundary after each block, followed by the index trailer.
+func writeIndexedPayload(w io.Writer, m huffman.Coder, p []byte, blockSymbols uint32) (int, error) {
+	cw := &countingWriter{w, 0}
+	index := make([]blockIndexEntry, 0)
+
+	n := 0
+	for n < len(p) {
+		end := n + int(blockSymbols)
+		if end > len(p) {
+			end = len(p)
+		}
+		index = append(index, blockIndexEntry{uint64(n), cw.n})
+
+		hw, err := m.NewSymbolWriter(cw)
+		if err != nil {
+			return n, err
+		}
+		count, err := hw.Write(p[n:end])
+		if err != nil {
+			return n + count, err
+		}
+		err = hw.Close()
+		if err != nil {
+			return n + count, err
+		}
+		n = end
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, e := range index {
+		binary.Write(buf, binary.LittleEndian, e.symbolOffset)
+		binary.Write(buf, binary.LittleEndian, e.byteOffset)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(index)))
+	_, err := w.Write(buf.Bytes())
+	return n, err
+}
+
+// The number of blocks a payload is split into
+func numIndexBlocks(h *Header) uint64 {
+	n := h.PayloadLen / uint64(h.BlockSymbols)
+	if h.PayloadLen%uint64(h.BlockSymbols) > 0 {
+		n += 1
+	}
+	return n
+}
+
+// Read a BLOCK_INDEX payload from start to end, including the trailer so that
+// the reader is left at the end of the packet. The index must match where
+// the blocks were found, so no bytes can hide between them.
+func readIndexedPayload(r *countingReader, h *Header, check func(decoded uint64) error) ([]byte, error) {
+	var hr huffman.SymbolReader
+	var p []byte
+	payloadStart := r.n
+	byteOffsets := make([]uint64, 0)
+	for n := uint64(0); n < h.PayloadLen; n += uint64(h.BlockSymbols) {
+		end := n + uint64(h.BlockSymbols)
+		if end > h.PayloadLen {
+			end = h.PayloadLen
+		}
+		byteOffsets = append(byteOffsets, r.n-payloadStart)
+
+		// Every block starts on a new byte, drop the padding of the last one
+		if hr == nil {
+			var err error
+			hr, err = h.Model.NewSymbolReader(r)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			hr.Reset(r)
+		}
+		var err error
+		p, err = readSymbols(p, hr, end-n, check)
+		if err != nil {
+			return nil, err
+		}
+		err = hr.Finish()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	numBlocks := numIndexBlocks(h)
+	trailer, err := readLimited(r, numBlocks*kINDEX_ENTRY_LEN+4)
+	if err != nil {
+		return nil, err
+	}
+	got := binary.LittleEndian.Uint32(trailer[len(trailer)-4:])
+	if uint64(got) != numBlocks {
+		return nil, fmt.Errorf("%w, it has %d blocks but the payload has %d", ErrInvalidIndex, got, numBlocks)
+	}
+	for i, byteOffset := range byteOffsets {
+		entry := trailer[i*kINDEX_ENTRY_LEN:]
+		if binary.LittleEndian.Uint64(entry[0:8]) != uint64(i)*uint64(h.BlockSymbols) ||
+			binary.LittleEndian.Uint64(entry[8:16]) != byteOffset {
+			return nil, fmt.Errorf("%w, block %d does not start where the index says", ErrTrailingData, i)
+		}
+	}
+	return p, nil
+}
+
+// IndexedDecoder gives random access to the payload of a BLOCK_INDEX packet.
+// Only the blocks which cover the requested bytes are decoded.
+type IndexedDecoder struct {
+	r io.ReaderAt
+	h *Header
+	// Where the encoded payload starts and ends in r
+	payloadStart int64
+	payloadEnd   int64
+	index        []blockIndexEntry
+}
+
+// Read the header and index of the packet which takes up the first size bytes
+// of r.
+func NewIndexedDecoder(r io.ReaderAt, size int64) (*IndexedDecoder, error) {
+	return NewIndexedDecoderWithRegistry(r, size, nil)
+}
+
+// Same as NewIndexedDecoder, looking up the model of HAS_MODEL_ID packets in
+// the registry.
+func NewIndexedDecoderWithRegistry(r io.ReaderAt, size int64, registry *ModelRegistry) (*IndexedDecoder, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	h, err := ReadHeaderWithRegistry(sr, registry)
+	if err != nil {
+		return nil, err
+	}
+	if h.Flags&BLOCK_INDEX == 0 {
+		return nil, errors.New("Packet does not have a BLOCK_INDEX")
+	}
+	// Offsets into the payload are int64s
+	if h.PayloadLen > math.MaxInt64 {
+		return nil, fmt.Errorf("%w, %d bytes does not fit an int64", ErrPayloadTooLarge, h.PayloadLen)
+	}
+	payloadStart, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// The number of entries is the last thing in the packet
+	numBlocks := numIndexBlocks(h)
+	trailerLen := int64(numBlocks*kINDEX_ENTRY_LEN + 4)
+	payloadEnd := size - trailerLen
+	if numBlocks > uint64(size) || payloadEnd < payloadStart {
+		return nil, fmt.Errorf("%w, the packet is too short to hold %d blocks", ErrInvalidIndex, numBlocks)
+	}
+	trailer := make([]byte, trailerLen)
+	_, err = r.ReadAt(trailer, payloadEnd)
+	if err != nil {
+		return nil, err
+	}
+	got := binary.LittleEndian.Uint32(trailer[len(trailer)-4:])
+	if uint64(got) != numBlocks {
+		return nil, fmt.Errorf("%w, it has %d blocks but the payload has %d", ErrInvalidIndex, got, numBlocks)
+	}
+
+	index := make([]blockIndexEntry, numBlocks)
+	for i := range index {
+		entry := trailer[i*kINDEX_ENTRY_LEN:]
+		index[i].symbolOffset = binary.LittleEndian.Uint64(entry[0:8])
+		index[i].byteOffset = binary.LittleEndian.Uint64(entry[8:16])
+
+		if index[i].symbolOffset != uint64(i)*uint64(h.BlockSymbols) ||
+			index[i].byteOffset > uint64(payloadEnd-payloadStart) ||
+			(i > 0 && index[i].byteOffset < index[i-1].byteOffset) {
+			return nil, fmt.Errorf("%w, entry for block %d", ErrInvalidIndex, i)
+		}
+	}
+
+	return &IndexedDecoder{r, h, payloadStart, payloadEnd, index}, nil
+}
+
+func (this *IndexedDecoder) Header() *Header {
+	return this.h
+}
+
+// The length of the original payload
+func (this *IndexedDecoder) Size() int64 {
+	return int64(this.h.PayloadLen)
+}
+
+// Read len(p) bytes of the original payload starting at off. Implements
+// io.ReaderAt, returning io.EOF if the payload ends before p is filled.
+func (this *IndexedDecoder) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("IndexedDecoder.ReadAt: negative offset")
+	}
+	if off >= this.Size() {
+		return 0, io.EOF
+	}
+
+	// Find the block which holds the first byte
+	block := sort.Search(len(this.index), func(i int) bool {
+		return this.index[i].symbolOffset > uint64(off)
+	}) - 1
+
+	var hr huffman.SymbolReader
+	n := 0
+	for n < len(p) && block < len(this.index) {
+		start := this.payloadStart + int64(this.index[block].byteOffset)
+		end := this.payloadEnd
+		if block+1 < len(this.index) {
+			end = this.payloadStart + int64(this.index[block+1].byteOffset)
+		}
+		section := io.NewSectionReader(this.r, start, end-start)
+		if hr == nil {
+			var err error
+			hr, err = this.h.Model.NewSymbolReader(section)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			hr.Reset(section)
+		}
+
+		// Decode and throw away the symbols before the offset
+		blockStart := int64(this.index[block].symbolOffset)
+		blockEnd := blockStart + int64(this.h.BlockSymbols)
+		if blockEnd > this.Size() {
+			blockEnd = this.Size()
+		}
+		skip := off + int64(n) - blockStart
+		if skip > 0 {
+			_, err := io.CopyN(ioutil.Discard, hr, skip)
+			if err != nil {
+				return n, unexpectedEOF(err)
+			}
+		}
+
+		want := blockEnd - (off + int64(n))
+		if want > int64(len(p)-n) {
+			want = int64(len(p) - n)
+		}
+		count, err := hr.Read(p[n : n+int(want)])
+		n += count
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+		block += 1
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
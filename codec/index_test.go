@@ -0,0 +1,198 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestIndex_Decoder(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 20)
+
+	for _, flags := range []uint16{0, HAS_MODEL, ADAPTIVE_MODEL, HAS_CHECKSUM} {
+		for _, blockSymbols := range []uint32{1, 7, 64, uint32(len(src)), 100000} {
+			packet := encodePacket(t, src, flags|BLOCK_INDEX, withIndexBlockSize(blockSymbols))
+
+			// Followed by a second packet to check the trailer is consumed
+			r := bytes.NewReader(append(packet, packet...))
+			for i := 0; i < 2; i++ {
+				decoder, err := NewDecoder(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := decoder.Read()
+				if err != nil {
+					t.Fatalf("Failed to decode flags %#x block %d: %v", flags, blockSymbols, err)
+				}
+				if bytes.Compare(src, got) != 0 {
+					t.Errorf("Payload differs with flags %#x block %d. got = %s", flags, blockSymbols, got)
+				}
+			}
+		}
+	}
+}
+
+func TestIndex_ReadAt(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 20)
+	packet := encodePacket(t, src, HAS_CHECKSUM|BLOCK_INDEX, withIndexBlockSize(64))
+
+	decoder, err := NewIndexedDecoder(bytes.NewReader(packet), int64(len(packet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoder.Size() != int64(len(src)) {
+		t.Errorf("Size = %d, want %d", decoder.Size(), len(src))
+	}
+	if decoder.Header().BlockSymbols != 64 {
+		t.Errorf("BlockSymbols = %d, want 64", decoder.Header().BlockSymbols)
+	}
+
+	type testCase struct {
+		off int64
+		n   int
+	}
+	for _, tc := range []testCase{
+		{0, 1},
+		{0, 64},
+		{63, 2},
+		{64, 64},
+		{100, 300},
+		{500, 1},
+		{0, len(src)},
+		{int64(len(src)) - 1, 1},
+	} {
+		p := make([]byte, tc.n)
+		n, err := decoder.ReadAt(p, tc.off)
+		if err != nil {
+			t.Fatalf("ReadAt(%d, %d) failed: %v", tc.n, tc.off, err)
+		}
+		if n != tc.n {
+			t.Errorf("ReadAt(%d, %d) read %d bytes", tc.n, tc.off, n)
+		}
+		want := src[tc.off : tc.off+int64(tc.n)]
+		if bytes.Compare(want, p) != 0 {
+			t.Errorf("ReadAt(%d, %d) = %q, want %q", tc.n, tc.off, p, want)
+		}
+	}
+}
+
+func TestIndex_ReadAtEOF(t *testing.T) {
+	src := []byte(streamTestText)
+	packet := encodePacket(t, src, BLOCK_INDEX, withIndexBlockSize(8))
+	decoder, err := NewIndexedDecoder(bytes.NewReader(packet), int64(len(packet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 10)
+	n, err := decoder.ReadAt(p, int64(len(src))-4)
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF reading past the end, got %v", err)
+	}
+	if n != 4 || string(p[:n]) != streamTestText[len(src)-4:] {
+		t.Errorf("Read %d bytes %q before the end", n, p[:n])
+	}
+
+	n, err = decoder.ReadAt(p, int64(len(src)))
+	if n != 0 || err != io.EOF {
+		t.Errorf("Expected (0, io.EOF) at the end, got (%d, %v)", n, err)
+	}
+	_, err = decoder.ReadAt(p, -1)
+	if err == nil {
+		t.Errorf("Expected an error for a negative offset")
+	}
+}
+
+func TestIndex_ReadAtLargeBlock(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 1<<15)
+	packet := encodePacket(t, src, BLOCK_INDEX, withIndexBlockSize(uint32(len(src))))
+	decoder, err := NewIndexedDecoder(bytes.NewReader(packet), int64(len(packet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The symbols before the offset are thrown away, not kept
+	p := make([]byte, 16)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = decoder.ReadAt(p, int64(len(src)-len(p)))
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(p, src[len(src)-len(p):]) != 0 {
+		t.Errorf("ReadAt got %q", p)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(src))/4 {
+		t.Errorf("Skipping %d symbols allocated %d bytes", len(src), alloc)
+	}
+}
+
+func TestIndex_Errors(t *testing.T) {
+	encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoder.SetIndexBlockSize(0) == nil {
+		t.Errorf("Expected an error for a block size of 0")
+	}
+	if _, err := NewStreamEncoder(bytes.NewBuffer([]byte{}), BLOCK_INDEX); err == nil {
+		t.Errorf("Expected an error streaming with BLOCK_INDEX")
+	}
+
+	// Not indexed
+	plain := encodePacket(t, []byte(streamTestText), HAS_CHECKSUM)
+	if _, err := NewIndexedDecoder(bytes.NewReader(plain), int64(len(plain))); err == nil {
+		t.Errorf("Expected an error for a packet without an index")
+	}
+
+	// Truncated index
+	packet := encodePacket(t, []byte(streamTestText), BLOCK_INDEX, withIndexBlockSize(8))
+	short := packet[:len(packet)-1]
+	if _, err := NewIndexedDecoder(bytes.NewReader(short), int64(len(short))); err == nil {
+		t.Errorf("Expected an error for a truncated index")
+	}
+	decoder, err := NewDecoder(bytes.NewReader(short))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.Read(); err == nil {
+		t.Errorf("Expected an error decoding a truncated index")
+	}
+
+	// The block count does not match the payload
+	bad := append([]byte{}, packet...)
+	bad[len(bad)-4] += 1
+	if _, err := NewIndexedDecoder(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("Expected ErrInvalidIndex for the wrong block count, got %v", err)
+	}
+	decoder, err = NewDecoder(bytes.NewReader(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.Read(); !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("Expected ErrInvalidIndex decoding the wrong block count, got %v", err)
+	}
+
+	// A forged header whose PayloadLen rounds up past 2^64 blocks
+	forged := bytes.NewBuffer([]byte{})
+	binary.Write(forged, binary.LittleEndian, uint16(VERSION))
+	binary.Write(forged, binary.LittleEndian, uint16(BLOCK_INDEX))
+	binary.Write(forged, binary.LittleEndian, uint64(math.MaxUint64))
+	binary.Write(forged, binary.LittleEndian, uint32(2))
+	binary.Write(forged, binary.LittleEndian, uint32(0))
+	if _, err := NewIndexedDecoder(bytes.NewReader(forged.Bytes()), int64(forged.Len())); err == nil {
+		t.Errorf("Expected an error for a PayloadLen of 2^64-1")
+	}
+
+	// The last block does not start at its symbol offset
+	bad = append([]byte{}, packet...)
+	bad[len(bad)-4-kINDEX_ENTRY_LEN] ^= 1
+	if _, err := NewIndexedDecoder(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("Expected ErrInvalidIndex for a bad entry, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+const (
+	// The default number of symbols in each chunk of a PARALLEL packet
+	kDEFAULT_PARALLEL_CHUNK_SYMBOLS = 256 * 1024
+)
+
+// The number of chunks a PARALLEL payload is split into. Rounds up without
+// adding to payloadLen, which may be anything up to 2^64-1.
+func numParallelChunks(payloadLen uint64, chunkSymbols uint32) uint64 {
+	n := payloadLen / uint64(chunkSymbols)
+	if payloadLen%uint64(chunkSymbols) > 0 {
+		n += 1
+	}
+	return n
+}
+
+// The number of goroutines to use for the chunks. Never more than there are
+// chunks, and GOMAXPROCS if workers is 0.
+func numWorkers(workers int, numChunks int) int {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > numChunks {
+		workers = numChunks
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// Call fn for every chunk, spread over the given number of goroutines. Each
+// goroutine has its own worker number so it can keep state between chunks.
+// If several chunks fail the error of the first chunk is returned, so the
+// result does not depend on the scheduling.
+func runWorkers(numChunks int, workers int, fn func(worker int, chunk int) error) error {
+	errs := make([]error, numChunks)
+	chunks := make(chan int, numChunks)
+	for i := 0; i < numChunks; i++ {
+		chunks <- i
+	}
+	close(chunks)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for chunk := range chunks {
+				errs[chunk] = fn(worker, chunk)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode every chunk of the payload into its own byte aligned bit stream on
+// separate goroutines, then write the table of encoded chunk sizes followed by
+// the chunks in order.
+func writeParallelPayload(w io.Writer, m huffman.Coder, p []byte, chunkSymbols uint32, workers int) (int, error) {
+	numChunks := int(numParallelChunks(uint64(len(p)), chunkSymbols))
+	encoded := make([][]byte, numChunks)
+
+	err := runWorkers(numChunks, numWorkers(workers, numChunks), func(worker int, chunk int) error {
+		start := chunk * int(chunkSymbols)
+		end := start + int(chunkSymbols)
+		if end > len(p) {
+			end = len(p)
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+		hw, err := m.NewSymbolWriter(buf)
+		if err != nil {
+			return err
+		}
+		_, err = hw.Write(p[start:end])
+		if err != nil {
+			return err
+		}
+		err = hw.Close()
+		if err != nil {
+			return err
+		}
+		encoded[chunk] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	table := bytes.NewBuffer([]byte{})
+	for i, chunk := range encoded {
+		if len(chunk) > math.MaxUint32 {
+			return 0, fmt.Errorf("Chunk %d is too large, %d encoded bytes", i, len(chunk))
+		}
+		binary.Write(table, binary.LittleEndian, uint32(len(chunk)))
+	}
+	_, err = w.Write(table.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	for _, chunk := range encoded {
+		_, err = w.Write(chunk)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Read the chunk size table and all of the chunks, then decode the chunks on
+// separate goroutines. Each chunk must decode to exactly its symbols, with
+// nothing left over. Like readSymbols the output of each chunk grows as it is
+// decoded, with the total checked as it goes.
+func readParallelPayload(r *countingReader, h *Header, workers int, check func(decoded uint64) error) ([]byte, error) {
+	n := numParallelChunks(h.PayloadLen, h.ChunkSymbols)
+	// Small enough for an int on any platform, and for the 4 bytes of each
+	// entry of the table
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("PARALLEL packet has too many chunks, %d", n)
+	}
+	numChunks := int(n)
+	table, err := readLimited(r, 4*n)
+	if err != nil {
+		return nil, err
+	}
+
+	coder, err := findCoder(h.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Where each chunk starts in the encoded payload. A chunk too short to
+	// hold its symbols is rejected before anything is read or decoded.
+	offsets := make([]uint64, numChunks+1)
+	for i := 0; i < numChunks; i++ {
+		size := uint64(binary.LittleEndian.Uint32(table[4*i:]))
+		if size < coder.minEncodedLen(chunkLen(h, i, numChunks)) {
+			return nil, fmt.Errorf("%w, chunk %d of %d symbols is only %d bytes",
+				io.ErrUnexpectedEOF, i, chunkLen(h, i, numChunks), size)
+		}
+		offsets[i+1] = offsets[i] + size
+	}
+	encoded, err := readLimited(r, offsets[numChunks])
+	if err != nil {
+		return nil, err
+	}
+
+	workers = numWorkers(workers, numChunks)
+	readers := make([]huffman.SymbolReader, workers)
+	decoded := make([][]byte, numChunks)
+	// The number of bytes decoded by all of the chunks so far
+	var total uint64
+	err = runWorkers(numChunks, workers, func(worker int, chunk int) error {
+		src := bytes.NewReader(encoded[offsets[chunk]:offsets[chunk+1]])
+		if readers[worker] == nil {
+			var err error
+			readers[worker], err = h.Model.NewSymbolReader(src)
+			if err != nil {
+				return err
+			}
+		} else {
+			readers[worker].Reset(src)
+		}
+
+		last := uint64(0)
+		var err error
+		decoded[chunk], err = readSymbols(nil, readers[worker], chunkLen(h, chunk, numChunks), func(n uint64) error {
+			sum := atomic.AddUint64(&total, n-last)
+			last = n
+			return check(sum)
+		})
+		if err != nil {
+			return err
+		}
+		err = readers[worker].Finish()
+		if err != nil {
+			return err
+		}
+		if src.Len() > 0 {
+			return fmt.Errorf("%w, %d bytes left over in chunk %d", ErrTrailingData, src.Len(), chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, 0, total)
+	for i := range decoded {
+		p = append(p, decoded[i]...)
+		decoded[i] = nil
+	}
+	return p, nil
+}
+
+// The number of symbols in the chunk, only the last one can be short.
+func chunkLen(h *Header, chunk int, numChunks int) uint64 {
+	symbols := uint64(h.ChunkSymbols)
+	if chunk == numChunks-1 && h.PayloadLen%symbols > 0 {
+		return h.PayloadLen % symbols
+	}
+	return symbols
+}
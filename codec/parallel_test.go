@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// A PARALLEL packet header followed by the given bytes
+func parallelHeader(flags uint16, payloadLen uint64, chunkSymbols uint32, rest ...byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, VERSION)
+	binary.Write(buf, binary.LittleEndian, flags|PARALLEL)
+	binary.Write(buf, binary.LittleEndian, payloadLen)
+	binary.Write(buf, binary.LittleEndian, chunkSymbols)
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+func TestParallel_EncodeDecode(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 50)
+
+	for _, flags := range []uint16{0, HAS_MODEL, ADAPTIVE_MODEL, HAS_CHECKSUM} {
+		for _, chunkSymbols := range []uint32{1, 7, 100, uint32(len(src)), 100000} {
+			packet := encodePacket(t, src, flags|PARALLEL, withParallelChunkSize(chunkSymbols))
+
+			// Followed by a second packet to check only this packet is read
+			r := bytes.NewReader(append(packet, packet...))
+			for i := 0; i < 2; i++ {
+				decoder, err := NewDecoder(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := decoder.Read()
+				if err != nil {
+					t.Fatalf("Failed to decode flags %#x chunk %d: %v", flags, chunkSymbols, err)
+				}
+				if bytes.Compare(src, got) != 0 {
+					t.Errorf("Payload differs with flags %#x chunk %d. got = %s", flags, chunkSymbols, got)
+				}
+			}
+		}
+	}
+}
+
+func TestParallel_Deterministic(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	src := make([]byte, 50000)
+	for i := range src {
+		// Skewed so that the codes have different lengths
+		src[i] = byte(rnd.ExpFloat64() * 16)
+	}
+
+	want := encodePacket(t, src, ADAPTIVE_MODEL|PARALLEL, withParallelChunkSize(1000), withWorkers(1))
+	for _, workers := range []int{2, 3, 8, 64} {
+		got := encodePacket(t, src, ADAPTIVE_MODEL|PARALLEL, withParallelChunkSize(1000), withWorkers(workers))
+		if bytes.Compare(want, got) != 0 {
+			t.Errorf("Packet encoded with %d workers differs from 1 worker", workers)
+		}
+
+		decoder, err := NewDecoder(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder.SetWorkers(workers)
+		p, err := decoder.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(src, p) != 0 {
+			t.Errorf("Failed to decode with %d workers", workers)
+		}
+	}
+}
+
+func TestParallel_Errors(t *testing.T) {
+	encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoder.SetParallelChunkSize(0) == nil {
+		t.Errorf("Expected an error for a chunk size of 0")
+	}
+	if _, err := encoder.Write([]byte("abc"), PARALLEL|BLOCK_INDEX); err == nil {
+		t.Errorf("Expected an error for PARALLEL with BLOCK_INDEX")
+	}
+	if _, err := NewStreamEncoder(bytes.NewBuffer([]byte{}), PARALLEL); err == nil {
+		t.Errorf("Expected an error streaming with PARALLEL")
+	}
+
+	// Every truncation must fail rather than return a short payload
+	packet := encodePacket(t, []byte(streamTestText), PARALLEL, withParallelChunkSize(8))
+	for n := 0; n < len(packet); n++ {
+		decoder, err := NewDecoder(bytes.NewReader(packet[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decoder.Read(); err == nil {
+			t.Errorf("Expected an error decoding %d of %d bytes", n, len(packet))
+		}
+	}
+}
+
+func TestParallel_ChunkCount(t *testing.T) {
+	tests := []struct {
+		payloadLen   uint64
+		chunkSymbols uint32
+		want         uint64
+	}{
+		{0, 1, 0},
+		{1, 8, 1},
+		{16, 8, 2},
+		{17, 8, 3},
+		{math.MaxUint64, 1, math.MaxUint64},
+		{math.MaxUint64, 2, 1 << 63},
+		{math.MaxUint64 - 1, math.MaxUint32, 1<<32 + 1},
+	}
+	for _, test := range tests {
+		if got := numParallelChunks(test.payloadLen, test.chunkSymbols); got != test.want {
+			t.Errorf("%d symbols in chunks of %d is %d chunks, want %d",
+				test.payloadLen, test.chunkSymbols, got, test.want)
+		}
+	}
+
+	// The chunk count must not wrap around to 0 and leave the whole
+	// PayloadLen to be allocated, even without any limits
+	packet := parallelHeader(0, math.MaxUint64, 2, 0, 0, 0, 0)
+	if _, err := decodeWithOptions(packet, DecoderOptions{}); err == nil {
+		t.Errorf("Expected an error for %d chunks", uint64(1)<<63)
+	}
+}
+
+func TestParallel_TinyPacket(t *testing.T) {
+	// A packet of 24 bytes with a single chunk which claims 1 GiB, within the
+	// default limits. The chunk table says the chunk is 4 bytes, just a rANS
+	// state.
+	for _, flags := range []uint16{0, CODER_RANS} {
+		packet := parallelHeader(flags, 1<<30, math.MaxUint32, 4, 0, 0, 0, 0x00, 0x00, 0x80, 0x00)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := decodeBytes(packet)
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("Expected an error with flags %#x", flags)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("Allocated %d bytes for a packet of %d bytes with flags %#x", allocated, len(packet), flags)
+		}
+	}
+}
+
+func BenchmarkParallel_Encode(b *testing.B) {
+	src := bytes.Repeat([]byte(streamTestText), 100000)
+	b.SetBytes(int64(len(src)))
+	for i := 0; i < b.N; i++ {
+		encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = encoder.Write(src, PARALLEL)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+// ModelRegistry maps model IDs to models so that a packet only needs to carry
+// the ID of the model it was encoded with (HAS_MODEL_ID) instead of the whole
+// HuffmanTree. The encoder and decoder must register the same models under the
+// same IDs. Safe for use from multiple goroutines.
+type ModelRegistry struct {
+	mutex  sync.RWMutex
+	models map[uint32]huffman.Coder
+}
+
+func NewModelRegistry() *ModelRegistry {
+	return &ModelRegistry{models: make(map[uint32]huffman.Coder)}
+}
+
+// Register the model under a chosen ID, e.g. one per data type and version.
+// An ID can only be registered once. Models which an Encoder would refuse,
+// see NewEncoderWithModel, can not be registered.
+func (this *ModelRegistry) Register(id uint32, m huffman.Coder) error {
+	if m == nil {
+		return errors.New("Can not register a nil model")
+	}
+	_, err := coderFlags(m)
+	if err != nil {
+		return err
+	}
+	err = checkModel(m)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.models[id]; ok {
+		return fmt.Errorf("Model ID 0x%08x is already registered", id)
+	}
+	this.models[id] = m
+	return nil
+}
+
+// Register the model under the ID given by ModelID and return the ID.
+// Registering the same model twice is not an error.
+func (this *ModelRegistry) RegisterModel(m huffman.Coder) (uint32, error) {
+	id, err := ModelID(m)
+	if err != nil {
+		return 0, err
+	}
+	err = checkModel(m)
+	if err != nil {
+		return 0, err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if existing, ok := this.models[id]; ok {
+		// Make sure it is the same code and not a hash collision
+		a, err := existing.MarshalAlphabet(huffman.DefaultAlphabet())
+		if err != nil {
+			return 0, err
+		}
+		b, err := m.MarshalAlphabet(huffman.DefaultAlphabet())
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(a, b) {
+			return 0, fmt.Errorf("Model ID 0x%08x is already registered to a different model", id)
+		}
+		return id, nil
+	}
+	this.models[id] = m
+	return id, nil
+}
+
+// Find the model registered under the ID.
+func (this *ModelRegistry) Lookup(id uint32) (huffman.Coder, error) {
+	if this == nil {
+		return nil, fmt.Errorf("%w 0x%08x, no model registry was given", ErrUnknownModelID, id)
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	m, ok := this.models[id]
+	if !ok {
+		return nil, fmt.Errorf("%w 0x%08x", ErrUnknownModelID, id)
+	}
+	return m, nil
+}
+
+// A hashed ID for the model, the CRC-32C of the model as it would be written
+// in the HuffmanTree or FreqTable. Models which produce the same codes have
+// the same ID.
+func ModelID(m huffman.Coder) (uint32, error) {
+	if m == nil {
+		return 0, errors.New("Can not find the ID of a nil model")
+	}
+	_, err := coderFlags(m)
+	if err != nil {
+		return 0, err
+	}
+	p, err := m.MarshalAlphabet(huffman.DefaultAlphabet())
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(p, castagnoliTable), nil
+}
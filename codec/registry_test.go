@@ -0,0 +1,237 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+func TestRegistry_EncodeDecode(t *testing.T) {
+	src := []byte(`{"id": 12, "name": "iku", "tags": ["a", "b"]}`)
+	m, err := huffman.CreateModelFromText(append(append([]byte{}, src...), huffman.DefaultAlphabet()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewModelRegistry()
+	err = registry.Register(3, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flags := range []uint16{HAS_MODEL_ID, HAS_MODEL_ID | HAS_CHECKSUM, HAS_MODEL_ID | BLOCK_INDEX} {
+		encoded := bytes.NewBuffer([]byte{})
+		encoder, err := NewEncoderWithRegistry(encoded, registry, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encoder.Write(src, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := encoded.Bytes()
+
+		h, err := ReadHeaderWithRegistry(bytes.NewReader(packet), registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ModelID != 3 || h.Model != m {
+			t.Errorf("Header has model ID %d and model %p, want 3 and %p", h.ModelID, h.Model, m)
+		}
+
+		decoder, err := NewDecoderWithRegistry(bytes.NewReader(packet), registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoder.Read()
+		if err != nil {
+			t.Fatalf("Failed to decode flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("Payload differs with flags %#x. got = %s", flags, got)
+		}
+	}
+}
+
+func TestRegistry_UnknownID(t *testing.T) {
+	registry := NewModelRegistry()
+	_, err := registry.RegisterModel(huffman.DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ModelID(huffman.DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewEncoderWithRegistry(encoded, registry, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write([]byte("abc"), HAS_MODEL_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No registry at all
+	decoder, err := NewDecoder(bytes.NewReader(encoded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decoder.Read()
+	if err == nil || !strings.Contains(err.Error(), "no model registry") {
+		t.Errorf("Expected a missing registry error, got %v", err)
+	}
+
+	// A registry without the model
+	decoder, err = NewDecoderWithRegistry(bytes.NewReader(encoded.Bytes()), NewModelRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decoder.Read()
+	if err == nil || !strings.Contains(err.Error(), "Unknown model ID") {
+		t.Errorf("Expected an unknown model ID error, got %v", err)
+	}
+}
+
+func TestRegistry_Errors(t *testing.T) {
+	registry := NewModelRegistry()
+	if registry.Register(1, nil) == nil {
+		t.Errorf("Expected an error registering a nil model")
+	}
+	err := registry.Register(1, huffman.DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.Register(1, huffman.ASCIIModel()) == nil {
+		t.Errorf("Expected an error registering an ID twice")
+	}
+
+	// Hashed IDs are stable for the same model
+	a, err := registry.RegisterModel(huffman.DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := registry.RegisterModel(huffman.DefaultModel())
+	if err != nil || a != b {
+		t.Errorf("Registering the same model gave IDs %#x and %#x, %v", a, b, err)
+	}
+
+	if _, err := NewEncoderWithRegistry(bytes.NewBuffer([]byte{}), registry, 99); err == nil {
+		t.Errorf("Expected an error creating an encoder with an unknown ID")
+	}
+	encoder, err := NewEncoder(bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write([]byte("abc"), HAS_MODEL_ID); err == nil {
+		t.Errorf("Expected an error writing HAS_MODEL_ID without a model ID")
+	}
+	encoder, err = NewEncoderWithRegistry(bytes.NewBuffer([]byte{}), registry, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write([]byte("abc"), HAS_MODEL_ID|HAS_MODEL); err == nil {
+		t.Errorf("Expected an error writing HAS_MODEL_ID with HAS_MODEL")
+	}
+}
+
+func TestRegistry_EscapeModel(t *testing.T) {
+	src := []byte(`{"id": 12, "name": "iku"}`)
+	m, err := huffman.CreateModelWithEscape(src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ESCAPE has no length in the HuffmanTree, so the model can not be
+	// written in a packet or hashed to an ID
+	for _, flags := range []uint16{HAS_MODEL, HAS_MODEL | COMPACT_MODEL} {
+		encoder, err := NewEncoderWithModel(bytes.NewBuffer([]byte{}), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = encoder.Write(src, flags)
+		var serr *huffman.SymbolError
+		if !errors.As(err, &serr) || serr.Symbol != huffman.ESCAPE {
+			t.Errorf("Expected a SymbolError for ESCAPE with flags %#x, got %v", flags, err)
+		}
+		if !errors.Is(err, huffman.ErrInvalidModel) {
+			t.Errorf("Expected ErrInvalidModel with flags %#x, got %v", flags, err)
+		}
+	}
+	registry := NewModelRegistry()
+	if _, err := registry.RegisterModel(m); !errors.Is(err, huffman.ErrSymbolNotInAlphabet) {
+		t.Errorf("Expected ErrSymbolNotInAlphabet registering the model, got %v", err)
+	}
+
+	// A chosen ID works as both sides have the whole model
+	err = registry.Register(7, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewEncoderWithRegistry(encoded, registry, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"id": 99, "name": "not in the model"}`)
+	_, err = encoder.Write(payload, HAS_MODEL_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := NewDecoderWithRegistry(encoded, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decoder.Read()
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("Decoded %q, %v, want %q", got, err, payload)
+	}
+}
+
+func TestRegistry_EOBModel(t *testing.T) {
+	src := []byte(`{"id": 12, "name": "iku"}`)
+	m, err := huffman.CreateModelWithEOB(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Writer ends the payload with EOB but the Decoder stops at
+	// PayloadLen, so the model is refused before a packet is written
+	encoded := bytes.NewBuffer([]byte{})
+	_, err = NewEncoderWithModel(encoded, m)
+	if !errors.Is(err, ErrEOBNotSupported) || !errors.Is(err, huffman.ErrInvalidModel) {
+		t.Errorf("Expected ErrEOBNotSupported creating an encoder, got %v", err)
+	}
+	err = writeHeader(encoded, &Header{Flags: HAS_MODEL, Model: m})
+	if !errors.Is(err, ErrEOBNotSupported) {
+		t.Errorf("Expected ErrEOBNotSupported writing the header, got %v", err)
+	}
+	registry := NewModelRegistry()
+	if err := registry.Register(7, m); !errors.Is(err, ErrEOBNotSupported) {
+		t.Errorf("Expected ErrEOBNotSupported registering the model, got %v", err)
+	}
+	if _, err := registry.RegisterModel(m); !errors.Is(err, huffman.ErrInvalidModel) {
+		t.Errorf("Expected ErrInvalidModel registering the model, got %v", err)
+	}
+
+	// The same counts without EOB make a round trip
+	plain, err := huffman.CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := NewEncoderWithModel(encoded, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write(src, HAS_MODEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeBytes(encoded.Bytes())
+	if err != nil || !bytes.Equal(got, src) {
+		t.Errorf("Decoded %q, %v, want %q", got, err, src)
+	}
+}
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// Written before each packet by an Encoder with SetMagic, "IKUH" in the
+	// stream. Lets a Decoder with DecoderOptions.Resync find the start of the
+	// next packet after a corrupt one.
+	MAGIC = uint32(0x48554b49)
+)
+
+// Write MAGIC before every packet so that a stream of packets can be read
+// with DecoderOptions.Resync.
+func (this *Encoder) SetMagic(enabled bool) {
+	this.magic = enabled
+}
+
+// Move on to the next packet of the stream, whose payload is then returned
+// by Payload. Returns false once the stream ends or a packet fails to decode,
+// Err tells the two apart. With DecoderOptions.Resync packets which fail to
+// decode are skipped instead of stopping, see Skipped.
+//
+//	for decoder.Next() {
+//		p := decoder.Payload()
+//	}
+//	if err := decoder.Err(); err != nil {
+func (this *Decoder) Next() bool {
+	this.payload = nil
+	if this.err != nil {
+		return false
+	}
+	for {
+		p, err := this.read(false)
+		if err == nil {
+			this.payload = p
+			return true
+		}
+		if err == io.EOF {
+			return false
+		}
+		if !this.opts.Resync || this.replay.failed != nil {
+			this.err = err
+			return false
+		}
+		this.skipped += 1
+	}
+}
+
+// The payload of the packet read by the last call to Next.
+func (this *Decoder) Payload() []byte {
+	return this.payload
+}
+
+// The error which stopped Next, nil if the stream ended cleanly between
+// packets.
+func (this *Decoder) Err() error {
+	return this.err
+}
+
+// The number of packets Next skipped because they failed to decode,
+// including a last packet cut short by the end of the stream. Only with
+// DecoderOptions.Resync.
+func (this *Decoder) Skipped() int {
+	return this.skipped
+}
+
+// Skip ahead to just after the next MAGIC. Returns io.EOF if the stream
+// ends first, whatever was skipped.
+func findMagic(r io.Reader) error {
+	var window [4]byte
+	n := 0
+	for {
+		copy(window[:], window[1:])
+		_, err := io.ReadFull(r, window[3:])
+		if err != nil {
+			return err
+		}
+		n += 1
+		if n >= len(window) && binary.LittleEndian.Uint32(window[:]) == MAGIC {
+			return nil
+		}
+	}
+}
+
+// Keeps a copy of everything read since the last mark, so that the bytes of
+// a packet which fails to decode can be searched again for the next MAGIC.
+// A corrupt header may claim far more bytes than its packet has, which
+// would otherwise swallow the packets after it.
+type replayReader struct {
+	r io.Reader
+	// Bytes to read again before reading more from r
+	pending  []byte
+	recorded []byte
+	// An error from r itself rather than from a bad packet, retrying it
+	// would never get past it
+	failed error
+}
+
+func (this *replayReader) Read(p []byte) (int, error) {
+	if len(this.pending) > 0 {
+		n := copy(p, this.pending)
+		this.pending = this.pending[n:]
+		this.recorded = append(this.recorded, p[:n]...)
+		return n, nil
+	}
+	n, err := this.r.Read(p)
+	this.recorded = append(this.recorded, p[:n]...)
+	if err != nil && err != io.EOF {
+		this.failed = err
+	}
+	return n, err
+}
+
+// Start recording from here.
+func (this *replayReader) mark() {
+	this.recorded = this.recorded[:0]
+}
+
+// Read everything since the mark again.
+func (this *replayReader) rewind() {
+	this.pending = append(append([]byte{}, this.recorded...), this.pending...)
+	this.recorded = this.recorded[:0]
+}
@@ -0,0 +1,162 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Encode each record as its own packet, one after the other
+func encodeRecords(t *testing.T, records [][]byte, flags []uint16, magic bool) []byte {
+	stream := make([]byte, 0)
+	for i, record := range records {
+		packet := encodePacket(t, record, flags[i%len(flags)],
+			withIndexBlockSize(4), withParallelChunkSize(4), withMagic(magic))
+		stream = append(stream, packet...)
+	}
+	return stream
+}
+
+func testRecords(n int) [][]byte {
+	records := make([][]byte, n)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf(`{"id":%d,"msg":"record number %d"}`, i, i))
+	}
+	return records
+}
+
+var sequenceFlags = []uint16{
+	0, HAS_MODEL, ADAPTIVE_MODEL | HAS_CHECKSUM, ADAPTIVE_MODEL | COMPACT_MODEL,
+	BLOCK_INDEX, PARALLEL | HAS_CHECKSUM, ADAPTIVE_MODEL | CODER_RANS,
+}
+
+func readRecords(t *testing.T, stream []byte, opts DecoderOptions) ([][]byte, *Decoder) {
+	decoder, err := NewDecoder(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.SetOptions(opts)
+	got := make([][]byte, 0)
+	for decoder.Next() {
+		got = append(got, decoder.Payload())
+	}
+	return got, decoder
+}
+
+func TestSequence_Next(t *testing.T) {
+	records := testRecords(20)
+	for _, magic := range []bool{false, true} {
+		stream := encodeRecords(t, records, sequenceFlags, magic)
+		got, decoder := readRecords(t, stream, DecoderOptions{Resync: magic})
+		if decoder.Err() != nil {
+			t.Fatalf("Failed to read the records: %v", decoder.Err())
+		}
+		if len(got) != len(records) {
+			t.Fatalf("Read %d records, want %d", len(got), len(records))
+		}
+		for i := range records {
+			if bytes.Compare(got[i], records[i]) != 0 {
+				t.Errorf("Record %d is %s, want %s", i, got[i], records[i])
+			}
+		}
+	}
+
+	// Each packet is followed by the next one rather than trailing data
+	for _, magic := range []bool{false, true} {
+		stream := encodeRecords(t, records, sequenceFlags, magic)
+		opts := DecoderOptions{RejectTrailingData: true, Resync: magic}
+		got, decoder := readRecords(t, stream, opts)
+		if len(got) != len(records) || decoder.Err() != nil {
+			t.Errorf("Read %d of %d records with RejectTrailingData, %v", len(got), len(records), decoder.Err())
+		}
+		if !magic {
+			_, decoder = readRecords(t, append(stream, 0x00), opts)
+			if decoder.Err() == nil {
+				t.Errorf("Expected an error for a byte after the last packet")
+			}
+		}
+	}
+
+	// An empty stream has no packets and no error
+	got, decoder := readRecords(t, nil, DefaultDecoderOptions())
+	if len(got) != 0 || decoder.Err() != nil {
+		t.Errorf("Expected nothing from an empty stream, got %d records and %v", len(got), decoder.Err())
+	}
+}
+
+func TestSequence_Truncated(t *testing.T) {
+	records := testRecords(3)
+	for _, flags := range sequenceFlags {
+		stream := encodeRecords(t, records, []uint16{flags}, false)
+		last := len(encodeRecords(t, records[:2], []uint16{flags}, false))
+
+		// Cut off anywhere in the last packet
+		for n := last + 1; n < len(stream); n++ {
+			got, decoder := readRecords(t, stream[:n], DefaultDecoderOptions())
+			if len(got) != 2 {
+				t.Errorf("Read %d records cut at %d of %d with flags %#x", len(got), n, len(stream), flags)
+			}
+			if !errors.Is(decoder.Err(), io.ErrUnexpectedEOF) {
+				t.Errorf("Expected io.ErrUnexpectedEOF cut at %d of %d with flags %#x, got %v",
+					n, len(stream), flags, decoder.Err())
+			}
+		}
+	}
+}
+
+func TestSequence_Resync(t *testing.T) {
+	records := testRecords(6)
+	packets := make([][]byte, len(records))
+	for i := range records {
+		packets[i] = encodeRecords(t, records[i:i+1], sequenceFlags[i:i+1], true)
+	}
+
+	// Garbage at the start, record 1 cut short, and record 3 with a broken
+	// header which claims to be longer than the rest of the stream
+	stream := []byte("garbage")
+	stream = append(stream, packets[0]...)
+	stream = append(stream, packets[1][:len(packets[1])/2]...)
+	stream = append(stream, packets[2]...)
+	broken := append([]byte{}, packets[3]...)
+	// PayloadLen is the 8 bytes after the MAGIC, Version and Flags
+	broken[9] += 0x10
+	stream = append(stream, broken...)
+	stream = append(stream, packets[4]...)
+	stream = append(stream, packets[5]...)
+
+	got, decoder := readRecords(t, stream, DecoderOptions{Resync: true})
+	if decoder.Err() != nil {
+		t.Fatalf("Failed to resync: %v", decoder.Err())
+	}
+	want := [][]byte{records[0], records[2], records[4], records[5]}
+	if len(got) != len(want) {
+		t.Fatalf("Read %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if bytes.Compare(got[i], want[i]) != 0 {
+			t.Errorf("Record %d is %s, want %s", i, got[i], want[i])
+		}
+	}
+	if decoder.Skipped() != 2 {
+		t.Errorf("Skipped %d packets, want 2", decoder.Skipped())
+	}
+
+	// A final packet cut short anywhere after its MAGIC is skipped too
+	stream = append(append([]byte{}, packets[0]...), packets[1]...)
+	for n := len(packets[0]) + 4; n < len(stream); n++ {
+		got, decoder := readRecords(t, stream[:n], DecoderOptions{Resync: true})
+		if len(got) != 1 || decoder.Err() != nil || decoder.Skipped() != 1 {
+			t.Errorf("Cut at %d of %d: read %d records and skipped %d, %v",
+				n, len(stream), len(got), decoder.Skipped(), decoder.Err())
+		}
+	}
+
+	// Without Resync the first bad packet stops the loop
+	stream = append(append([]byte{}, packets[0]...), broken...)
+	got, decoder = readRecords(t, stream[4:], DefaultDecoderOptions())
+	if len(got) != 1 || decoder.Err() == nil {
+		t.Errorf("Expected 1 record and an error, got %d and %v", len(got), decoder.Err())
+	}
+}
@@ -0,0 +1,325 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/Stymphalian/iku_huffman/huffman"
+)
+
+const (
+	// The default number of payload bytes buffered before a block is written
+	kDEFAULT_BLOCK_SIZE = 64 * 1024
+)
+
+// StreamEncoder writes a STREAMED packet. The header is written up front and
+// the payload is written out in blocks as they fill up, so the length of the
+// payload does not need to be known and the payload is never held in memory.
+// Close must be called to write the final block and the end of stream marker.
+// The payload is always encoded with the default model of the coder selected
+// by the flags.
+type StreamEncoder struct {
+	w           io.Writer
+	m           huffman.Coder
+	flags       uint16
+	block       []byte
+	wroteHeader bool
+	closed      bool
+	// CRC-32C of all of the payload written so far
+	checksum uint32
+	// Returned by every call to Close after the first
+	closeErr error
+}
+
+func NewStreamEncoder(w io.Writer, flags uint16) (*StreamEncoder, error) {
+	return NewStreamEncoderSize(w, flags, kDEFAULT_BLOCK_SIZE)
+}
+
+// Create a StreamEncoder which buffers up to blockSize bytes of payload before
+// writing a block. The BlockLen of a block is a uint32, so blockSize can be at
+// most math.MaxUint32.
+func NewStreamEncoderSize(w io.Writer, flags uint16, blockSize int) (*StreamEncoder, error) {
+	if flags&ADAPTIVE_MODEL > 0 {
+		return nil, fmt.Errorf(
+			"%w, ADAPTIVE_MODEL is not supported when streaming, the model must be known before the payload",
+			ErrInvalidFlags)
+	}
+	if flags&(BLOCK_INDEX|PARALLEL) > 0 {
+		return nil, fmt.Errorf(
+			"%w, BLOCK_INDEX and PARALLEL are not supported when streaming, the blocks already split up the payload",
+			ErrInvalidFlags)
+	}
+	if flags&HAS_MODEL_ID > 0 {
+		return nil, fmt.Errorf(
+			"%w, HAS_MODEL_ID is not supported when streaming, a StreamEncoder only uses the default model",
+			ErrInvalidFlags)
+	}
+	if blockSize <= 0 || uint64(blockSize) > math.MaxUint32 {
+		return nil, fmt.Errorf("Invalid block size %d", blockSize)
+	}
+	coder, err := findCoder(flags)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCompact(flags)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamEncoder{
+		w:     w,
+		m:     coder.defaultModel(),
+		flags: flags | STREAMED,
+		block: make([]byte, 0, blockSize),
+	}, nil
+}
+
+func (this *StreamEncoder) Write(p []byte) (int, error) {
+	if this.closed {
+		return 0, errors.New("Write on a closed StreamEncoder")
+	}
+	if !this.wroteHeader {
+		// The length is unknown so it is always written as 0.
+		err := writeHeader(this.w, &Header{Flags: this.flags, Model: this.m})
+		if err != nil {
+			return 0, err
+		}
+		this.wroteHeader = true
+	}
+
+	n := 0
+	for n < len(p) {
+		count := copy(this.block[len(this.block):cap(this.block)], p[n:])
+		this.block = this.block[:len(this.block)+count]
+		n += count
+
+		if len(this.block) == cap(this.block) {
+			err := this.writeBlock()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Write out whatever is left in the current block followed by the end of
+// stream marker. Does not close the underlying writer. If that fails the
+// stream is left without its end, and later calls return the same error.
+func (this *StreamEncoder) Close() error {
+	if this.closed {
+		return this.closeErr
+	}
+	this.closeErr = this.writeEnd()
+	this.closed = true
+	return this.closeErr
+}
+
+func (this *StreamEncoder) writeEnd() error {
+	if !this.wroteHeader {
+		// Make sure that even an empty stream has a header.
+		_, err := this.Write(nil)
+		if err != nil {
+			return err
+		}
+	}
+	if len(this.block) > 0 {
+		err := this.writeBlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// An empty block marks the end of the stream. Its checksum covers the
+	// whole payload.
+	return this.writeBlockHeader(0, 0, this.checksum)
+}
+
+// Encode the buffered payload and write it out as a single block.
+func (this *StreamEncoder) writeBlock() error {
+	encoded := bytes.NewBuffer([]byte{})
+	hw, err := this.m.NewSymbolWriter(encoded)
+	if err != nil {
+		return err
+	}
+	_, err = hw.Write(this.block)
+	if err != nil {
+		return err
+	}
+	err = hw.Close()
+	if err != nil {
+		return err
+	}
+	if uint64(encoded.Len()) > math.MaxUint32 {
+		return fmt.Errorf("Encoded block of %d bytes is too long for the EncodedLen of a block", encoded.Len())
+	}
+
+	this.checksum = crc32.Update(this.checksum, castagnoliTable, this.block)
+	err = this.writeBlockHeader(uint32(len(this.block)), uint32(encoded.Len()),
+		crc32.Checksum(this.block, castagnoliTable))
+	if err != nil {
+		return err
+	}
+	_, err = this.w.Write(encoded.Bytes())
+	if err != nil {
+		return err
+	}
+
+	this.block = this.block[:0]
+	return nil
+}
+
+// The checksum is only written if the HAS_CHECKSUM flag is set.
+func (this *StreamEncoder) writeBlockHeader(blockLen uint32, encodedLen uint32, checksum uint32) error {
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, blockLen)
+	binary.Write(buf, binary.LittleEndian, encodedLen)
+	if this.flags&HAS_CHECKSUM > 0 {
+		binary.Write(buf, binary.LittleEndian, checksum)
+	}
+	_, err := this.w.Write(buf.Bytes())
+	return err
+}
+
+// StreamDecoder reads the payload of a packet one block at a time. Read
+// returns io.EOF once the end of stream marker has been read.
+type StreamDecoder struct {
+	r io.Reader
+	h *Header
+
+	// The current block being read.
+	block     *io.LimitedReader
+	hr        huffman.SymbolReader
+	remaining uint32
+
+	// Checksums of the current block and of the whole payload, both the
+	// expected value from the stream and the value of what has been read.
+	blockWant uint32
+	blockGot  uint32
+	totalGot  uint32
+
+	done bool
+}
+
+// Reads the packet header from the stream. The payload is read on demand by
+// calls to Read.
+func NewStreamDecoder(r io.Reader) (*StreamDecoder, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.Flags&STREAMED == 0 {
+		return nil, errors.New("Packet is not STREAMED, use a Decoder instead")
+	}
+	return newStreamDecoder(r, h), nil
+}
+
+func newStreamDecoder(r io.Reader, h *Header) *StreamDecoder {
+	return &StreamDecoder{r: r, h: h}
+}
+
+func (this *StreamDecoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !this.done {
+		if this.remaining == 0 {
+			err := this.nextBlock()
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		want := len(p) - n
+		if uint32(want) > this.remaining {
+			want = int(this.remaining)
+		}
+		count, err := this.hr.Read(p[n : n+want])
+		this.blockGot = crc32.Update(this.blockGot, castagnoliTable, p[n:n+count])
+		this.totalGot = crc32.Update(this.totalGot, castagnoliTable, p[n:n+count])
+		n += count
+		this.remaining -= uint32(count)
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+
+		if this.remaining > 0 {
+			continue
+		}
+		err = this.hr.Finish()
+		if err != nil {
+			return n, err
+		}
+		if this.h.Flags&HAS_CHECKSUM > 0 && this.blockGot != this.blockWant {
+			return n, ErrChecksumMismatch
+		}
+	}
+
+	if n == 0 && this.done && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Move on to the next block in the stream. The current block must have been
+// read to its last byte.
+func (this *StreamDecoder) nextBlock() error {
+	if this.block != nil {
+		if this.block.N > 0 {
+			return fmt.Errorf("%w, %d bytes left over in the block", ErrTrailingData, this.block.N)
+		}
+		this.block = nil
+	}
+
+	var blockLen uint32
+	var encodedLen uint32
+	err := binary.Read(this.r, binary.LittleEndian, &blockLen)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	err = binary.Read(this.r, binary.LittleEndian, &encodedLen)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if this.h.Flags&HAS_CHECKSUM > 0 {
+		err = binary.Read(this.r, binary.LittleEndian, &this.blockWant)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	this.blockGot = 0
+
+	if blockLen == 0 {
+		if encodedLen != 0 {
+			return fmt.Errorf("%w, the end of stream block has %d encoded bytes", ErrTrailingData, encodedLen)
+		}
+		if this.h.Flags&HAS_CHECKSUM > 0 && this.totalGot != this.blockWant {
+			return ErrChecksumMismatch
+		}
+		this.done = true
+		return nil
+	}
+
+	this.block = &io.LimitedReader{R: this.r, N: int64(encodedLen)}
+	if this.hr == nil {
+		this.hr, err = this.h.Model.NewSymbolReader(this.block)
+		if err != nil {
+			return err
+		}
+	} else {
+		this.hr.Reset(this.block)
+	}
+	this.remaining = blockLen
+	return nil
+}
+
+// The stream ending before the end of stream marker is always an error.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+	"testing/iotest"
+)
+
+const streamTestText = "The quick brown fox jumps over the lazy dog. "
+
+func TestStream_CopyMultipleBlocks(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 100)
+
+	for _, flags := range []uint16{0, HAS_MODEL} {
+		encoded := bytes.NewBuffer([]byte{})
+		encoder, err := NewStreamEncoderSize(encoded, flags, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(encoder, bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(src)) {
+			t.Errorf("Only copied %d bytes out of %d", n, len(src))
+		}
+		err = encoder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read the stream back a byte at a time to cross every block boundary
+		decoder, err := NewStreamDecoder(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(iotest.OneByteReader(decoder))
+		if err != nil {
+			t.Fatalf("Failed to read the stream with flags %#x: %v", flags, err)
+		}
+		if bytes.Compare(src, got) != 0 {
+			t.Errorf("payload was not retrieved with flags %#x. got = %s", flags, got)
+		}
+	}
+}
+
+func TestStream_EOF(t *testing.T) {
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoder(encoded, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write([]byte("abc"))
+	encoder.Close()
+
+	decoder, err := NewStreamDecoder(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	n, err := decoder.Read(p)
+	if n != 3 || err != nil {
+		t.Errorf("Expected to read 3 bytes with no error, got %d, %v", n, err)
+	}
+	n, err = decoder.Read(p)
+	if n != 0 || err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %d, %v", n, err)
+	}
+}
+
+func TestStream_Empty(t *testing.T) {
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoder(encoded, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := encoded.Bytes()
+	decoder, err := NewStreamDecoder(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(decoder)
+	if err != nil || len(got) != 0 {
+		t.Errorf("Expected an empty payload, got %v, %v", got, err)
+	}
+
+	// The end of stream block claims an encoded byte
+	packet[len(packet)-4] = 1
+	decoder, err = NewStreamDecoder(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(decoder)
+	if !errors.Is(err, ErrTrailingData) {
+		t.Errorf("Expected ErrTrailingData, got %v", err)
+	}
+}
+
+func TestStream_Truncated(t *testing.T) {
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoderSize(encoded, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write([]byte(streamTestText))
+	encoder.Close()
+
+	// Drop the end of stream marker and part of the last block
+	truncated := encoded.Bytes()[:encoded.Len()-10]
+	decoder, err := NewStreamDecoder(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(decoder)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF but got %v", err)
+	}
+}
+
+func TestStream_DecoderReadsStreamedPacket(t *testing.T) {
+	src := bytes.Repeat([]byte(streamTestText), 10)
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoderSize(encoded, HAS_MODEL, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(src)
+	encoder.Close()
+
+	decoder, err := NewDecoder(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decoder.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("payload was not retrieved. got = %s", got)
+	}
+}
+
+func TestStream_WriteAfterClose(t *testing.T) {
+	encoder, err := NewStreamEncoder(ioutil.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Close()
+	_, err = encoder.Write([]byte("abc"))
+	if err == nil {
+		t.Errorf("Expected an error when writing to a closed encoder")
+	}
+}
+
+func TestStream_InvalidFlags(t *testing.T) {
+	for _, flags := range []uint16{
+		ADAPTIVE_MODEL, BLOCK_INDEX, PARALLEL, HAS_MODEL_ID, HAS_MODEL_ID | HAS_MODEL,
+		CODER_RANS | HAS_MODEL | COMPACT_MODEL,
+	} {
+		encoded := bytes.NewBuffer([]byte{})
+		_, err := NewStreamEncoder(encoded, flags)
+		if !errors.Is(err, ErrInvalidFlags) {
+			t.Errorf("Expected ErrInvalidFlags for flags %#x, got %v", flags, err)
+		}
+		if encoded.Len() != 0 {
+			t.Errorf("Wrote %d bytes for flags %#x", encoded.Len(), flags)
+		}
+	}
+}
+
+// An io.Writer which fails once n bytes have been written
+type shortWriter struct {
+	n int
+}
+
+func (this *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > this.n {
+		return 0, errors.New("Write failed")
+	}
+	this.n -= len(p)
+	return len(p), nil
+}
+
+func TestStream_CloseFails(t *testing.T) {
+	w := &shortWriter{1 << 20}
+	encoder, err := NewStreamEncoder(w, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encoder.Write([]byte(streamTestText))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last block and the end of stream marker can not be written
+	w.n = 0
+	for i := 0; i < 2; i++ {
+		if err := encoder.Close(); err == nil {
+			t.Errorf("Expected an error from Close call %d", i+1)
+		}
+	}
+}
+
+func TestStream_BlockSize(t *testing.T) {
+	// BlockLen is a uint32
+	tooLarge := uint64(math.MaxUint32) + 1
+	for _, size := range []int{0, -1, int(tooLarge)} {
+		if _, err := NewStreamEncoderSize(ioutil.Discard, 0, size); err == nil {
+			t.Errorf("Expected an error for a block size of %d", size)
+		}
+	}
+}
+
+func TestStream_Checksum(t *testing.T) {
+	src := bytes.Repeat([]byte("abcd"), 40)
+	encoded := bytes.NewBuffer([]byte{})
+	encoder, err := NewStreamEncoderSize(encoded, HAS_CHECKSUM, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(src)
+	encoder.Close()
+	packet := encoded.Bytes()
+
+	got, err := decodeBytes(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("payload was not retrieved. got = %s", got)
+	}
+
+	// Corrupt the checksum of the end of stream block
+	corrupt := append([]byte{}, packet...)
+	corrupt[len(corrupt)-1] ^= 0x01
+	_, err = decodeBytes(corrupt)
+	if err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch for the total, got %v", err)
+	}
+
+	// Corrupt the checksum of the first block, which follows the header
+	h, err := ReadHeader(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := 2 + 2 + 8 + 4 + 4
+	if h.Flags&HAS_MODEL > 0 {
+		t.Fatal("Did not expect a model")
+	}
+	corrupt = append([]byte{}, packet...)
+	corrupt[headerLen+8] ^= 0x01
+	_, err = decodeBytes(corrupt)
+	if err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch for the block, got %v", err)
+	}
+}
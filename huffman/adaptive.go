@@ -0,0 +1,265 @@
+package huffman
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Stymphalian/iku_bits/bitreader"
+)
+
+// An adaptive huffman tree using the FGK algorithm (Faller, Gallager, Knuth).
+// Both the writer and reader start with a tree holding only the NYT (not yet
+// transmitted) node and update the tree after every symbol in the same way,
+// so the model never has to be sent.
+//
+// The freq of each node is its weight. The tree keeps the sibling property:
+// listing the nodes by their position in 'order' gives weights which never
+// increase, and the two children of a node are always next to each other.
+type adaptiveTree struct {
+	root   *Node
+	nyt    *Node
+	leaves map[byte]*Node
+
+	// Nodes ordered from the root (highest weight) down to the NYT node
+	order []*Node
+	index map[*Node]int
+}
+
+func newAdaptiveTree() *adaptiveTree {
+	nyt := &Node{0, 0, nil, nil, nil}
+	return &adaptiveTree{
+		root:   nyt,
+		nyt:    nyt,
+		leaves: make(map[byte]*Node),
+		order:  []*Node{nyt},
+		index:  map[*Node]int{nyt: 0},
+	}
+}
+
+// Add one to the weight of the symbol, adding it to the tree if it has not
+// been seen before, and reorder the tree to keep the sibling property.
+func (this *adaptiveTree) update(symbol byte) {
+	q, ok := this.leaves[symbol]
+	if !ok {
+		// Split the NYT node into a new NYT node and a leaf for the symbol
+		parent := this.nyt
+		q = &Node{Symbol(symbol), 0, parent, nil, nil}
+		nyt := &Node{0, 0, parent, nil, nil}
+		parent.left = nyt
+		parent.right = q
+
+		this.index[q] = len(this.order)
+		this.order = append(this.order, q)
+		this.index[nyt] = len(this.order)
+		this.order = append(this.order, nyt)
+
+		this.nyt = nyt
+		this.leaves[symbol] = q
+	}
+
+	for q != nil {
+		// Move the node to the front of the nodes with the same weight before
+		// incrementing it, so the order stays sorted by weight.
+		leader := this.blockLeader(q)
+		if leader != q && leader != q.parent {
+			this.swap(q, leader)
+		}
+		q.freq += 1
+		q = q.parent
+	}
+}
+
+// The first node in the order with the same weight as n.
+func (this *adaptiveTree) blockLeader(n *Node) *Node {
+	for i := 0; i < this.index[n]; i++ {
+		if this.order[i].freq == n.freq {
+			return this.order[i]
+		}
+	}
+	return n
+}
+
+// Swap the position of the two sub-trees in both the tree and the order.
+func (this *adaptiveTree) swap(a *Node, b *Node) {
+	ia, ib := this.index[a], this.index[b]
+	this.order[ia], this.order[ib] = b, a
+	this.index[a], this.index[b] = ib, ia
+
+	pa, pb := a.parent, b.parent
+	if pa == pb {
+		pa.left, pa.right = pa.right, pa.left
+		return
+	}
+	if pa.left == a {
+		pa.left = b
+	} else {
+		pa.right = b
+	}
+	if pb.left == b {
+		pb.left = a
+	} else {
+		pb.right = a
+	}
+	a.parent, b.parent = pb, pa
+}
+
+// The path from the root down to the node, one entry per bit
+func (this *adaptiveTree) path(n *Node) []int {
+	bits := make([]int, 0)
+	for n.parent != nil {
+		if n.parent.left == n {
+			bits = append(bits, 0)
+		} else {
+			bits = append(bits, 1)
+		}
+		n = n.parent
+	}
+	// reverse so the bits go from the root down
+	for i, j := 0, len(bits)-1; i < j; i, j = i+1, j-1 {
+		bits[i], bits[j] = bits[j], bits[i]
+	}
+	return bits
+}
+
+// AdaptiveWriter encodes a payload in a single pass with an adaptive
+// huffman code. Symbols which have not been seen before are written as the
+// pattern for the NYT node followed by the 8 bits of the symbol.
+type AdaptiveWriter struct {
+	w           *ByteSeqWriter
+	t           *adaptiveTree
+	bitsWritten uint64
+}
+
+func NewAdaptiveWriter(w io.Writer) (*AdaptiveWriter, error) {
+	bw, err := NewByteSeqWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &AdaptiveWriter{bw, newAdaptiveTree(), 0}, nil
+}
+
+func (this *AdaptiveWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		leaf, ok := this.t.leaves[p[i]]
+		if !ok {
+			leaf = this.t.nyt
+		}
+		err := this.writePath(this.t.path(leaf))
+		if err != nil {
+			return i, err
+		}
+		if !ok {
+			err = this.writeSeq(ByteSeq{uint64(p[i]), 8})
+			if err != nil {
+				return i, err
+			}
+		}
+		this.t.update(p[i])
+	}
+	return len(p), nil
+}
+
+// Write out the path a ByteSeq at a time. The path to a node can be longer
+// than a single ByteSeq can hold.
+func (this *AdaptiveWriter) writePath(bits []int) error {
+	for len(bits) > 0 {
+		var seq ByteSeq
+		for len(bits) > 0 && seq.Len < kMAX_PATTERN_LEN {
+			seq.Pattern = seq.Pattern<<1 | uint64(bits[0])
+			seq.Len += 1
+			bits = bits[1:]
+		}
+		err := this.writeSeq(seq)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *AdaptiveWriter) writeSeq(seq ByteSeq) error {
+	bitsWritten, err := this.w.Write(seq)
+	this.bitsWritten += uint64(bitsWritten)
+	return err
+}
+
+func (this *AdaptiveWriter) Close() error {
+	bitsWritten, err := this.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	this.bitsWritten += uint64(bitsWritten)
+	return nil
+}
+
+func (this *AdaptiveWriter) BitsWritten() uint64 {
+	return this.bitsWritten
+}
+
+// AdaptiveReader decodes a payload written by an AdaptiveWriter. As with
+// Reader the caller must know how many symbols to read, the padding at the
+// end of the stream is not marked.
+type AdaptiveReader struct {
+	r *countingBitReader
+	t *adaptiveTree
+	// Number of symbols decoded, the Index of a DecodeError
+	symbols int64
+}
+
+func NewAdaptiveReader(r io.Reader) (*AdaptiveReader, error) {
+	b, err := bitreader.NewBitReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &AdaptiveReader{&countingBitReader{r: b}, newAdaptiveTree(), 0}, nil
+}
+
+func (this *AdaptiveReader) Read(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		node := this.t.root
+		start := this.r.n
+		for !node.IsLeaf() {
+			b, err := this.r.ReadBit()
+			if err != nil {
+				return i, err
+			}
+			if b == 1 {
+				node = node.right
+			} else {
+				node = node.left
+			}
+		}
+
+		symbol := byte(node.symbol)
+		if node == this.t.nyt {
+			var err error
+			symbol, err = this.readRaw()
+			if err != nil {
+				return i, err
+			}
+			if _, ok := this.t.leaves[symbol]; ok {
+				return i, &DecodeError{this.symbols, start, fmt.Errorf(
+					"%w, symbol %#x of the adaptive stream was already transmitted", ErrInvalidCode, symbol)}
+			}
+		}
+
+		p[i] = symbol
+		this.symbols += 1
+		this.t.update(symbol)
+	}
+	return len(p), nil
+}
+
+// Read the 8 bits of a symbol which follow the NYT pattern
+func (this *AdaptiveReader) readRaw() (byte, error) {
+	symbol := byte(0)
+	for j := 0; j < 8; j++ {
+		b, err := this.r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		symbol = symbol<<1 | byte(b)
+	}
+	return symbol, nil
+}
@@ -0,0 +1,110 @@
+package huffman
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func adaptiveRoundTrip(t *testing.T, src []byte) *bytes.Buffer {
+	encoded := bytes.NewBuffer([]byte{})
+	w, err := NewAdaptiveWriter(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in a few pieces to make sure state carries over between calls
+	for i := 0; i < len(src); i += 7 {
+		end := i + 7
+		if end > len(src) {
+			end = len(src)
+		}
+		n, err := w.Write(src[i:end])
+		if err != nil || n != end-i {
+			t.Fatalf("Failed to write bytes: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.BitsWritten() > uint64(encoded.Len()*8) {
+		t.Errorf("Wrote %d bits but only have %d bytes", w.BitsWritten(), encoded.Len())
+	}
+	result := bytes.NewBuffer(append([]byte{}, encoded.Bytes()...))
+
+	r, err := NewAdaptiveReader(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 0, len(src))
+	for len(got) < len(src) {
+		end := len(got) + 5
+		if end > len(src) {
+			end = len(src)
+		}
+		p := make([]byte, end-len(got))
+		n, err := r.Read(p)
+		if err != nil {
+			t.Fatalf("Failed to read symbol %d: %v", len(got)+n, err)
+		}
+		got = append(got, p...)
+	}
+	if bytes.Compare(got, src) != 0 {
+		t.Errorf("Failed to encode/decode.\ngot  = %v\nwant = %v", got, src)
+	}
+	return result
+}
+
+func TestAdaptive_WriteAndRead(t *testing.T) {
+	encoded := adaptiveRoundTrip(t, []byte(loremText))
+	if encoded.Len() >= len(loremText) {
+		t.Errorf("Adaptive huffman did not compress the data %d, %d",
+			len(loremText), encoded.Len())
+	}
+
+	adaptiveRoundTrip(t, []byte(codebookTestText))
+	adaptiveRoundTrip(t, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	adaptiveRoundTrip(t, []byte("a"))
+	adaptiveRoundTrip(t, []byte{})
+
+	src := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(src)
+	adaptiveRoundTrip(t, src)
+}
+
+func TestAdaptive_FirstSymbol(t *testing.T) {
+	// The first symbol is always new and the tree only has the NYT node, so
+	// it is written as just its raw 8 bits.
+	encoded := adaptiveRoundTrip(t, []byte("a"))
+	if bytes.Compare(encoded.Bytes(), []byte{'a'}) != 0 {
+		t.Errorf("Expected the raw symbol, got %#v", encoded.Bytes())
+	}
+}
+
+func TestAdaptive_SiblingProperty(t *testing.T) {
+	tree := newAdaptiveTree()
+	for _, b := range []byte(codebookTestText) {
+		tree.update(b)
+
+		for i := 1; i < len(tree.order); i++ {
+			if tree.order[i].freq > tree.order[i-1].freq {
+				t.Fatalf("Node %d has a larger weight than node %d", i, i-1)
+			}
+		}
+		for _, n := range tree.order {
+			if n.IsLeaf() {
+				continue
+			}
+			if n.freq != n.left.freq+n.right.freq {
+				t.Fatalf("Node weight %v is not the sum of its children", n.freq)
+			}
+			li, ri := tree.index[n.left], tree.index[n.right]
+			if li-ri != 1 && ri-li != 1 {
+				t.Fatalf("Siblings are not next to each other in the order")
+			}
+		}
+	}
+	if tree.root.freq != uint64(len(codebookTestText)) {
+		t.Errorf("Root weight %v does not match the number of symbols", tree.root.freq)
+	}
+}
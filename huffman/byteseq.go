@@ -2,9 +2,7 @@ package huffman
 
 import (
 	"bytes"
-	"errors"
 	"io"
-	"log"
 
 	"github.com/Stymphalian/iku_bits/bitwriter"
 )
@@ -14,14 +12,17 @@ type ByteSeq struct {
 	Len     uint
 }
 
-func (this *ByteSeq) AddBit(one int) {
-	if this.Len >= 64 {
-		panic(errors.New("Can't add more than 64 bits to ByteSeq"))
+// Add a bit above the bits already in the sequence. Fails with
+// ErrPatternTooLong once the sequence holds 64 bits.
+func (this *ByteSeq) AddBit(one int) error {
+	if this.Len >= kMAX_PATTERN_LEN {
+		return ErrPatternTooLong
 	}
 	if one == 1 {
 		this.Pattern |= (0x01 << this.Len)
 	}
 	this.Len += 1
+	return nil
 }
 
 func (this ByteSeq) String() string {
@@ -41,18 +42,21 @@ type ByteSeqWriter struct {
 	w bitwriter.Interface
 }
 
-func NewByteSeqWriter(w io.Writer) *ByteSeqWriter {
+func NewByteSeqWriter(w io.Writer) (*ByteSeqWriter, error) {
 	b, err := bitwriter.NewBitWriter(w)
 	if err != nil {
-		log.Fatal("Failed to create a bit writer", err)
+		return nil, err
 	}
-	return &ByteSeqWriter{b}
+	return &ByteSeqWriter{b}, nil
 }
 
 // Writes the byte sequence into the writer stream
 // Return[int] the number of bits written to the stream
 // Return[error] nil if okay, otherwise error object
 func (this *ByteSeqWriter) Write(seq ByteSeq) (n int, err error) {
+	if seq.Len > kMAX_PATTERN_LEN {
+		return 0, ErrPatternTooLong
+	}
 	n = this.w.Remain()
 	for i := int(seq.Len - 1); i >= 0; i-- {
 		n += 1
@@ -44,7 +44,10 @@ func TestByteSeqString(t *testing.T) {
 
 func TestByteSeqWriter_WriteSimple(t *testing.T) {
 	dest := bytes.NewBuffer([]byte{})
-	w := NewByteSeqWriter(dest)
+	w, err := NewByteSeqWriter(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	w.Write(ByteSeq{0x02, 2})
 	w.Write(ByteSeq{0x02, 2})
@@ -64,7 +67,10 @@ func TestByteSeqWriter_WriteSimple(t *testing.T) {
 
 func TestByteSeqWriter_WriteFlush(t *testing.T) {
 	dest := bytes.NewBuffer([]byte{})
-	w := NewByteSeqWriter(dest)
+	w, err := NewByteSeqWriter(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Write out the sequence, but because it is only 13 bits we will have
 	// 5 bits to carry over
@@ -5,9 +5,17 @@ import (
 	"container/heap"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 )
 
+const (
+	// The longest pattern which can be held in a ByteSeq
+	kMAX_PATTERN_LEN = 64
+)
+
+// The count of a symbol. Only Nume, the number of times the symbol was seen,
+// is used to build a model. Deno and Freq are kept for information.
 type Freq struct {
 	Nume uint64
 	Deno uint64
@@ -34,8 +42,9 @@ func BuildFrequencyDict(src []byte) map[byte]*Freq {
 }
 
 type Node struct {
-	symbol byte
-	freq   float64
+	symbol Symbol
+	// The weight of the node, the sum of the counts of the leaves below it
+	freq   uint64
 	parent *Node
 	left   *Node
 	right  *Node
@@ -84,31 +93,40 @@ func (this *Node) String() string {
 		for i := 0; i < depth; i++ {
 			s.WriteString(" ")
 		}
-		s.WriteString(fmt.Sprintf("%c:%.2f\n", n.symbol, n.freq))
+		s.WriteString(fmt.Sprintf("%c:%d\n", n.symbol, n.freq))
 	}, 0)
 	return s.String()
 }
 
-// Type used for priority queue
-type NodePQ []*Node
+// An entry in the queue used to build the huffman tree. The seq is the order
+// in which the entry was added and breaks ties between equal weights.
+type nodeQueueItem struct {
+	node *Node
+	seq  int
+}
+
+// Priority queue of nodes ordered by (weight, seq)
+type nodeQueue []nodeQueueItem
 
 // sort.Interface methods
-func (this NodePQ) Len() int {
+func (this nodeQueue) Len() int {
 	return len(this)
 }
-func (this NodePQ) Less(i int, j int) bool {
-	return this[i].freq < this[j].freq
+func (this nodeQueue) Less(i int, j int) bool {
+	if this[i].node.freq != this[j].node.freq {
+		return this[i].node.freq < this[j].node.freq
+	}
+	return this[i].seq < this[j].seq
 }
-func (this NodePQ) Swap(i int, j int) {
+func (this nodeQueue) Swap(i int, j int) {
 	this[i], this[j] = this[j], this[i]
-
 }
 
 // heap.Interface methods
-func (this *NodePQ) Push(x interface{}) {
-	*this = append(*this, x.(*Node))
+func (this *nodeQueue) Push(x interface{}) {
+	*this = append(*this, x.(nodeQueueItem))
 }
-func (this *NodePQ) Pop() interface{} {
+func (this *nodeQueue) Pop() interface{} {
 	old := *this
 	n := len(old)
 	item := old[n-1]
@@ -116,48 +134,76 @@ func (this *NodePQ) Pop() interface{} {
 	return item
 }
 
+// Build the huffman tree from the integer counts (Nume) of the symbols. The
+// tree only depends on the counts, following the rule in spec.txt:
+//  1. The leaves are numbered 0, 1, 2, ... in increasing symbol order.
+//  2. The two nodes with the smallest (weight, number) are removed and
+//     joined under a new node whose weight is the sum of the two. The new
+//     node takes the next unused number, so on equal weights the leaves and
+//     older nodes are always joined first.
+//  3. Repeat until one node is left.
+//
+// The first node removed becomes the left child. Only the depth of each leaf
+// matters, since the patterns are taken from the canonical code.
 func buildHuffmanTree(dict map[byte]*Freq) (*Node, error) {
+	return buildSymbolHuffmanTree(symbolCounts(dict))
+}
 
-	// Return tree + all the base nodes given the mapping of prioriy of symbols
-	pq := make(NodePQ, 0)
-	heap.Init(&pq)
-
-	sortedKeys := make(symbolFreqPairSlice, 0)
+// The counts (Nume) of the freqDict keyed by Symbol.
+func symbolCounts(dict map[byte]*Freq) map[Symbol]uint64 {
+	counts := make(map[Symbol]uint64)
 	for k, v := range dict {
-		sortedKeys = append(sortedKeys, symbolFreqPair{k, *v})
+		counts[Symbol(k)] = v.Nume
 	}
-	sort.Stable(sortedKeys)
+	return counts
+}
 
-	for i := 0; i < len(sortedKeys); i++ {
-		k := byte(sortedKeys[i].symbol)
-		n := &Node{k, dict[k].Freq, nil, nil, nil}
-		heap.Push(&pq, n)
+// Like buildHuffmanTree but for counts of any Symbol, such as ESCAPE.
+func buildSymbolHuffmanTree(counts map[Symbol]uint64) (*Node, error) {
+	symbols := make([]int, 0, len(counts))
+	for k := range counts {
+		symbols = append(symbols, int(k))
 	}
+	sort.Ints(symbols)
 
-	for pq.Len() > 1 {
-		a := heap.Pop(&pq).(*Node)
-		b := heap.Pop(&pq).(*Node)
-		n := &Node{0x00, a.freq + b.freq, nil, a, b}
+	pq := make(nodeQueue, 0, len(symbols))
+	for i, k := range symbols {
+		n := &Node{Symbol(k), counts[Symbol(k)], nil, nil, nil}
+		pq = append(pq, nodeQueueItem{n, i})
+	}
+	heap.Init(&pq)
 
-		if a.Size() > b.Size() {
-			// We always want the larger sub-tree on the right side
-			n.left, n.right = n.right, n.left
+	seq := len(pq)
+	for pq.Len() > 1 {
+		a := heap.Pop(&pq).(nodeQueueItem).node
+		b := heap.Pop(&pq).(nodeQueueItem).node
+		if a.freq+b.freq < a.freq {
+			return nil, errors.New("Sum of the symbol counts overflows a uint64")
 		}
+		n := &Node{0x00, a.freq + b.freq, nil, a, b}
 		a.parent = n
 		b.parent = n
-		heap.Push(&pq, n)
+		heap.Push(&pq, nodeQueueItem{n, seq})
+		seq += 1
 	}
 
 	if pq.Len() != 1 {
-		return nil, errors.New("Failed to make tree")
+		return nil, ErrNoSymbols
+	}
+	root := heap.Pop(&pq).(nodeQueueItem).node
+	if root.IsLeaf() {
+		// Only one symbol. Give it a 1 bit pattern instead of an empty one so
+		// that it can still be written and read back from a stream.
+		leaf := root
+		root = &Node{0x00, leaf.freq, nil, leaf, nil}
+		leaf.parent = root
 	}
-	root := pq.Pop().(*Node)
 	return root, nil
 }
 
 // Construct a map from 'symbol' -> byte sequence given the set of
 // leaf nodes. This should be called from the result of 'createTreeReturnLeafs'
-func buildPatternDict(root *Node) (map[byte]ByteSeq, error) {
+func buildPatternDict(root *Node) (map[Symbol]ByteSeq, error) {
 	leafNodes := make([]*Node, 0)
 	root.InOrderTraversal(func(n *Node) {
 		if n.IsLeaf() {
@@ -165,7 +211,7 @@ func buildPatternDict(root *Node) (map[byte]ByteSeq, error) {
 		}
 	})
 
-	dict := make(map[byte]ByteSeq)
+	dict := make(map[Symbol]ByteSeq)
 	for i := 0; i < len(leafNodes); i++ {
 
 		// traverse to root
@@ -179,12 +225,16 @@ func buildPatternDict(root *Node) (map[byte]ByteSeq, error) {
 			}
 
 			// add a bit depending on the if we are the left or right child
+			var err error
 			if p.left == n {
-				byteSeq.AddBit(0)
+				err = byteSeq.AddBit(0)
 			} else if p.right == n {
-				byteSeq.AddBit(1)
+				err = byteSeq.AddBit(1)
 			} else {
-				return nil, errors.New("current node is not a child of its parent")
+				return nil, fmt.Errorf("%w, node is not a child of its parent", ErrInvalidModel)
+			}
+			if err != nil {
+				return nil, err
 			}
 
 			// keep going up
@@ -199,14 +249,21 @@ func buildPatternDict(root *Node) (map[byte]ByteSeq, error) {
 
 // Given a codebook mapping symbol -> length of byte pattern
 // Create a canonical encoding of the codebook
-func canonicalCodebook(codebook map[byte]ByteSeq) (map[byte]ByteSeq, error) {
+func canonicalCodebook(codebook map[Symbol]ByteSeq) (map[Symbol]ByteSeq, error) {
 	ps := make(symbolByteSeqPairLenNameSort, 0)
 	for k, v := range codebook {
 		ps = append(ps, symbolByteSeqPair{k, v})
 	}
 	sort.Stable(ps)
+	return sequentialCodebook(ps), nil
+}
 
-	newCodeBook := make(map[byte]ByteSeq)
+// Give the symbols consecutive patterns in the order they are listed, moving
+// to a longer pattern whenever the length goes up. The pairs must be sorted
+// by length. With the symbols of each length in symbol order this is the
+// canonical code.
+func sequentialCodebook(ps []symbolByteSeqPair) map[Symbol]ByteSeq {
+	newCodeBook := make(map[Symbol]ByteSeq)
 	patLen := uint(0)
 	pat := uint64(0)
 	for i := 0; i < len(ps); i++ {
@@ -221,11 +278,10 @@ func canonicalCodebook(codebook map[byte]ByteSeq) (map[byte]ByteSeq, error) {
 			}
 		}
 	}
-
-	return newCodeBook, nil
+	return newCodeBook
 }
 
-func canonicalHuffmanTree(codebook map[byte]ByteSeq) (*Node, error) {
+func canonicalHuffmanTree(codebook map[Symbol]ByteSeq) (*Node, error) {
 	ps := make(symbolByteSeqPairLenNameSort, 0)
 	for k, v := range codebook {
 		ps = append(ps, symbolByteSeqPair{k, v})
@@ -252,9 +308,108 @@ func canonicalHuffmanTree(codebook map[byte]ByteSeq) (*Node, error) {
 			// is at root node
 			if j == 0 {
 				n.symbol = ps[i].symbol
-				n.freq = 0.0
+				n.freq = 0
 			}
 		}
 	}
 	return root, nil
 }
+
+// Find the length of the pattern for each symbol in the tree, which is just
+// the depth of each leaf. Unlike buildPatternDict this does not need the
+// patterns to fit inside a ByteSeq.
+func treeCodeLengths(root *Node) map[Symbol]uint {
+	lengths := make(map[Symbol]uint)
+	root.InOrderTraversalDepth(func(n *Node, depth int) {
+		if n.IsLeaf() {
+			lengths[n.symbol] = uint(depth)
+		}
+	}, 0)
+	return lengths
+}
+
+// An item in the package-merge lists. Either a single symbol (a leaf) or a
+// package made from two items of the previous list.
+type packageMergeItem struct {
+	weight uint64
+	symbol int
+	left   *packageMergeItem
+	right  *packageMergeItem
+}
+
+// Count the number of times each symbol appears within the item.
+func (this *packageMergeItem) countSymbols(counts []uint) {
+	if this.left == nil {
+		counts[this.symbol] += 1
+		return
+	}
+	this.left.countSymbols(counts)
+	this.right.countSymbols(counts)
+}
+
+// Find the pattern lengths of the minimum-redundancy prefix code for the
+// weights where no pattern is longer than maxLen bits. Uses the package-merge
+// algorithm (Larmore and Hirschberg). The returned lengths are in the same
+// order as the weights. Ties are broken as described in spec.txt, by the
+// position of the weight and by taking leaves before packages.
+func limitedCodeLengths(weights []uint64, maxLen uint) ([]uint, error) {
+	n := len(weights)
+	if n == 0 {
+		return nil, ErrNoSymbols
+	}
+	if maxLen == 0 || (maxLen < 64 && uint64(n) > 1<<maxLen) {
+		return nil, fmt.Errorf("Can not fit %d symbols in patterns of at most %d bits",
+			n, maxLen)
+	}
+	if n == 1 {
+		return []uint{1}, nil
+	}
+	total := uint64(0)
+	for _, w := range weights {
+		if w > math.MaxUint64/uint64(maxLen)-total {
+			return nil, errors.New("Sum of the symbol counts is too large for package-merge")
+		}
+		total += w
+	}
+
+	// The leaves sorted by weight, ties are broken by the symbol's position
+	leaves := make([]*packageMergeItem, n)
+	for i := 0; i < n; i++ {
+		leaves[i] = &packageMergeItem{weights[i], i, nil, nil}
+	}
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return leaves[i].weight < leaves[j].weight
+	})
+
+	// Each round packages up pairs of the previous list and merges the
+	// packages back in with the leaves. After maxLen-1 rounds the cheapest
+	// 2n-2 items of the list make up the code.
+	list := leaves
+	for level := uint(1); level < maxLen; level++ {
+		packages := make([]*packageMergeItem, 0, len(list)/2)
+		for i := 0; i+1 < len(list); i += 2 {
+			packages = append(packages, &packageMergeItem{
+				list[i].weight + list[i+1].weight, -1, list[i], list[i+1]})
+		}
+
+		merged := make([]*packageMergeItem, 0, len(leaves)+len(packages))
+		i, j := 0, 0
+		for i < len(leaves) || j < len(packages) {
+			if j >= len(packages) ||
+				(i < len(leaves) && leaves[i].weight <= packages[j].weight) {
+				merged = append(merged, leaves[i])
+				i++
+			} else {
+				merged = append(merged, packages[j])
+				j++
+			}
+		}
+		list = merged
+	}
+
+	lengths := make([]uint, n)
+	for _, item := range list[:2*n-2] {
+		item.countSymbols(lengths)
+	}
+	return lengths, nil
+}
@@ -68,39 +68,40 @@ func TestCodebook_TestNodeIsLeaf(t *testing.T) {
 }
 
 func TestCodebook_TestHeap(t *testing.T) {
-	n := make(NodePQ, 0)
+	n := make(nodeQueue, 0)
 	heap.Init(&n)
-	a := &Node{byte('a'), 2, nil, nil, nil}
-	b := &Node{byte('b'), 6, nil, nil, nil}
-	c := &Node{byte('c'), 7, nil, nil, nil}
-	d := &Node{byte('d'), 10, nil, nil, nil}
-	e := &Node{byte('e'), 10, nil, nil, nil}
-	f := &Node{byte('f'), 11, nil, nil, nil}
-
-	heap.Push(&n, d)
-	heap.Push(&n, c)
-	heap.Push(&n, a)
-	heap.Push(&n, f)
-	heap.Push(&n, e)
-	heap.Push(&n, b)
-
-	want := []byte("abcdef")
+	a := &Node{Symbol('a'), 2, nil, nil, nil}
+	b := &Node{Symbol('b'), 6, nil, nil, nil}
+	c := &Node{Symbol('c'), 7, nil, nil, nil}
+	d := &Node{Symbol('d'), 10, nil, nil, nil}
+	e := &Node{Symbol('e'), 10, nil, nil, nil}
+	f := &Node{Symbol('f'), 11, nil, nil, nil}
+
+	// Equal weights come out in seq order, not symbol order
+	heap.Push(&n, nodeQueueItem{e, 0})
+	heap.Push(&n, nodeQueueItem{c, 1})
+	heap.Push(&n, nodeQueueItem{a, 2})
+	heap.Push(&n, nodeQueueItem{f, 3})
+	heap.Push(&n, nodeQueueItem{d, 4})
+	heap.Push(&n, nodeQueueItem{b, 5})
+
+	want := []byte("abcedf")
 	got := make([]byte, 0)
 
 	for n.Len() > 0 {
-		got = append(got, heap.Pop(&n).(*Node).symbol)
+		got = append(got, byte(heap.Pop(&n).(nodeQueueItem).node.symbol))
 	}
 	if bytes.Compare(want, got) != 0 {
-		t.Errorf("Priority queue failed")
+		t.Errorf("Priority queue failed, got %s want %s", got, want)
 	}
 }
 
 func TestCodebook_BuildHuffmanTree(t *testing.T) {
 	d := map[byte]*Freq{
-		0x00: &Freq{0, 0, 0.4},
-		0x01: &Freq{0, 0, 0.35},
-		0x02: &Freq{0, 0, 0.2},
-		0x03: &Freq{0, 0, 0.05},
+		0x00: &Freq{40, 100, 0.4},
+		0x01: &Freq{35, 100, 0.35},
+		0x02: &Freq{20, 100, 0.2},
+		0x03: &Freq{5, 100, 0.05},
 	}
 	root, err := buildHuffmanTree(d)
 	if err != nil {
@@ -116,7 +117,7 @@ func TestCodebook_BuildHuffmanTree(t *testing.T) {
 		t.Error(err)
 	}
 
-	wantDict := map[byte]ByteSeq{
+	wantDict := map[Symbol]ByteSeq{
 		0x00: ByteSeq{0x00, 1},
 		0x01: ByteSeq{0x02, 2},
 		0x02: ByteSeq{0x06, 3},
@@ -146,7 +147,7 @@ func TestCodebook_BuildTreeAndFreqDict(t *testing.T) {
 		t.Error(err)
 	}
 
-	wantDict := map[byte]ByteSeq{
+	wantDict := map[Symbol]ByteSeq{
 		'_': ByteSeq{0x02, 2},
 		'D': ByteSeq{0x01, 2},
 		'A': ByteSeq{0x00, 2},
@@ -162,21 +163,21 @@ func TestCodebook_BuildTreeAndFreqDict(t *testing.T) {
 }
 
 func TestCodebook_canonicalCodebook(t *testing.T) {
-	codebook := map[byte]ByteSeq{
-		byte('a'): ByteSeq{0x03, 2},
-		byte('b'): ByteSeq{0x00, 1},
-		byte('c'): ByteSeq{0x05, 3},
-		byte('d'): ByteSeq{0x04, 3},
+	codebook := map[Symbol]ByteSeq{
+		Symbol('a'): ByteSeq{0x03, 2},
+		Symbol('b'): ByteSeq{0x00, 1},
+		Symbol('c'): ByteSeq{0x05, 3},
+		Symbol('d'): ByteSeq{0x04, 3},
 	}
 	newbook, err := canonicalCodebook(codebook)
 	if err != nil {
 		t.Errorf("Failed to create canonical codebook: %v", err)
 	}
-	wantbook := map[byte]ByteSeq{
-		byte('b'): ByteSeq{0x00, 1},
-		byte('a'): ByteSeq{0x02, 2},
-		byte('c'): ByteSeq{0x06, 3},
-		byte('d'): ByteSeq{0x07, 3},
+	wantbook := map[Symbol]ByteSeq{
+		Symbol('b'): ByteSeq{0x00, 1},
+		Symbol('a'): ByteSeq{0x02, 2},
+		Symbol('c'): ByteSeq{0x06, 3},
+		Symbol('d'): ByteSeq{0x07, 3},
 	}
 
 	for k, v := range wantbook {
@@ -187,10 +188,10 @@ func TestCodebook_canonicalCodebook(t *testing.T) {
 }
 
 func TestCodebook_SimpleCanonicalHuffmanTreeSimple(t *testing.T) {
-	codebook := map[byte]ByteSeq{
-		byte('a'): ByteSeq{0x00, 1},
-		byte('b'): ByteSeq{0x02, 2},
-		byte('c'): ByteSeq{0x03, 2},
+	codebook := map[Symbol]ByteSeq{
+		Symbol('a'): ByteSeq{0x00, 1},
+		Symbol('b'): ByteSeq{0x02, 2},
+		Symbol('c'): ByteSeq{0x03, 2},
 	}
 	newbook, err := canonicalCodebook(codebook)
 	if err != nil {
@@ -216,10 +217,10 @@ for symbol %c. got %v , want %v`, k, v, newbook[k])
 }
 
 func TestCodebook_SimpleCanonicalHuffmanTree(t *testing.T) {
-	codebook := map[byte]ByteSeq{
-		byte('a'): ByteSeq{0x00, 1},
-		byte('b'): ByteSeq{0x02, 2},
-		byte('c'): ByteSeq{0x03, 2},
+	codebook := map[Symbol]ByteSeq{
+		Symbol('a'): ByteSeq{0x00, 1},
+		Symbol('b'): ByteSeq{0x02, 2},
+		Symbol('c'): ByteSeq{0x03, 2},
 	}
 	newbook, err := canonicalCodebook(codebook)
 	if err != nil {
@@ -243,3 +244,116 @@ for symbol %c. got %v , want %v`, k, v, newbook[k])
 		}
 	}
 }
+
+// Fibonacci weights give the most skewed huffman tree possible
+func fibonacciWeights(n int) []uint64 {
+	weights := make([]uint64, n)
+	a, b := uint64(1), uint64(1)
+	for i := 0; i < n; i++ {
+		weights[i] = a
+		a, b = b, a+b
+	}
+	return weights
+}
+
+func codeCost(weights []uint64, lengths []uint) uint64 {
+	cost := uint64(0)
+	for i := range weights {
+		cost += weights[i] * uint64(lengths[i])
+	}
+	return cost
+}
+
+func TestCodebook_LimitedCodeLengths(t *testing.T) {
+	weights := fibonacciWeights(20)
+	for _, maxLen := range []uint{5, 8, 15} {
+		lengths, err := limitedCodeLengths(weights, maxLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Must be a complete prefix code within the limit
+		kraft := 0.0
+		for i, l := range lengths {
+			if l == 0 || l > maxLen {
+				t.Errorf("Symbol %d has length %d with a limit of %d", i, l, maxLen)
+			}
+			kraft += 1.0 / float64(uint64(1)<<l)
+		}
+		if kraft != 1.0 {
+			t.Errorf("Lengths do not form a complete prefix code, kraft sum %v", kraft)
+		}
+	}
+
+	// With a limit larger than the huffman tree it must be just as good
+	dict := make(map[byte]*Freq)
+	for i, w := range weights {
+		dict[byte(i)] = &Freq{w, 0, float64(w)}
+	}
+	root, err := buildHuffmanTree(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeLengths := treeCodeLengths(root)
+	huffmanLengths := make([]uint, len(weights))
+	for i := range weights {
+		huffmanLengths[i] = treeLengths[Symbol(i)]
+	}
+	lengths, err := limitedCodeLengths(weights, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeCost(weights, lengths) != codeCost(weights, huffmanLengths) {
+		t.Errorf("Package merge cost %d does not match the huffman cost %d",
+			codeCost(weights, lengths), codeCost(weights, huffmanLengths))
+	}
+}
+
+func TestCodebook_LimitedCodeLengthsErrors(t *testing.T) {
+	if _, err := limitedCodeLengths([]uint64{}, 4); err == nil {
+		t.Errorf("Expected an error without any symbols")
+	}
+	if _, err := limitedCodeLengths([]uint64{1, 2, 3, 4, 5}, 2); err == nil {
+		t.Errorf("Expected an error when the symbols can't fit in the limit")
+	}
+	lengths, err := limitedCodeLengths([]uint64{7}, 4)
+	if err != nil || lengths[0] != 1 {
+		t.Errorf("A single symbol should have a length of 1, got %v, %v", lengths, err)
+	}
+}
+
+func TestCodebook_DeterministicTies(t *testing.T) {
+	// The example from spec.txt
+	dict := make(map[byte]*Freq)
+	for _, symbol := range []byte("abcde") {
+		dict[symbol] = &Freq{1, 5, 0.2}
+	}
+	want := map[Symbol]uint{'a': 3, 'b': 3, 'c': 2, 'd': 2, 'e': 2}
+
+	// Maps are iterated in a random order, so build it several times
+	for i := 0; i < 20; i++ {
+		root, err := buildHuffmanTree(dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := treeCodeLengths(root)
+		for symbol, l := range want {
+			if got[symbol] != l {
+				t.Fatalf("Length of %c = %d, want %d", symbol, got[symbol], l)
+			}
+		}
+	}
+}
+
+func TestCodebook_CountOverflow(t *testing.T) {
+	dict := map[byte]*Freq{
+		'a': &Freq{1 << 63, 0, 0},
+		'b': &Freq{1 << 63, 0, 0},
+	}
+	if _, err := buildHuffmanTree(dict); err == nil {
+		t.Errorf("Expected an error when the counts overflow")
+	}
+	if _, err := limitedCodeLengths([]uint64{1 << 62, 1 << 62, 1}, 2); err == nil {
+		t.Errorf("Expected an error when the package weights overflow")
+	}
+}
@@ -0,0 +1,53 @@
+package huffman
+
+import (
+	"io"
+)
+
+// Coder is an entropy coder, a model built from the symbol counts of
+// BuildFrequencyDict which writes symbols as bits and reads them back. Model
+// is the huffman Coder and RANSModel the rANS one, so code which only needs
+// to encode and decode payloads can use either.
+type Coder interface {
+	// Rebuild the model from the symbol counts
+	Reset(freqDict map[byte]*Freq) error
+	// Write out the model's parameters for every symbol of the alphabet, in
+	// the order of the alphabet.
+	MarshalAlphabet(alphabet []byte) ([]byte, error)
+	// Rebuild the model from the output of MarshalAlphabet
+	UnmarshalBinary(alphabet []byte, p []byte) error
+	// Write symbols to w. Close must be called to write out the last bits.
+	NewSymbolWriter(w io.Writer) (io.WriteCloser, error)
+	// Read symbols from r. Nothing past the last symbol read is consumed, so
+	// the caller must know how many symbols were written.
+	NewSymbolReader(r io.Reader) (SymbolReader, error)
+}
+
+// A reader of symbols which can be moved to a new stream with the same model
+// without rebuilding its tables. Read fills all of p unless there is an error.
+type SymbolReader interface {
+	io.Reader
+	Reset(r io.Reader)
+	// Check that the stream ends cleanly after the last symbol read, e.g.
+	// that the padding bits of the last byte are 0. Call it once all of the
+	// symbols have been read.
+	Finish() error
+}
+
+// Encode symbols with a Writer
+func (this *Model) NewSymbolWriter(w io.Writer) (io.WriteCloser, error) {
+	hw, err := NewWriter(w, this)
+	if err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+// Decode symbols with a TableReader
+func (this *Model) NewSymbolReader(r io.Reader) (SymbolReader, error) {
+	hr, err := NewTableReader(r, this)
+	if err != nil {
+		return nil, err
+	}
+	return hr, nil
+}
@@ -0,0 +1,182 @@
+package huffman
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// How the symbols of a compact model are listed, the high nibble of the
+	// first byte
+	kCOMPACT_BITMAP = 0
+	kCOMPACT_RANGES = 1
+	// Lengths are written as length-1, so 6 bits fit the longest pattern
+	kCOMPACT_MAX_WIDTH = 6
+)
+
+// Write out the pattern lengths of the model in far fewer bytes than
+// MarshalAlphabet when only some of the alphabet is used. The first byte
+// holds how the symbols are listed in its high nibble and the number of bits
+// W of each length in its low nibble. Then the symbols in the model are
+// listed, by index into the alphabet, as whichever is smaller of
+//   - a bitmap of len(alphabet)/8 bytes, bit i%8 of byte i/8 for index i
+//   - a count of ranges followed by the first index and length-1 of each
+//     range, one byte each
+//
+// followed by the length-1 of each listed symbol in W bits, most significant
+// bit first, padded with 0 bits to a byte. The inverse of ReadCompact.
+func (this *Model) MarshalCompact(alphabet []byte) ([]byte, error) {
+	lengths, err := this.MarshalAlphabet(alphabet)
+	if err != nil {
+		return nil, err
+	}
+	if len(alphabet)%8 != 0 || len(alphabet) > kDEFAULT_ALPHABET_LEN {
+		return nil, fmt.Errorf("Alphabet of %d symbols can not be written compactly", len(alphabet))
+	}
+
+	maxLen := uint8(0)
+	bitmap := make([]byte, len(alphabet)/8)
+	ranges := make([]byte, 0)
+	for i, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		if l > maxLen {
+			maxLen = l
+		}
+		bitmap[i/8] |= 1 << uint(i%8)
+		if i > 0 && lengths[i-1] > 0 {
+			ranges[len(ranges)-1] += 1
+		} else {
+			ranges = append(ranges, byte(i), 0)
+		}
+	}
+	if maxLen == 0 {
+		return nil, ErrNoSymbols
+	}
+	width := uint(bits.Len8(maxLen - 1))
+	if width == 0 {
+		width = 1
+	}
+
+	var p []byte
+	if 1+len(ranges) < len(bitmap) {
+		p = append([]byte{kCOMPACT_RANGES<<4 | byte(width), byte(len(ranges) / 2)}, ranges...)
+	} else {
+		p = append([]byte{kCOMPACT_BITMAP<<4 | byte(width)}, bitmap...)
+	}
+
+	acc := uint64(0)
+	nbits := uint(0)
+	for _, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		acc = acc<<width | uint64(l-1)
+		nbits += width
+		for nbits >= 8 {
+			p = append(p, byte(acc>>(nbits-8)))
+			nbits -= 8
+		}
+	}
+	if nbits > 0 {
+		p = append(p, byte(acc<<(8-nbits)))
+	}
+	return p, nil
+}
+
+// Rebuild the model from the compact lengths written by MarshalCompact.
+// Exactly the bytes of the compact model are read from r.
+func (this *Model) ReadCompact(alphabet []byte, r io.Reader) error {
+	lengths, err := ReadCompactLengths(alphabet, r)
+	if err != nil {
+		return err
+	}
+	return this.UnmarshalBinary(alphabet, lengths)
+}
+
+// Read the compact lengths written by MarshalCompact and expand them to the
+// lengths MarshalAlphabet would have written, without building the model.
+func ReadCompactLengths(alphabet []byte, r io.Reader) ([]byte, error) {
+	if len(alphabet)%8 != 0 || len(alphabet) > kDEFAULT_ALPHABET_LEN {
+		return nil, fmt.Errorf("Alphabet of %d symbols can not be read compactly", len(alphabet))
+	}
+	var mode [1]byte
+	_, err := io.ReadFull(r, mode[:])
+	if err != nil {
+		return nil, err
+	}
+	width := uint(mode[0] & 0x0f)
+	if width == 0 || width > kCOMPACT_MAX_WIDTH {
+		return nil, fmt.Errorf("%w, compact lengths of %d bits", ErrInvalidModel, width)
+	}
+
+	present := make([]bool, len(alphabet))
+	switch mode[0] >> 4 {
+	case kCOMPACT_BITMAP:
+		bitmap := make([]byte, len(alphabet)/8)
+		_, err = io.ReadFull(r, bitmap)
+		if err != nil {
+			return nil, err
+		}
+		for i := range present {
+			present[i] = bitmap[i/8]&(1<<uint(i%8)) > 0
+		}
+	case kCOMPACT_RANGES:
+		var count [1]byte
+		_, err = io.ReadFull(r, count[:])
+		if err != nil {
+			return nil, err
+		}
+		ranges := make([]byte, 2*int(count[0]))
+		_, err = io.ReadFull(r, ranges)
+		if err != nil {
+			return nil, err
+		}
+		next := 0
+		for i := 0; i < len(ranges); i += 2 {
+			start, end := int(ranges[i]), int(ranges[i])+int(ranges[i+1])
+			if start < next || end >= len(alphabet) {
+				return nil, fmt.Errorf("%w, compact range %d to %d is out of order or past the alphabet",
+					ErrInvalidModel, start, end)
+			}
+			for j := start; j <= end; j++ {
+				present[j] = true
+			}
+			next = end + 1
+		}
+	default:
+		return nil, fmt.Errorf("%w, unknown compact symbol list %d", ErrInvalidModel, mode[0]>>4)
+	}
+
+	n := 0
+	for _, ok := range present {
+		if ok {
+			n += 1
+		}
+	}
+	if n == 0 {
+		return nil, ErrNoSymbols
+	}
+	packed := make([]byte, (uint(n)*width+7)/8)
+	_, err = io.ReadFull(r, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	lengths := make([]byte, len(alphabet))
+	bit := uint(0)
+	for i, ok := range present {
+		if !ok {
+			continue
+		}
+		v := byte(0)
+		for j := uint(0); j < width; j++ {
+			v = v<<1 | packed[bit/8]>>(7-bit%8)&1
+			bit += 1
+		}
+		lengths[i] = v + 1
+	}
+	return lengths, nil
+}
@@ -0,0 +1,119 @@
+package huffman
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompact_RoundTrip(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, src := range [][]byte{
+		[]byte(loremText), []byte("a"), []byte("abcdefghijklmnopqrstuvwxyz"), all,
+		[]byte("\x00\x02\x04\x06\x08\x0a\x0c\x0e\x10\x12\x14\x16\x18\x1a\x1c\x1e\x20"),
+	} {
+		m, err := CreateModelFromText(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := m.MarshalCompact(DefaultAlphabet())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Followed by another byte to check only the model is read
+		r := bytes.NewReader(append(p, 0xaa))
+		other := &Model{}
+		err = other.ReadCompact(DefaultAlphabet(), r)
+		if err != nil {
+			t.Fatalf("Failed to read %d byte compact model: %v", len(p), err)
+		}
+		if r.Len() != 1 {
+			t.Errorf("Read %d bytes of a %d byte compact model", len(p)+1-r.Len(), len(p))
+		}
+		want, _ := m.MarshalAlphabet(DefaultAlphabet())
+		got, _ := other.MarshalAlphabet(DefaultAlphabet())
+		if bytes.Compare(want, got) != 0 {
+			t.Errorf("Compact model does not round trip for %d symbols", len(m.patternDict))
+		}
+	}
+}
+
+func TestCompact_Size(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want int
+	}{
+		// One range and 1 bit lengths
+		{"a", 1 + 1 + 2 + 1},
+		// 26 lengths of 4 or 5 bits in 3 bits each, one range
+		{"abcdefghijklmnopqrstuvwxyzaaaa", 1 + 1 + 2 + 10},
+	} {
+		m, err := CreateModelFromText([]byte(tc.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := m.MarshalCompact(DefaultAlphabet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != tc.want {
+			t.Errorf("Compact model of %q is %d bytes, want %d", tc.src, len(p), tc.want)
+		}
+	}
+
+	// Every other byte takes too many ranges, so the bitmap is used
+	scattered := make([]byte, 0)
+	for i := 0; i < 256; i += 2 {
+		scattered = append(scattered, byte(i))
+	}
+	m, err := CreateModelFromText(scattered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.MarshalCompact(DefaultAlphabet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 128 lengths of 7, written as 6 in 3 bits each
+	if p[0] != kCOMPACT_BITMAP<<4|3 || len(p) != 1+32+48 {
+		t.Errorf("Compact model of every other byte is %d bytes with mode %#x", len(p), p[0])
+	}
+}
+
+func TestCompact_Errors(t *testing.T) {
+	m, err := CreateModelFromText([]byte(loremText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.MarshalCompact(DefaultAlphabet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(p); n++ {
+		if err := (&Model{}).ReadCompact(DefaultAlphabet(), bytes.NewReader(p[:n])); err == nil {
+			t.Errorf("Expected an error reading %d of %d bytes", n, len(p))
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		p    []byte
+	}{
+		{"width 0", []byte{0x10, 1, 'a', 0, 0}},
+		{"width 7", []byte{0x17, 1, 'a', 0, 0}},
+		{"unknown symbol list", []byte{0x21, 1, 'a', 0, 0}},
+		{"overlapping ranges", []byte{0x11, 2, 'a', 1, 'b', 0, 0}},
+		{"range past the alphabet", []byte{0x11, 1, 0xff, 1, 0}},
+		{"no symbols", []byte{0x11, 0}},
+	} {
+		if err := (&Model{}).ReadCompact(DefaultAlphabet(), bytes.NewReader(tc.p)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+	if _, err := m.MarshalCompact(make([]byte, 10)); err == nil {
+		t.Errorf("Expected an error for an alphabet which is not a multiple of 8")
+	}
+}
@@ -0,0 +1,296 @@
+package huffman
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// The bitmap of which contexts, or which symbols of a context, are in a
+	// serialized ContextModel
+	kCONTEXT_BITMAP_LEN = kDEFAULT_ALPHABET_LEN / 8
+)
+
+// ContextModel is an order-1 context model. It keeps a separate canonical
+// code for each previous symbol, so a symbol is coded with the code of the
+// symbol before it. The first symbol of a payload uses the context of 0.
+// Contexts which never occur have no code.
+type ContextModel struct {
+	models [kDEFAULT_ALPHABET_LEN]*Model
+}
+
+// Count each symbol of the src under the symbol which came before it. The
+// first symbol is counted under 0.
+func BuildContextFrequencyDict(src []byte) map[byte]map[byte]*Freq {
+	counts := make(map[byte][]byte)
+	prev := byte(0)
+	for _, b := range src {
+		counts[prev] = append(counts[prev], b)
+		prev = b
+	}
+
+	dict := make(map[byte]map[byte]*Freq)
+	for context, symbols := range counts {
+		dict[context] = BuildFrequencyDict(symbols)
+	}
+	return dict
+}
+
+func CreateContextModelFromText(src []byte) (*ContextModel, error) {
+	m := &ContextModel{}
+	err := m.Reset(BuildContextFrequencyDict(src))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Rebuild the code of every context from the counts of the symbols which
+// follow it. Contexts missing from the dict are left without a code.
+func (this *ContextModel) Reset(contextDict map[byte]map[byte]*Freq) error {
+	if len(contextDict) == 0 {
+		return ErrNoSymbols
+	}
+	var models [kDEFAULT_ALPHABET_LEN]*Model
+	for context, freqDict := range contextDict {
+		m := &Model{}
+		err := m.Reset(freqDict)
+		if err != nil {
+			return fmt.Errorf("Failed to build context %#x: %w", context, err)
+		}
+		models[context] = m
+	}
+	this.models = models
+	return nil
+}
+
+// The model used for symbols which follow the previous symbol, nil if the
+// context never occurs.
+func (this *ContextModel) Context(prev byte) *Model {
+	return this.models[prev]
+}
+
+// Write out the code lengths of the contexts which occur. The model starts
+// with a 32 byte bitmap of the contexts (bit i%8 of byte i/8 for context i).
+// Each context in the bitmap follows in order as
+//  1. The number of symbols in the context minus 1
+//  2. The symbols, one byte each if there are less than 32 of them,
+//     otherwise a 32 byte bitmap of them
+//  3. The pattern length of each symbol, one byte each, in symbol order
+func (this *ContextModel) MarshalBinary() ([]byte, error) {
+	p := make([]byte, kCONTEXT_BITMAP_LEN)
+	for context, m := range this.models {
+		if m != nil {
+			p[context/8] |= 1 << uint(context%8)
+		}
+	}
+
+	for context, m := range this.models {
+		if m == nil {
+			continue
+		}
+		lengths, err := m.MarshalAlphabet(DefaultAlphabet())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write context %#x: %w", context, err)
+		}
+		symbols := make([]byte, 0)
+		bitmap := make([]byte, kCONTEXT_BITMAP_LEN)
+		for symbol, l := range lengths {
+			if l > 0 {
+				symbols = append(symbols, byte(symbol))
+				bitmap[symbol/8] |= 1 << uint(symbol%8)
+			}
+		}
+
+		p = append(p, byte(len(symbols)-1))
+		if len(symbols) < kCONTEXT_BITMAP_LEN {
+			p = append(p, symbols...)
+		} else {
+			p = append(p, bitmap...)
+		}
+		for _, symbol := range symbols {
+			p = append(p, lengths[symbol])
+		}
+	}
+	return p, nil
+}
+
+// Rebuild the model written by MarshalBinary.
+func (this *ContextModel) UnmarshalBinary(p []byte) error {
+	if len(p) < kCONTEXT_BITMAP_LEN {
+		return fmt.Errorf("%w, context model is too short for the bitmap of contexts", ErrInvalidModel)
+	}
+	contexts := p[:kCONTEXT_BITMAP_LEN]
+	p = p[kCONTEXT_BITMAP_LEN:]
+
+	var models [kDEFAULT_ALPHABET_LEN]*Model
+	numContexts := 0
+	for context := 0; context < kDEFAULT_ALPHABET_LEN; context++ {
+		if contexts[context/8]&(1<<uint(context%8)) == 0 {
+			continue
+		}
+		numContexts += 1
+		if len(p) < 1 {
+			return fmt.Errorf("%w, context model is truncated at context %#x", ErrInvalidModel, context)
+		}
+		n := int(p[0]) + 1
+		p = p[1:]
+
+		symbols := make([]byte, 0, n)
+		if n < kCONTEXT_BITMAP_LEN {
+			if len(p) < n {
+				return fmt.Errorf("%w, context model is truncated at context %#x", ErrInvalidModel, context)
+			}
+			symbols = append(symbols, p[:n]...)
+			p = p[n:]
+		} else {
+			if len(p) < kCONTEXT_BITMAP_LEN {
+				return fmt.Errorf("%w, context model is truncated at context %#x", ErrInvalidModel, context)
+			}
+			for symbol := 0; symbol < kDEFAULT_ALPHABET_LEN; symbol++ {
+				if p[symbol/8]&(1<<uint(symbol%8)) > 0 {
+					symbols = append(symbols, byte(symbol))
+				}
+			}
+			p = p[kCONTEXT_BITMAP_LEN:]
+			if len(symbols) != n {
+				return fmt.Errorf("%w, context %#x has %d symbols in its bitmap, expected %d",
+					ErrInvalidModel, context, len(symbols), n)
+			}
+		}
+		if len(p) < n {
+			return fmt.Errorf("%w, context model is truncated at context %#x", ErrInvalidModel, context)
+		}
+
+		lengths := make([]byte, kDEFAULT_ALPHABET_LEN)
+		for i, symbol := range symbols {
+			if lengths[symbol] != 0 {
+				return fmt.Errorf("%w, context %#x has symbol %#x more than once", ErrInvalidModel, context, symbol)
+			}
+			if p[i] == 0 {
+				return fmt.Errorf("%w, context %#x has a length of 0 for symbol %#x", ErrInvalidModel, context, symbol)
+			}
+			lengths[symbol] = p[i]
+		}
+		p = p[n:]
+
+		m := &Model{}
+		err := m.UnmarshalBinary(DefaultAlphabet(), lengths)
+		if err != nil {
+			return fmt.Errorf("Invalid context %#x: %w", context, err)
+		}
+		models[context] = m
+	}
+	if numContexts == 0 {
+		return ErrNoSymbols
+	}
+	if len(p) > 0 {
+		return fmt.Errorf("%w, context model has %d bytes left over", ErrInvalidModel, len(p))
+	}
+	this.models = models
+	return nil
+}
+
+// ContextWriter encodes a payload with a ContextModel, each symbol with the
+// code of the symbol before it.
+type ContextWriter struct {
+	w           *ByteSeqWriter
+	m           *ContextModel
+	prev        byte
+	bitsWritten uint64
+	// Number of symbols written, the Index of a SymbolError
+	symbols int64
+}
+
+func NewContextWriter(w io.Writer, m *ContextModel) (*ContextWriter, error) {
+	bw, err := NewByteSeqWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &ContextWriter{bw, m, 0, 0, 0}, nil
+}
+
+func (this *ContextWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		m := this.m.models[this.prev]
+		if m == nil {
+			return i, &SymbolError{Symbol(p[i]), this.symbols,
+				fmt.Errorf("%w, context %#x has no code", ErrSymbolNotInModel, this.prev)}
+		}
+		seq, ok := m.patternDict[Symbol(p[i])]
+		if !ok {
+			return i, &SymbolError{Symbol(p[i]), this.symbols,
+				fmt.Errorf("%w of context %#x", ErrSymbolNotInModel, this.prev)}
+		}
+		bitsWritten, err := this.w.Write(seq)
+		if err != nil {
+			return i, err
+		}
+		this.bitsWritten += uint64(bitsWritten)
+		this.symbols += 1
+		this.prev = p[i]
+	}
+	return len(p), nil
+}
+
+func (this *ContextWriter) Close() error {
+	bitsWritten, err := this.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	this.bitsWritten += uint64(bitsWritten)
+	return nil
+}
+
+func (this *ContextWriter) BitsWritten() uint64 {
+	return this.bitsWritten
+}
+
+// ContextReader decodes a payload written by a ContextWriter. It is a
+// TableReader which switches to the lookup tables of the previous symbol's
+// context before each symbol. As with Reader the caller must know how many
+// symbols to read.
+type ContextReader struct {
+	r      TableReader
+	tables [kDEFAULT_ALPHABET_LEN]*decodeTable
+	prev   byte
+}
+
+func NewContextReader(r io.Reader, m *ContextModel) (*ContextReader, error) {
+	c := &ContextReader{}
+	for context, cm := range m.models {
+		if cm == nil {
+			continue
+		}
+		if cm.tree == nil {
+			return nil, fmt.Errorf("%w, context %#x does not have a huffman tree", ErrInvalidModel, context)
+		}
+		c.tables[context] = buildDecodeTable(cm)
+	}
+	c.Reset(r)
+	return c, nil
+}
+
+// Start reading a new payload with the same model, from the context of 0.
+func (this *ContextReader) Reset(r io.Reader) {
+	this.r.Reset(r)
+	this.prev = 0
+}
+
+func (this *ContextReader) Read(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		t := this.tables[this.prev]
+		if t == nil {
+			return i, this.r.decodeError(this.r.offset(), fmt.Errorf("%w, context %#x has no code", ErrInvalidCode, this.prev))
+		}
+		this.r.t = t
+		b, err := this.r.readByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+		this.prev = p[i]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,181 @@
+package huffman
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func encodeWithContext(t *testing.T, m *ContextModel, src []byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	w, err := NewContextWriter(buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestContextModel_EncodeDecode(t *testing.T) {
+	all := make([]byte, 0)
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i), byte(255-i), byte(i))
+	}
+
+	for _, src := range [][]byte{[]byte(loremText), []byte("a"), []byte("abababab"), all} {
+		m, err := CreateContextModelFromText(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := encodeWithContext(t, m, src)
+
+		// Two payloads back to back to check only the first is read
+		br := bytes.NewReader(append(encoded, encoded...))
+		r, err := NewContextReader(br, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			got := make([]byte, len(src))
+			_, err = io.ReadFull(r, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Compare(src, got) != 0 {
+				t.Errorf("Failed to round trip %d bytes", len(src))
+			}
+			r.Reset(br)
+		}
+	}
+}
+
+func TestContextModel_Smaller(t *testing.T) {
+	src := []byte(loremText)
+	cm, err := CreateContextModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order1 := len(encodeWithContext(t, cm, src))
+	order0 := len(encodeWithCoder(t, m, src))
+	if order1*10 > order0*8 {
+		t.Errorf("Order-1 payload is %d bytes, order-0 is %d", order1, order0)
+	}
+}
+
+func TestContextModel_Marshal(t *testing.T) {
+	all := make([]byte, 0)
+	for i := 0; i < 256; i++ {
+		all = append(all, 'x', byte(i))
+	}
+	for _, src := range [][]byte{[]byte(loremText), []byte("a"), all} {
+		m, err := CreateContextModelFromText(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := &ContextModel{}
+		err = other.UnmarshalBinary(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for context := 0; context < kDEFAULT_ALPHABET_LEN; context++ {
+			want, have := m.Context(byte(context)), other.Context(byte(context))
+			if (want == nil) != (have == nil) {
+				t.Fatalf("Context %#x does not round trip", context)
+			}
+			if want == nil {
+				continue
+			}
+			for symbol, seq := range want.patternDict {
+				if have.patternDict[symbol] != seq {
+					t.Errorf("Context %#x symbol %#x has pattern %v, want %v",
+						context, symbol, have.patternDict[symbol], seq)
+				}
+			}
+		}
+	}
+
+	// 'a' is followed by 'b', and 'b' by 'a'. The contexts of 0, 'a' and 'b'
+	// each take a count, a symbol and a length.
+	m, err := CreateContextModelFromText([]byte("abab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != kCONTEXT_BITMAP_LEN+3*3 {
+		t.Errorf("Model is %d bytes, want %d", len(p), kCONTEXT_BITMAP_LEN+3*3)
+	}
+}
+
+func TestContextModel_Errors(t *testing.T) {
+	m, err := CreateContextModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := NewContextWriter(bytes.NewBuffer([]byte{}), m)
+	// 'c' never follows 'a'
+	if _, err := w.Write([]byte("ac")); err == nil {
+		t.Errorf("Expected an error for a symbol which is not in its context")
+	}
+	// Nothing ever follows 'c'
+	w, _ = NewContextWriter(bytes.NewBuffer([]byte{}), m)
+	if _, err := w.Write([]byte("abca")); err == nil {
+		t.Errorf("Expected an error for a context which is not in the model")
+	}
+	if _, err := CreateContextModelFromText(nil); err == nil {
+		t.Errorf("Expected an error for a model without symbols")
+	}
+
+	m, err = CreateContextModelFromText([]byte(loremText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(p); n++ {
+		if err := (&ContextModel{}).UnmarshalBinary(p[:n]); err == nil {
+			t.Errorf("Expected an error reading %d of %d bytes", n, len(p))
+		}
+	}
+	if err := (&ContextModel{}).UnmarshalBinary(append(p, 0)); err == nil {
+		t.Errorf("Expected an error for trailing bytes")
+	}
+	if err := (&ContextModel{}).UnmarshalBinary(make([]byte, kCONTEXT_BITMAP_LEN)); err == nil {
+		t.Errorf("Expected an error for a model without contexts")
+	}
+	// Context 0 has 'a' twice
+	bad := append(make([]byte, kCONTEXT_BITMAP_LEN), 1, 'a', 'a', 1, 1)
+	bad[0] = 1
+	if err := (&ContextModel{}).UnmarshalBinary(bad); err == nil {
+		t.Errorf("Expected an error for a repeated symbol")
+	}
+
+	encoded := encodeWithContext(t, m, []byte(loremText[:100]))
+	r, err := NewContextReader(bytes.NewReader(encoded[:len(encoded)/2]), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 100)); err == nil {
+		t.Errorf("Expected an error reading a truncated payload")
+	}
+}
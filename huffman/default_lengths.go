@@ -0,0 +1,38 @@
+package huffman
+
+// The pattern lengths of the default models, indexed by symbol.
+//
+// These were built from typicalDefaultText with every symbol of the alphabet
+// added once, before the tree construction rule was pinned down in spec.txt.
+// They are kept as tables so that packets encoded with the default models
+// still decode, and so that other implementations can use the same default
+// models without building any trees.
+var kDEFAULT_MODEL_LENGTHS = [kDEFAULT_ALPHABET_LEN]uint8{
+	17, 17, 16, 16, 16, 16, 16, 16, 16, 16, 9, 16, 16, 16, 16, 16,
+	17, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	3, 17, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 6, 16, 6, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 13, 16, 16, 16, 16,
+	16, 10, 17, 9, 9, 11, 11, 17, 16, 9, 16, 17, 13, 9, 9, 14,
+	9, 11, 16, 9, 16, 10, 9, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 4, 7, 5, 5, 3, 7, 7, 8, 4, 10, 16, 4, 5, 4, 5,
+	6, 7, 4, 4, 4, 4, 6, 16, 9, 16, 16, 16, 16, 16, 16, 17,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 17, 17, 16, 16, 16,
+	16, 16, 16, 17, 16, 17, 16, 17, 17, 16, 17, 17, 17, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 17, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 17, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 17, 16, 16, 16, 16, 16, 16, 16,
+}
+
+var kASCII_MODEL_LENGTHS = [kASCII_ALPHABET_LEN]uint8{
+	17, 17, 17, 17, 16, 16, 17, 17, 16, 16, 9, 16, 16, 16, 16, 16,
+	17, 16, 16, 16, 16, 16, 16, 17, 16, 16, 16, 16, 16, 16, 17, 16,
+	3, 17, 16, 17, 16, 16, 16, 16, 16, 16, 16, 16, 6, 16, 6, 16,
+	16, 17, 17, 16, 16, 16, 16, 16, 16, 16, 17, 13, 16, 16, 16, 16,
+	17, 10, 16, 9, 9, 11, 11, 17, 17, 9, 16, 16, 13, 9, 8, 14,
+	9, 11, 16, 9, 16, 10, 9, 17, 16, 16, 16, 16, 16, 16, 16, 17,
+	17, 4, 7, 5, 5, 3, 7, 7, 8, 4, 10, 16, 4, 5, 4, 5,
+	6, 7, 4, 4, 4, 4, 6, 16, 9, 16, 16, 16, 16, 16, 16, 16,
+}
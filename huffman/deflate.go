@@ -0,0 +1,408 @@
+package huffman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// DEFLATE (RFC 1951) constants used for literal only huffman blocks.
+const (
+	// Longest pattern allowed in the literal/length code
+	kDEFLATE_MAX_CODE_LEN = 15
+	// Longest pattern allowed in the code length code
+	kDEFLATE_MAX_CODE_LEN_LEN = 7
+	// The end of block symbol of the literal/length alphabet
+	kDEFLATE_END_OF_BLOCK = 256
+	// Only the literals and the end of block symbol are ever used
+	kDEFLATE_NUM_LITERALS = 257
+	// Number of symbols in the code length alphabet
+	kDEFLATE_NUM_CODE_LENS = 19
+	// Number of literals buffered before a block is written
+	kDEFLATE_BLOCK_SIZE = 64 * 1024
+)
+
+// The order the code length code lengths are written in (RFC 1951 3.2.7)
+var kDEFLATE_CODE_LEN_ORDER = [kDEFLATE_NUM_CODE_LENS]int{
+	16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// The container the DEFLATE stream is written in.
+type DeflateFormat int
+
+const (
+	// A raw DEFLATE stream, as read by compress/flate
+	DEFLATE_RAW DeflateFormat = iota
+	// RFC 1950 zlib header and Adler-32 trailer, as read by compress/zlib
+	DEFLATE_ZLIB
+	// RFC 1952 gzip header and CRC-32 trailer, as read by compress/gzip
+	DEFLATE_GZIP
+)
+
+// Writes bits least significant bit first, the order DEFLATE packs bits into
+// bytes. Unlike ByteSeqWriter which writes the most significant bit first.
+type lsbBitWriter struct {
+	w     io.Writer
+	bits  uint64
+	nbits uint
+	buf   []byte
+	err   error
+}
+
+func newLSBBitWriter(w io.Writer) *lsbBitWriter {
+	return &lsbBitWriter{w: w, buf: make([]byte, 0, 4096)}
+}
+
+// Write the low n bits of v, n must be at most 32.
+func (this *lsbBitWriter) writeBits(v uint64, n uint) {
+	this.bits |= v << this.nbits
+	this.nbits += n
+	for this.nbits >= 8 {
+		this.buf = append(this.buf, byte(this.bits))
+		this.bits >>= 8
+		this.nbits -= 8
+	}
+	if len(this.buf) >= cap(this.buf)-8 {
+		this.flush()
+	}
+}
+
+// Write a huffman pattern. DEFLATE packs patterns starting from their most
+// significant bit, so the pattern is reversed.
+func (this *lsbBitWriter) writeCode(code uint16, n uint) {
+	reversed := uint64(0)
+	for i := uint(0); i < n; i++ {
+		reversed = reversed<<1 | uint64(code>>i&1)
+	}
+	this.writeBits(reversed, n)
+}
+
+// Pad the last byte with 0 bits.
+func (this *lsbBitWriter) align() {
+	if this.nbits > 0 {
+		this.writeBits(0, 8-this.nbits)
+	}
+}
+
+func (this *lsbBitWriter) flush() error {
+	if this.err == nil && len(this.buf) > 0 {
+		_, this.err = this.w.Write(this.buf)
+	}
+	this.buf = this.buf[:0]
+	return this.err
+}
+
+// Assign the canonical patterns to the lengths (RFC 1951 3.2.2). This is the
+// same canonical code as canonicalCodebook, sorted by (length, symbol).
+func deflateCanonicalCodes(lengths []uint) []uint16 {
+	var count [kMAX_PATTERN_LEN + 1]uint16
+	for _, l := range lengths {
+		count[l] += 1
+	}
+	count[0] = 0
+
+	var next [kMAX_PATTERN_LEN + 1]uint16
+	code := uint16(0)
+	for l := 1; l <= kMAX_PATTERN_LEN; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[symbol] = next[l]
+		next[l] += 1
+	}
+	return codes
+}
+
+// Limit the code to the given length. Returns a length for every index of
+// weights, 0 for the weights which are 0.
+func limitedCodeLengthsSparse(weights []uint64, maxLen uint) ([]uint, error) {
+	used := make([]uint64, 0, len(weights))
+	for _, w := range weights {
+		if w > 0 {
+			used = append(used, w)
+		}
+	}
+	usedLengths, err := limitedCodeLengths(used, maxLen)
+	if err != nil {
+		return nil, err
+	}
+
+	lengths := make([]uint, len(weights))
+	j := 0
+	for i, w := range weights {
+		if w > 0 {
+			lengths[i] = usedLengths[j]
+			j++
+		}
+	}
+	return lengths, nil
+}
+
+// The literal/length code lengths for the model. The patterns of the model
+// become weights, 2^(48-len), so shorter patterns stay shorter, and the end
+// of block symbol is added with the smallest weight. The code is then limited
+// to kDEFLATE_MAX_CODE_LEN bits.
+func deflateLiteralLengths(m *Model) ([]uint, error) {
+	weights := make([]uint64, kDEFLATE_NUM_LITERALS)
+	for symbol, seq := range m.patternDict {
+		if symbol > 0xff {
+			// Only the bytes can be written as literals
+			continue
+		}
+		l := seq.Len
+		if l > 48 {
+			l = 48
+		}
+		weights[symbol] = 1 << (48 - l)
+	}
+	weights[kDEFLATE_END_OF_BLOCK] = 1
+	return limitedCodeLengthsSparse(weights, kDEFLATE_MAX_CODE_LEN)
+}
+
+// A symbol of the code length alphabet with its extra bits.
+type codeLenToken struct {
+	symbol    int
+	extra     uint64
+	extraBits uint
+}
+
+// Run length encode the code lengths with the code length alphabet
+// (RFC 1951 3.2.7). 16 repeats the previous length, 17 and 18 repeat zeros.
+func encodeCodeLengths(lengths []uint) []codeLenToken {
+	tokens := make([]codeLenToken, 0)
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, codeLenToken{18, uint64(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLenToken{17, uint64(run - 3), 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, codeLenToken{int(l), 0, 0})
+			run--
+			for run >= 3 {
+				r := run
+				if r > 6 {
+					r = 6
+				}
+				tokens = append(tokens, codeLenToken{16, uint64(r - 3), 2})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLenToken{int(l), 0, 0})
+		}
+	}
+	return tokens
+}
+
+// DeflateWriter writes a payload as a DEFLATE stream (RFC 1951) which any
+// inflater, such as compress/flate, can read. Every block is a dynamic
+// huffman block which only uses literals, with the code taken from the model
+// and limited to 15 bits. Symbols which are not in the model can not be
+// written.
+type DeflateWriter struct {
+	w      *lsbBitWriter
+	format DeflateFormat
+
+	lengths []uint
+	codes   []uint16
+	// The dynamic block header, the same for every block
+	header []codeLenToken
+	// Code for the code length alphabet
+	lenLengths []uint
+	lenCodes   []uint16
+
+	block       []byte
+	checksum    hash.Hash32
+	size        uint32
+	wroteHeader bool
+	closed      bool
+	// Number of bytes accepted by Write
+	symbols int64
+}
+
+func NewDeflateWriter(w io.Writer, m *Model) (*DeflateWriter, error) {
+	return NewDeflateWriterFormat(w, m, DEFLATE_RAW)
+}
+
+// Create a DeflateWriter which wraps the DEFLATE stream in a zlib or gzip
+// container.
+func NewDeflateWriterFormat(w io.Writer, m *Model, format DeflateFormat) (*DeflateWriter, error) {
+	if m == nil || m.patternDict == nil {
+		return nil, errors.New("DeflateWriter requires a model")
+	}
+	var checksum hash.Hash32
+	switch format {
+	case DEFLATE_RAW:
+	case DEFLATE_ZLIB:
+		checksum = adler32.New()
+	case DEFLATE_GZIP:
+		checksum = crc32.NewIEEE()
+	default:
+		return nil, fmt.Errorf("Unknown DEFLATE format %d", format)
+	}
+
+	lengths, err := deflateLiteralLengths(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// The single distance code has a length of 0, no distances are used
+	header := encodeCodeLengths(append(append([]uint{}, lengths...), 0))
+	lenWeights := make([]uint64, kDEFLATE_NUM_CODE_LENS)
+	for _, t := range header {
+		lenWeights[t.symbol] += 1
+	}
+	lenLengths, err := limitedCodeLengthsSparse(lenWeights, kDEFLATE_MAX_CODE_LEN_LEN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeflateWriter{
+		w:          newLSBBitWriter(w),
+		format:     format,
+		lengths:    lengths,
+		codes:      deflateCanonicalCodes(lengths),
+		header:     header,
+		lenLengths: lenLengths,
+		lenCodes:   deflateCanonicalCodes(lenLengths),
+		block:      make([]byte, 0, kDEFLATE_BLOCK_SIZE),
+		checksum:   checksum,
+	}, nil
+}
+
+func (this *DeflateWriter) Write(p []byte) (int, error) {
+	if this.closed {
+		return 0, errors.New("Write on a closed DeflateWriter")
+	}
+	for i := 0; i < len(p); i++ {
+		if this.lengths[p[i]] == 0 {
+			return i, &SymbolError{Symbol(p[i]), this.symbols, ErrSymbolNotInModel}
+		}
+		this.block = append(this.block, p[i])
+		this.symbols += 1
+		if len(this.block) == cap(this.block) {
+			err := this.writeBlock(false)
+			if err != nil {
+				return i + 1, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Write the last block and the trailer of the container. Does not close the
+// underlying writer.
+func (this *DeflateWriter) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+
+	if len(this.block) > 0 {
+		err := this.writeBlock(true)
+		if err != nil {
+			return err
+		}
+	} else {
+		this.writeContainerHeader()
+		// An empty final stored block: BFINAL, BTYPE 00, LEN 0, NLEN 0xffff
+		this.w.writeBits(1, 1)
+		this.w.writeBits(0, 2)
+		this.w.align()
+		this.w.writeBits(0xffff0000, 32)
+	}
+	this.w.align()
+
+	switch this.format {
+	case DEFLATE_ZLIB:
+		var trailer [4]byte
+		binary.BigEndian.PutUint32(trailer[:], this.checksum.Sum32())
+		this.w.writeBits(uint64(binary.LittleEndian.Uint32(trailer[:])), 32)
+	case DEFLATE_GZIP:
+		this.w.writeBits(uint64(this.checksum.Sum32()), 32)
+		this.w.writeBits(uint64(this.size), 32)
+	}
+	return this.w.flush()
+}
+
+func (this *DeflateWriter) writeContainerHeader() {
+	if this.wroteHeader {
+		return
+	}
+	this.wroteHeader = true
+	switch this.format {
+	case DEFLATE_ZLIB:
+		// CM 8 with a 32K window, FLEVEL 0, no dictionary
+		this.w.writeBits(0x78, 8)
+		this.w.writeBits(0x01, 8)
+	case DEFLATE_GZIP:
+		// Magic, CM 8, no flags, no mtime, no extra flags, unknown OS
+		for _, b := range []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff} {
+			this.w.writeBits(uint64(b), 8)
+		}
+	}
+}
+
+// Write the buffered literals as one dynamic huffman block.
+func (this *DeflateWriter) writeBlock(final bool) error {
+	this.writeContainerHeader()
+	if this.checksum != nil {
+		this.checksum.Write(this.block)
+	}
+	this.size += uint32(len(this.block))
+
+	bfinal := uint64(0)
+	if final {
+		bfinal = 1
+	}
+	this.w.writeBits(bfinal, 1)
+	this.w.writeBits(2, 2)
+
+	// Trailing zero lengths of the code length code do not need writing
+	numLenCodes := kDEFLATE_NUM_CODE_LENS
+	for numLenCodes > 4 && this.lenLengths[kDEFLATE_CODE_LEN_ORDER[numLenCodes-1]] == 0 {
+		numLenCodes--
+	}
+	this.w.writeBits(kDEFLATE_NUM_LITERALS-257, 5)
+	this.w.writeBits(0, 5)
+	this.w.writeBits(uint64(numLenCodes-4), 4)
+	for i := 0; i < numLenCodes; i++ {
+		this.w.writeBits(uint64(this.lenLengths[kDEFLATE_CODE_LEN_ORDER[i]]), 3)
+	}
+	for _, t := range this.header {
+		this.w.writeCode(this.lenCodes[t.symbol], this.lenLengths[t.symbol])
+		this.w.writeBits(t.extra, t.extraBits)
+	}
+
+	for _, b := range this.block {
+		this.w.writeCode(this.codes[b], this.lengths[b])
+	}
+	this.w.writeCode(this.codes[kDEFLATE_END_OF_BLOCK], this.lengths[kDEFLATE_END_OF_BLOCK])
+	this.block = this.block[:0]
+	return this.w.flush()
+}
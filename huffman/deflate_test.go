@@ -0,0 +1,181 @@
+package huffman
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func deflate(t *testing.T, m *Model, format DeflateFormat, chunks ...[]byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	w, err := NewDeflateWriterFormat(buf, m, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		n, err := w.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(chunk) {
+			t.Fatalf("Wrote %d bytes out of %d", n, len(chunk))
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func inflate(t *testing.T, format DeflateFormat, p []byte) []byte {
+	var r io.Reader
+	var err error
+	switch format {
+	case DEFLATE_RAW:
+		r = flate.NewReader(bytes.NewReader(p))
+	case DEFLATE_ZLIB:
+		r, err = zlib.NewReader(bytes.NewReader(p))
+	case DEFLATE_GZIP:
+		r, err = gzip.NewReader(bytes.NewReader(p))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to inflate format %d: %v", format, err)
+	}
+	return got
+}
+
+func TestDeflate_CompressFlateRoundTrip(t *testing.T) {
+	src := []byte(loremText)
+	fitted, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := CreateModelFromText([]byte("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		m    *Model
+		src  []byte
+	}{
+		{"DefaultModel", DefaultModel(), src},
+		{"DefaultModel binary", DefaultModel(), DefaultAlphabet()},
+		{"Fitted", fitted, src},
+		{"SingleSymbol", single, []byte("aaaaaaaaa")},
+		{"Empty", DefaultModel(), []byte{}},
+	} {
+		for _, format := range []DeflateFormat{DEFLATE_RAW, DEFLATE_ZLIB, DEFLATE_GZIP} {
+			p := deflate(t, tc.m, format, tc.src)
+			got := inflate(t, format, p)
+			if bytes.Compare(tc.src, got) != 0 {
+				t.Errorf("%s format %d: got %q", tc.name, format, got)
+			}
+		}
+	}
+}
+
+func TestDeflate_MultipleBlocks(t *testing.T) {
+	src := bytes.Repeat([]byte(loremText), 3*kDEFLATE_BLOCK_SIZE/len(loremText)+1)
+	p := deflate(t, DefaultModel(), DEFLATE_GZIP, src[:1000], src[1000:])
+	got := inflate(t, DEFLATE_GZIP, p)
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("Failed to inflate %d bytes over several blocks", len(src))
+	}
+	if len(p) >= len(src) {
+		t.Errorf("Deflated %d bytes into %d", len(src), len(p))
+	}
+}
+
+func TestDeflate_LengthsLimited(t *testing.T) {
+	lengths, err := deflateLiteralLengths(DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kraft := 0.0
+	for symbol, l := range lengths {
+		if l == 0 || l > kDEFLATE_MAX_CODE_LEN {
+			t.Errorf("Symbol %d has length %d", symbol, l)
+		}
+		kraft += 1.0 / float64(uint64(1)<<l)
+	}
+	if kraft != 1.0 {
+		t.Errorf("Code is not complete, Kraft sum %v", kraft)
+	}
+}
+
+func TestDeflate_CodeLengthRuns(t *testing.T) {
+	lengths := []uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 3, 3, 3, 3, 3, 3, 3, 2, 0, 0, 1}
+	tokens := encodeCodeLengths(lengths)
+
+	// Expand the tokens back out
+	got := make([]uint, 0)
+	for _, tok := range tokens {
+		switch tok.symbol {
+		case 16:
+			for i := uint64(0); i < tok.extra+3; i++ {
+				got = append(got, got[len(got)-1])
+			}
+		case 17:
+			got = append(got, make([]uint, tok.extra+3)...)
+		case 18:
+			got = append(got, make([]uint, tok.extra+11)...)
+		default:
+			got = append(got, uint(tok.symbol))
+		}
+	}
+	if len(got) != len(lengths) {
+		t.Fatalf("Expanded to %v, want %v", got, lengths)
+	}
+	for i := range lengths {
+		if got[i] != lengths[i] {
+			t.Fatalf("Expanded to %v, want %v", got, lengths)
+		}
+	}
+	// 18 for the zeros, 3 16 3 for the threes, 2, and 0 0 as two zeros are
+	// too short for a run
+	if len(tokens) != 8 {
+		t.Errorf("Expected 8 tokens, got %v", tokens)
+	}
+}
+
+func TestDeflate_Errors(t *testing.T) {
+	m, err := CreateModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewDeflateWriter(ioutil.Discard, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ab"))
+	n, err := w.Write([]byte("abz"))
+	if err == nil || n != 2 {
+		t.Errorf("Expected an error writing a symbol not in the model, got %d, %v", n, err)
+	}
+	var serr *SymbolError
+	if !errors.As(err, &serr) || serr.Symbol != 'z' || serr.Index != 4 {
+		t.Errorf("Expected a SymbolError for 'z' at index 4, got %v", err)
+	}
+	if !errors.Is(err, ErrSymbolNotInModel) {
+		t.Errorf("Expected ErrSymbolNotInModel, got %v", err)
+	}
+
+	if _, err := NewDeflateWriter(ioutil.Discard, nil); err == nil {
+		t.Errorf("Expected an error without a model")
+	}
+	if _, err := NewDeflateWriterFormat(ioutil.Discard, m, DeflateFormat(9)); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,71 @@
+package huffman
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// A byte or symbol was written which has no pattern in the model, and
+	// the model does not have an ESCAPE pattern.
+	ErrSymbolNotInModel = errors.New("Symbol is not in the model")
+	// The bits of the stream do not match any symbol of the model.
+	ErrInvalidCode = errors.New("Invalid code, the bits do not match any symbol of the model")
+	// A symbol which does not stand for a byte, such as EOS, was decoded by
+	// a reader of bytes.
+	ErrNotAByte = errors.New("Decoded symbol is not a byte")
+	// A model, or the bytes it was read from, breaks the rules of its
+	// format, e.g. has more patterns than fit in their lengths.
+	ErrInvalidModel = errors.New("Invalid model")
+	// A model without any symbols, which can not code anything.
+	ErrNoSymbols = fmt.Errorf("%w, it does not have any symbols", ErrInvalidModel)
+	// A model has a symbol which can not be written in the format it is
+	// marshalled to, e.g. ESCAPE in a list of byte lengths.
+	ErrSymbolNotInAlphabet = fmt.Errorf("%w, it has a symbol which is not in the alphabet", ErrInvalidModel)
+	// The bits after the last symbol of a stream, which pad it to a whole
+	// byte, are not 0.
+	ErrInvalidPadding = errors.New("Padding bits after the last symbol are not 0")
+	// A pattern does not fit the 64 bits of a ByteSeq.
+	ErrPatternTooLong = fmt.Errorf("Pattern is longer than %d bits", kMAX_PATTERN_LEN)
+)
+
+// SymbolError is returned by the writers when a symbol of the payload can
+// not be written. Err is usually ErrSymbolNotInModel.
+type SymbolError struct {
+	Symbol Symbol
+	// The index of the symbol in everything given to the writer, or -1 when
+	// the error is not from a writer.
+	Index int64
+	Err   error
+}
+
+func (this *SymbolError) Error() string {
+	if this.Index < 0 {
+		return fmt.Sprintf("Failed to find symbol %#x: %v", this.Symbol, this.Err)
+	}
+	return fmt.Sprintf("Failed to write symbol %#x at index %d: %v", this.Symbol, this.Index, this.Err)
+}
+
+func (this *SymbolError) Unwrap() error {
+	return this.Err
+}
+
+// DecodeError is returned by the readers when the stream does not decode,
+// e.g. with ErrInvalidCode or ErrNotAByte. Errors from the underlying
+// io.Reader, such as io.EOF, are returned as they are.
+type DecodeError struct {
+	// The number of symbols decoded before the error
+	Index int64
+	// How far into the stream, in bits, the symbol which failed to decode
+	// starts
+	BitOffset uint64
+	Err       error
+}
+
+func (this *DecodeError) Error() string {
+	return fmt.Sprintf("Failed to decode symbol %d at bit %d: %v", this.Index, this.BitOffset, this.Err)
+}
+
+func (this *DecodeError) Unwrap() error {
+	return this.Err
+}
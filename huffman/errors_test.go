@@ -0,0 +1,130 @@
+package huffman
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// An io.Writer which always fails
+type failingWriter struct{}
+
+func (this failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("Write failed")
+}
+
+func TestErrors_SymbolError(t *testing.T) {
+	m, err := CreateModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(bytes.NewBuffer([]byte{}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ab"))
+	_, err = w.Write([]byte("cz"))
+
+	var serr *SymbolError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Expected a SymbolError, got %v", err)
+	}
+	if serr.Symbol != 'z' || serr.Index != 3 {
+		t.Errorf("Got symbol %#x at index %d, want %#x at 3", serr.Symbol, serr.Index, 'z')
+	}
+	if !errors.Is(err, ErrSymbolNotInModel) {
+		t.Errorf("Expected ErrSymbolNotInModel, got %v", err)
+	}
+
+	_, err = m.GetPattern('z')
+	if !errors.As(err, &serr) || serr.Index != -1 {
+		t.Errorf("Expected a SymbolError without an index, got %v", err)
+	}
+}
+
+func TestErrors_DecodeError(t *testing.T) {
+	m := &Model{}
+	err := m.resetFromLengths(map[Symbol]uint{'a': 2, 'b': 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 'a' = 00 and 'b' = 01, so the first byte is 4 symbols and nothing
+	// starts with a 1 bit. The TableReader needs a full table of bits to
+	// tell that the code is invalid.
+	src := []byte{0x14, 0xff, 0xff}
+	readers := map[string]func() (io.Reader, error){
+		"Reader": func() (io.Reader, error) {
+			return NewReader(bytes.NewReader(src), m)
+		},
+		"TableReader": func() (io.Reader, error) {
+			return NewTableReader(bytes.NewReader(src), m)
+		},
+	}
+	for name, newReader := range readers {
+		r, err := newReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 5)
+		n, err := r.Read(p)
+		if n != 4 || string(p[:n]) != "abba" {
+			t.Errorf("%s decoded %q before the error", name, p[:n])
+		}
+		var derr *DecodeError
+		if !errors.As(err, &derr) {
+			t.Fatalf("%s: expected a DecodeError, got %v", name, err)
+		}
+		if derr.Index != 4 || derr.BitOffset != 8 {
+			t.Errorf("%s: error at symbol %d bit %d, want symbol 4 bit 8", name, derr.Index, derr.BitOffset)
+		}
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("%s: expected ErrInvalidCode, got %v", name, err)
+		}
+	}
+
+	// EOS is not a byte
+	m = HPACKModel()
+	eos, err := m.GetSymbolPattern(EOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w, _ := NewByteSeqWriter(buf)
+	w.Write(eos)
+	w.Flush()
+	r, _ := NewTableReader(buf, m)
+	_, err = r.Read(make([]byte, 1))
+	if !errors.Is(err, ErrNotAByte) {
+		t.Errorf("Expected ErrNotAByte, got %v", err)
+	}
+}
+
+func TestErrors_NoPanics(t *testing.T) {
+	var seq ByteSeq
+	for i := 0; i < kMAX_PATTERN_LEN; i++ {
+		if err := seq.AddBit(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seq.AddBit(1); err != ErrPatternTooLong {
+		t.Errorf("Expected ErrPatternTooLong, got %v", err)
+	}
+
+	w, err := NewWriter(failingWriter{}, DefaultModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(bytes.Repeat([]byte(loremText), 10))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		t.Errorf("Expected an error from a failing writer")
+	}
+
+	err = (&Model{}).UnmarshalBinary(DefaultAlphabet(), make([]byte, kDEFAULT_ALPHABET_LEN))
+	if !errors.Is(err, ErrNoSymbols) || !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected ErrNoSymbols, got %v", err)
+	}
+}
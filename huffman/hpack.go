@@ -0,0 +1,150 @@
+package huffman
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	// The 256 byte values and EOS
+	kHPACK_ALPHABET_LEN = 257
+	// Padding must be shorter than a byte (RFC 7541 5.2)
+	kHPACK_MAX_PADDING = 7
+)
+
+// The pattern lengths of the HPACK static huffman code (RFC 7541 Appendix B),
+// indexed by symbol, with EOS last. The RFC's code is canonical so the lengths
+// are all that is needed to rebuild its patterns.
+var kHPACK_LENGTHS = [kHPACK_ALPHABET_LEN]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+	30,
+}
+
+var (
+	ErrHPACKEOS     = errors.New("HPACK string contains the EOS symbol")
+	ErrHPACKPadding = errors.New("HPACK string padding is longer than 7 bits or is not a prefix of EOS")
+)
+
+var (
+	hpackModelOnce sync.Once
+	hpackModel     *Model
+)
+
+// The static huffman code of HTTP/2 header compression (RFC 7541). It has a
+// pattern for every byte plus EOS, and patterns are up to 30 bits long.
+func HPACKModel() *Model {
+	lengths := make(map[Symbol]uint)
+	for symbol, l := range kHPACK_LENGTHS {
+		lengths[Symbol(symbol)] = uint(l)
+	}
+	m := &Model{}
+	err := m.resetFromLengths(lengths, 0)
+	if err != nil {
+		log.Fatalf("Failed to create the HPACK model")
+	}
+	return m
+}
+
+// The model is never changed so EncodeHPACK and DecodeHPACK share one.
+func sharedHPACKModel() *Model {
+	hpackModelOnce.Do(func() {
+		hpackModel = HPACKModel()
+	})
+	return hpackModel
+}
+
+// The number of bytes EncodeHPACK produces for src, which is needed for the
+// length prefix of an HPACK string literal.
+func HPACKEncodedLen(src []byte) int {
+	m := sharedHPACKModel()
+	n := uint64(0)
+	for _, b := range src {
+		n += uint64(m.patternDict[Symbol(b)].Len)
+	}
+	return int((n + 7) / 8)
+}
+
+// Huffman encode src with the HPACK code. The patterns are packed most
+// significant bit first and the last byte is padded with the leading 1 bits
+// of EOS.
+func EncodeHPACK(src []byte) []byte {
+	m := sharedHPACKModel()
+	dst := make([]byte, 0, HPACKEncodedLen(src))
+	bits := uint64(0)
+	nbits := uint(0)
+	for _, b := range src {
+		seq := m.patternDict[Symbol(b)]
+		bits = bits<<seq.Len | seq.Pattern
+		nbits += seq.Len
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(bits>>nbits))
+		}
+	}
+	if nbits > 0 {
+		padding := 8 - nbits
+		dst = append(dst, byte(bits<<padding|(1<<padding-1)))
+	}
+	return dst
+}
+
+// Decode an HPACK huffman encoded string. Fails with ErrHPACKEOS if the
+// string contains EOS, and with ErrHPACKPadding if the bits after the last
+// symbol are more than 7 bits or are not all 1s.
+func DecodeHPACK(p []byte) ([]byte, error) {
+	m := sharedHPACKModel()
+	dst := make([]byte, 0, len(p)*8/5)
+
+	// The bits read since the last symbol, and whether they were all 1s
+	node := m.tree
+	depth := uint(0)
+	ones := true
+	for n, b := range p {
+		for i := 7; i >= 0; i-- {
+			if b&(1<<uint(i)) > 0 {
+				node = node.right
+			} else {
+				node = node.left
+				ones = false
+			}
+			depth += 1
+			if node == nil {
+				start := uint64(8*n+8-i) - uint64(depth)
+				return nil, &DecodeError{int64(len(dst)), start,
+					fmt.Errorf("%w, no HPACK symbol matches the bits", ErrInvalidCode)}
+			}
+			if !node.IsLeaf() {
+				continue
+			}
+
+			if node.symbol == EOS {
+				return nil, ErrHPACKEOS
+			}
+			dst = append(dst, byte(node.symbol))
+			node = m.tree
+			depth = 0
+			ones = true
+		}
+	}
+	if depth > kHPACK_MAX_PADDING || !ones {
+		return nil, ErrHPACKPadding
+	}
+	return dst, nil
+}
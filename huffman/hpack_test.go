@@ -0,0 +1,136 @@
+package huffman
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The huffman encoded strings of RFC 7541 Appendix C.4 and C.6
+var hpackTestVectors = []struct {
+	text    string
+	encoded string
+}{
+	{"www.example.com", "f1e3c2e5f23a6ba0ab90f4ff"},
+	{"no-cache", "a8eb10649cbf"},
+	{"custom-key", "25a849e95ba97d7f"},
+	{"custom-value", "25a849e95bb8e8b4bf"},
+	{"302", "6402"},
+	{"private", "aec3771a4b"},
+	{"Mon, 21 Oct 2013 20:13:21 GMT", "d07abe941054d444a8200595040b8166e082a62d1bff"},
+	{"https://www.example.com", "9d29ad171863c78f0b97c8e9ae82ae43d3"},
+	{"307", "640eff"},
+	{"Mon, 21 Oct 2013 20:13:22 GMT", "d07abe941054d444a8200595040b8166e084a62d1bff"},
+	{"gzip", "9bd9ab"},
+	{"foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		"94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007"},
+}
+
+func TestHPACK_Model(t *testing.T) {
+	m := HPACKModel()
+	for _, tc := range []struct {
+		symbol Symbol
+		want   ByteSeq
+	}{
+		{'0', ByteSeq{0x0, 5}},
+		{'a', ByteSeq{0x3, 5}},
+		{'!', ByteSeq{0x3f8, 10}},
+		{0, ByteSeq{0x1ff8, 13}},
+		{0xff, ByteSeq{0x3ffffee, 26}},
+		{EOS, ByteSeq{0x3fffffff, 30}},
+	} {
+		got, err := m.GetSymbolPattern(tc.symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("Pattern of symbol %d = %v, want %v", tc.symbol, got, tc.want)
+		}
+	}
+
+	// EOS is not a byte so it can not be written in the 256 symbol alphabet
+	if _, err := m.MarshalAlphabet(DefaultAlphabet()); err == nil {
+		t.Errorf("Expected an error marshalling a model with EOS")
+	}
+}
+
+func TestHPACK_Vectors(t *testing.T) {
+	for _, tc := range hpackTestVectors {
+		want, err := hex.DecodeString(tc.encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := EncodeHPACK([]byte(tc.text))
+		if bytes.Compare(want, got) != 0 {
+			t.Errorf("Encoded %q = %x, want %x", tc.text, got, want)
+		}
+		if n := HPACKEncodedLen([]byte(tc.text)); n != len(want) {
+			t.Errorf("Encoded length of %q = %d, want %d", tc.text, n, len(want))
+		}
+
+		text, err := DecodeHPACK(want)
+		if err != nil {
+			t.Fatalf("Failed to decode %q: %v", tc.text, err)
+		}
+		if string(text) != tc.text {
+			t.Errorf("Decoded %q, want %q", text, tc.text)
+		}
+	}
+}
+
+func TestHPACK_AllBytes(t *testing.T) {
+	src := DefaultAlphabet()
+	got, err := DecodeHPACK(EncodeHPACK(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(src, got) != 0 {
+		t.Errorf("Failed to round trip every byte value")
+	}
+	if got, err := DecodeHPACK(nil); err != nil || len(got) != 0 {
+		t.Errorf("Empty string decoded to %q, %v", got, err)
+	}
+}
+
+func TestHPACK_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		encoded []byte
+		want    error
+	}{
+		// "302" followed by a whole byte of padding
+		{"long padding", []byte{0x64, 0x02, 0xff}, ErrHPACKPadding},
+		// 'a' is 00011, padded with 0s instead of 1s
+		{"zero padding", []byte{0x18}, ErrHPACKPadding},
+		// 30 1 bits are EOS
+		{"EOS", []byte{0xff, 0xff, 0xff, 0xfc}, ErrHPACKEOS},
+	} {
+		_, err := DecodeHPACK(tc.encoded)
+		if err != tc.want {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestHPACK_TableReader(t *testing.T) {
+	// HPACK packs patterns the same way as Writer, so the readers can decode
+	// it as long as they stop before the padding.
+	text := "www.example.com"
+	r, err := NewTableReader(bytes.NewReader(EncodeHPACK([]byte(text))), HPACKModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(text))
+	if _, err := r.Read(got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != text {
+		t.Errorf("TableReader decoded %q", got)
+	}
+
+	r.Reset(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xfc}))
+	if _, err := r.Read(got[:1]); err == nil {
+		t.Errorf("Expected an error reading EOS as a byte")
+	}
+}
@@ -0,0 +1,489 @@
+package huffman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Most literal/length and distance codes a dynamic block can declare
+	kDEFLATE_MAX_LITERAL_CODES  = 286
+	kDEFLATE_MAX_DISTANCE_CODES = 30
+	// Number of literal/length codes in a fixed huffman block
+	kDEFLATE_FIXED_LITERAL_CODES = 288
+)
+
+var (
+	// The DEFLATE stream has a length/distance pair, DeflateReader only
+	// decodes literals.
+	ErrDeflateBackReference = errors.New(
+		"DEFLATE stream uses back-references, only literal blocks are supported")
+	ErrDeflateChecksumMismatch = errors.New("DEFLATE container checksum does not match the data")
+)
+
+// Build the tree for the canonical code with the given lengths. Symbols from
+// numSymbols up still take their patterns, so the other symbols get the right
+// codes, but are left out of the tree and fail when they are decoded. Incomplete
+// codes are accepted, a pattern which is missing from the tree fails the same
+// way.
+func inflateHuffmanTree(lengths []uint, numSymbols int) (*Node, error) {
+	patternDict := make(map[Symbol]ByteSeq)
+	for symbol, l := range lengths {
+		if l > 0 {
+			patternDict[Symbol(symbol)] = ByteSeq{0, l}
+		}
+	}
+	err := checkKraft(patternDict, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w, in the DEFLATE code lengths", err)
+	}
+	codebook, err := canonicalCodebook(patternDict)
+	if err != nil {
+		return nil, err
+	}
+	for symbol := range codebook {
+		if int(symbol) >= numSymbols {
+			delete(codebook, symbol)
+		}
+	}
+	return canonicalHuffmanTree(codebook)
+}
+
+// The literal/length lengths of a fixed huffman block (RFC 1951 3.2.6)
+func fixedLiteralLengths() []uint {
+	lengths := make([]uint, kDEFLATE_FIXED_LITERAL_CODES)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	return lengths
+}
+
+// DeflateReader decodes the subset of DEFLATE (RFC 1951) which does not use
+// back-references: stored blocks, and fixed or dynamic huffman blocks which
+// only contain literals. This is what DeflateWriter writes, and what
+// compress/flate writes at the HuffmanOnly level. A stream with a
+// length/distance pair fails with ErrDeflateBackReference.
+type DeflateReader struct {
+	r      io.ByteReader
+	format DeflateFormat
+
+	// Bits read from the stream but not yet used, least significant first
+	bits  uint64
+	nbits uint
+
+	// The block being read
+	inBlock bool
+	final   bool
+	stored  int
+	lit     *Node
+
+	checksum   hash.Hash32
+	size       uint32
+	readHeader bool
+	done       bool
+	err        error
+	fixedTree  *Node
+}
+
+func NewDeflateReader(r io.Reader) (*DeflateReader, error) {
+	return NewDeflateReaderFormat(r, DEFLATE_RAW)
+}
+
+// Create a DeflateReader for a DEFLATE stream inside a zlib or gzip container.
+// The container checksum is checked at the end of the stream.
+func NewDeflateReaderFormat(r io.Reader, format DeflateFormat) (*DeflateReader, error) {
+	var checksum hash.Hash32
+	switch format {
+	case DEFLATE_RAW:
+	case DEFLATE_ZLIB:
+		checksum = adler32.New()
+	case DEFLATE_GZIP:
+		checksum = crc32.NewIEEE()
+	default:
+		return nil, fmt.Errorf("Unknown DEFLATE format %d", format)
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+	return &DeflateReader{r: br, format: format, checksum: checksum}, nil
+}
+
+func (this *DeflateReader) Read(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	n, err := this.read(p)
+	if this.checksum != nil {
+		this.checksum.Write(p[:n])
+	}
+	this.size += uint32(n)
+	if err == nil && this.done {
+		err = this.readTrailer()
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	this.err = err
+	return n, err
+}
+
+func (this *DeflateReader) read(p []byte) (int, error) {
+	if !this.readHeader {
+		err := this.readContainerHeader()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		this.readHeader = true
+	}
+
+	n := 0
+	for n < len(p) && !this.done {
+		if !this.inBlock {
+			err := this.readBlockHeader()
+			if err != nil {
+				return n, unexpectedEOF(err)
+			}
+			continue
+		}
+
+		if this.lit == nil {
+			// Stored block, copy the bytes straight through
+			for n < len(p) && this.stored > 0 {
+				b, err := this.r.ReadByte()
+				if err != nil {
+					return n, unexpectedEOF(err)
+				}
+				p[n] = b
+				n++
+				this.stored--
+			}
+			if this.stored == 0 {
+				this.endBlock()
+			}
+			continue
+		}
+
+		symbol, err := this.readSymbol(this.lit)
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+		switch {
+		case symbol < 256:
+			p[n] = byte(symbol)
+			n++
+		case symbol == kDEFLATE_END_OF_BLOCK:
+			this.endBlock()
+		default:
+			return n, ErrDeflateBackReference
+		}
+	}
+	return n, nil
+}
+
+func (this *DeflateReader) endBlock() {
+	this.inBlock = false
+	if this.final {
+		this.done = true
+	}
+}
+
+// Read the low n bits, n must be at most 32.
+func (this *DeflateReader) readBits(n uint) (uint64, error) {
+	for this.nbits < n {
+		b, err := this.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		this.bits |= uint64(b) << this.nbits
+		this.nbits += 8
+	}
+	v := this.bits & (1<<n - 1)
+	this.bits >>= n
+	this.nbits -= n
+	return v, nil
+}
+
+// Drop the bits up to the next byte boundary. Bytes are only read when bits
+// are needed so there is never a whole byte left over.
+func (this *DeflateReader) align() {
+	this.bits = 0
+	this.nbits = 0
+}
+
+// Walk the tree a bit at a time. DEFLATE packs patterns most significant bit
+// first, so each bit read is the next step down the tree. Every pattern is at
+// least one bit, even when the tree has no symbols at all.
+func (this *DeflateReader) readSymbol(root *Node) (int, error) {
+	n := root
+	for {
+		b, err := this.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		n = n.walk(b, 1)
+		if n == nil {
+			return 0, fmt.Errorf("%w, no DEFLATE symbol matches the bits", ErrInvalidCode)
+		}
+		if n.IsLeaf() {
+			return int(n.symbol), nil
+		}
+	}
+}
+
+func (this *DeflateReader) readBlockHeader() error {
+	header, err := this.readBits(3)
+	if err != nil {
+		return err
+	}
+	this.final = header&1 == 1
+
+	switch header >> 1 {
+	case 0:
+		this.align()
+		var lens [4]byte
+		for i := range lens {
+			lens[i], err = this.r.ReadByte()
+			if err != nil {
+				return err
+			}
+		}
+		length := binary.LittleEndian.Uint16(lens[0:2])
+		if length != ^binary.LittleEndian.Uint16(lens[2:4]) {
+			return fmt.Errorf("%w, the LEN and NLEN of a DEFLATE stored block do not match", ErrInvalidCode)
+		}
+		this.lit = nil
+		this.stored = int(length)
+	case 1:
+		if this.fixedTree == nil {
+			// Fixed blocks have codes for 286 and 287 but they are never used
+			this.fixedTree, err = inflateHuffmanTree(fixedLiteralLengths(), kDEFLATE_MAX_LITERAL_CODES)
+			if err != nil {
+				return err
+			}
+		}
+		this.lit = this.fixedTree
+	case 2:
+		this.lit, err = this.readDynamicHeader()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w, DEFLATE block type 3", ErrInvalidCode)
+	}
+	this.inBlock = true
+	return nil
+}
+
+// Read the code lengths of a dynamic huffman block (RFC 1951 3.2.7) and build
+// the literal/length tree. The distance code is read but never used.
+func (this *DeflateReader) readDynamicHeader() (*Node, error) {
+	counts, err := this.readBits(14)
+	if err != nil {
+		return nil, err
+	}
+	numLit := int(counts&0x1f) + 257
+	numDist := int(counts>>5&0x1f) + 1
+	numLenCodes := int(counts>>10) + 4
+	if numLit > kDEFLATE_MAX_LITERAL_CODES || numDist > kDEFLATE_MAX_DISTANCE_CODES {
+		return nil, fmt.Errorf("%w, the DEFLATE header has %d literal and %d distance codes",
+			ErrInvalidModel, numLit, numDist)
+	}
+
+	lenLengths := make([]uint, kDEFLATE_NUM_CODE_LENS)
+	for i := 0; i < numLenCodes; i++ {
+		l, err := this.readBits(3)
+		if err != nil {
+			return nil, err
+		}
+		lenLengths[kDEFLATE_CODE_LEN_ORDER[i]] = uint(l)
+	}
+	lenTree, err := inflateHuffmanTree(lenLengths, len(lenLengths))
+	if err != nil {
+		return nil, err
+	}
+
+	// The literal/length and distance lengths are one run length encoded
+	// sequence.
+	lengths := make([]uint, 0, numLit+numDist)
+	for len(lengths) < numLit+numDist {
+		symbol, err := this.readSymbol(lenTree)
+		if err != nil {
+			return nil, err
+		}
+
+		var value uint
+		var repeat uint64
+		switch {
+		case symbol < 16:
+			lengths = append(lengths, uint(symbol))
+			continue
+		case symbol == 16:
+			if len(lengths) == 0 {
+				return nil, fmt.Errorf("%w, the DEFLATE header repeats with no previous length", ErrInvalidModel)
+			}
+			value = lengths[len(lengths)-1]
+			repeat, err = this.readBits(2)
+			repeat += 3
+		case symbol == 17:
+			repeat, err = this.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = this.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(lengths)+int(repeat) > numLit+numDist {
+			return nil, fmt.Errorf("%w, the DEFLATE header has more code lengths than codes", ErrInvalidModel)
+		}
+		for i := uint64(0); i < repeat; i++ {
+			lengths = append(lengths, value)
+		}
+	}
+
+	if lengths[kDEFLATE_END_OF_BLOCK] == 0 {
+		return nil, fmt.Errorf("%w, the DEFLATE header has no end of block code", ErrInvalidModel)
+	}
+	_, err = inflateHuffmanTree(lengths[numLit:], numDist)
+	if err != nil {
+		return nil, err
+	}
+	return inflateHuffmanTree(lengths[:numLit], numLit)
+}
+
+func (this *DeflateReader) readByte() (byte, error) {
+	v, err := this.readBits(8)
+	return byte(v), err
+}
+
+func (this *DeflateReader) readContainerHeader() error {
+	switch this.format {
+	case DEFLATE_ZLIB:
+		cmf, err := this.readByte()
+		if err != nil {
+			return err
+		}
+		flg, err := this.readByte()
+		if err != nil {
+			return err
+		}
+		if cmf&0x0f != 8 || (uint16(cmf)<<8|uint16(flg))%31 != 0 {
+			return fmt.Errorf("%w, invalid zlib header", ErrInvalidCode)
+		}
+		if flg&0x20 > 0 {
+			return errors.New("zlib streams with a preset dictionary are not supported")
+		}
+	case DEFLATE_GZIP:
+		var header [10]byte
+		for i := range header {
+			b, err := this.readByte()
+			if err != nil {
+				return err
+			}
+			header[i] = b
+		}
+		if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+			return fmt.Errorf("%w, invalid gzip header", ErrInvalidCode)
+		}
+		return this.skipGzipFields(header[3])
+	}
+	return nil
+}
+
+// Skip the optional fields of a gzip header
+func (this *DeflateReader) skipGzipFields(flags byte) error {
+	const (
+		fHCRC    = 1 << 1
+		fEXTRA   = 1 << 2
+		fNAME    = 1 << 3
+		fCOMMENT = 1 << 4
+	)
+	if flags&fEXTRA > 0 {
+		xlen, err := this.readBits(16)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < xlen; i++ {
+			_, err = this.readByte()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range []byte{fNAME, fCOMMENT} {
+		if flags&f == 0 {
+			continue
+		}
+		// Zero terminated string
+		for {
+			b, err := this.readByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&fHCRC > 0 {
+		_, err := this.readBits(16)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *DeflateReader) readTrailer() error {
+	this.align()
+	switch this.format {
+	case DEFLATE_ZLIB:
+		var trailer [4]byte
+		for i := range trailer {
+			b, err := this.readByte()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			trailer[i] = b
+		}
+		if binary.BigEndian.Uint32(trailer[:]) != this.checksum.Sum32() {
+			return ErrDeflateChecksumMismatch
+		}
+	case DEFLATE_GZIP:
+		checksum, err := this.readBits(32)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		size, err := this.readBits(32)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if uint32(checksum) != this.checksum.Sum32() || uint32(size) != this.size {
+			return ErrDeflateChecksumMismatch
+		}
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package huffman
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func readDeflate(format DeflateFormat, p []byte) ([]byte, error) {
+	r, err := NewDeflateReaderFormat(bytes.NewReader(p), format)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func compressFlate(t *testing.T, format DeflateFormat, level int, src []byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case DEFLATE_RAW:
+		w, err = flate.NewWriter(buf, level)
+	case DEFLATE_ZLIB:
+		w, err = zlib.NewWriterLevel(buf, level)
+	case DEFLATE_GZIP:
+		var gw *gzip.Writer
+		gw, err = gzip.NewWriterLevel(buf, level)
+		if err == nil {
+			// Fill in the optional header fields so they get skipped
+			gw.Name = "lorem.txt"
+			gw.Comment = "huffman only"
+			gw.Extra = []byte{1, 2, 3}
+		}
+		w = gw
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInflate_DeflateWriterRoundTrip(t *testing.T) {
+	src := []byte(loremText)
+	m, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat(src, 2*kDEFLATE_BLOCK_SIZE/len(src)+1)
+
+	for _, format := range []DeflateFormat{DEFLATE_RAW, DEFLATE_ZLIB, DEFLATE_GZIP} {
+		for _, p := range [][]byte{[]byte{}, src, big} {
+			got, err := readDeflate(format, deflate(t, m, format, p))
+			if err != nil {
+				t.Fatalf("Failed to read format %d of %d bytes: %v", format, len(p), err)
+			}
+			if bytes.Compare(p, got) != 0 {
+				t.Errorf("Format %d of %d bytes differs", format, len(p))
+			}
+		}
+	}
+}
+
+func TestInflate_CompressFlate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	random := make([]byte, 100000)
+	for i := range random {
+		random[i] = byte(rnd.ExpFloat64() * 20)
+	}
+
+	for _, format := range []DeflateFormat{DEFLATE_RAW, DEFLATE_ZLIB, DEFLATE_GZIP} {
+		// HuffmanOnly gives dynamic blocks, NoCompression stored blocks
+		for _, level := range []int{flate.HuffmanOnly, flate.NoCompression} {
+			for _, src := range [][]byte{[]byte{}, []byte("a"), []byte(loremText), random} {
+				got, err := readDeflate(format, compressFlate(t, format, level, src))
+				if err != nil {
+					t.Fatalf("Failed to read format %d level %d of %d bytes: %v",
+						format, level, len(src), err)
+				}
+				if bytes.Compare(src, got) != 0 {
+					t.Errorf("Format %d level %d of %d bytes differs", format, level, len(src))
+				}
+			}
+		}
+	}
+}
+
+func TestInflate_FixedBlock(t *testing.T) {
+	// compress/flate does not write fixed blocks for HuffmanOnly so build one
+	codes := deflateCanonicalCodes(fixedLiteralLengths())
+	lengths := fixedLiteralLengths()
+	buf := bytes.NewBuffer([]byte{})
+	bw := newLSBBitWriter(buf)
+	bw.writeBits(1|1<<1, 3)
+	for _, b := range []byte("fixed \xff") {
+		bw.writeCode(codes[b], lengths[b])
+	}
+	bw.writeCode(codes[kDEFLATE_END_OF_BLOCK], lengths[kDEFLATE_END_OF_BLOCK])
+	bw.align()
+	err := bw.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readDeflate(DEFLATE_RAW, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "fixed \xff" {
+		t.Errorf("Fixed block decoded to %q", got)
+	}
+
+	// 286 and 287 have codes in a fixed block but are not valid symbols
+	for _, symbol := range []int{286, 287} {
+		buf.Reset()
+		bw = newLSBBitWriter(buf)
+		bw.writeBits(1|1<<1, 3)
+		bw.writeCode(codes['a'], lengths['a'])
+		bw.writeCode(codes[symbol], lengths[symbol])
+		bw.align()
+		err = bw.flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = readDeflate(DEFLATE_RAW, buf.Bytes())
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Expected ErrInvalidCode for symbol %d, got %q, %v", symbol, got, err)
+		}
+	}
+}
+
+func TestInflate_BackReference(t *testing.T) {
+	src := bytes.Repeat([]byte(loremText), 4)
+	_, err := readDeflate(DEFLATE_RAW, compressFlate(t, DEFLATE_RAW, flate.BestCompression, src))
+	if err != ErrDeflateBackReference {
+		t.Errorf("Expected ErrDeflateBackReference, got %v", err)
+	}
+}
+
+func TestInflate_Errors(t *testing.T) {
+	if _, err := NewDeflateReaderFormat(bytes.NewReader(nil), DeflateFormat(9)); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	for _, tc := range []struct {
+		name   string
+		format DeflateFormat
+		p      []byte
+		want   error
+	}{
+		{"block type 3", DEFLATE_RAW, []byte{0x07}, ErrInvalidCode},
+		{"stored block NLEN", DEFLATE_RAW, []byte{0x01, 0x01, 0x00, 0x00, 0x00}, ErrInvalidCode},
+		// A dynamic block with 288 literal/length codes
+		{"dynamic header counts", DEFLATE_RAW, []byte{0xfd, 0x00, 0x00}, ErrInvalidModel},
+		{"zlib header", DEFLATE_ZLIB, []byte{0x78, 0x00}, ErrInvalidCode},
+		{"gzip header", DEFLATE_GZIP, make([]byte, 10), ErrInvalidCode},
+	} {
+		if _, err := readDeflate(tc.format, tc.p); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	// Every truncation must fail
+	for _, format := range []DeflateFormat{DEFLATE_RAW, DEFLATE_ZLIB, DEFLATE_GZIP} {
+		p := compressFlate(t, format, flate.HuffmanOnly, []byte(loremText[:500]))
+		for n := 0; n < len(p); n++ {
+			if _, err := readDeflate(format, p[:n]); err == nil {
+				t.Errorf("Expected an error reading %d of %d bytes of format %d", n, len(p), format)
+			}
+		}
+
+		// Flip a payload bit, the container checksum must catch it if the
+		// stream still parses.
+		if format != DEFLATE_RAW {
+			bad := append([]byte{}, p...)
+			bad[len(bad)-10] ^= 0x10
+			if _, err := readDeflate(format, bad); err == nil {
+				t.Errorf("Expected an error for a corrupt stream of format %d", format)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package huffman
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+const (
+	// JPEG patterns are at most 16 bits, BITS has a count for each length
+	kJPEG_MAX_CODE_LEN = 16
+	// The Tc values of a DHT table
+	JPEG_DC_TABLE = 0
+	JPEG_AC_TABLE = 1
+	// The highest Th value, baseline JPEG only uses 0 and 1
+	kJPEG_MAX_TABLE_ID = 3
+)
+
+// A JPEG huffman table as it is stored in a DHT segment (ITU T.81 B.2.4.2).
+// BITS is the number of patterns of each length 1 to 16 and HUFFVAL the
+// symbols in the order their patterns were assigned.
+type jpegSpec struct {
+	bits    [kJPEG_MAX_CODE_LEN]uint8
+	huffval []byte
+}
+
+// The typical tables of ITU T.81 Annex K.3
+var (
+	kJPEG_LUMINANCE_DC = jpegSpec{
+		[kJPEG_MAX_CODE_LEN]uint8{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+	kJPEG_CHROMINANCE_DC = jpegSpec{
+		[kJPEG_MAX_CODE_LEN]uint8{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+	kJPEG_LUMINANCE_AC = jpegSpec{
+		[kJPEG_MAX_CODE_LEN]uint8{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}
+	kJPEG_CHROMINANCE_AC = jpegSpec{
+		[kJPEG_MAX_CODE_LEN]uint8{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}
+)
+
+// The DC coefficient table for luminance from ITU T.81 Annex K.3
+func JPEGLuminanceDCModel() *Model {
+	return jpegModelFromSpec(kJPEG_LUMINANCE_DC)
+}
+
+// The DC coefficient table for chrominance from ITU T.81 Annex K.3
+func JPEGChrominanceDCModel() *Model {
+	return jpegModelFromSpec(kJPEG_CHROMINANCE_DC)
+}
+
+// The AC coefficient table for luminance from ITU T.81 Annex K.3
+func JPEGLuminanceACModel() *Model {
+	return jpegModelFromSpec(kJPEG_LUMINANCE_AC)
+}
+
+// The AC coefficient table for chrominance from ITU T.81 Annex K.3
+func JPEGChrominanceACModel() *Model {
+	return jpegModelFromSpec(kJPEG_CHROMINANCE_AC)
+}
+
+func jpegModelFromSpec(spec jpegSpec) *Model {
+	m, err := CreateModelFromDHT(spec.bits, spec.huffval)
+	if err != nil {
+		log.Fatalf("Failed to create the JPEG model")
+	}
+	return m
+}
+
+// Create a model from a JPEG huffman table. The patterns are assigned the way
+// JPEG does (ITU T.81 C.2), which is the same canonical code as
+// canonicalCodebook except that symbols of the same length get their patterns
+// in HUFFVAL order rather than symbol order. The code never uses the all 1s
+// pattern, so it is not complete. MarshalModel keeps both and UnmarshalModel
+// reads the model back unchanged, but MarshalAlphabet only has the lengths
+// and UnmarshalBinary refuses an incomplete code.
+func CreateModelFromDHT(bits [kJPEG_MAX_CODE_LEN]uint8, huffval []byte) (*Model, error) {
+	total := 0
+	for _, n := range bits {
+		total += int(n)
+	}
+	if total != len(huffval) {
+		return nil, fmt.Errorf("%w, DHT BITS counts %d symbols but HUFFVAL has %d",
+			ErrInvalidModel, total, len(huffval))
+	}
+	if total == 0 {
+		return nil, ErrNoSymbols
+	}
+
+	ps := make([]symbolByteSeqPair, 0, total)
+	lengths := make(map[Symbol]ByteSeq)
+	for l := uint(1); l <= kJPEG_MAX_CODE_LEN; l++ {
+		for i := 0; i < int(bits[l-1]); i++ {
+			symbol := Symbol(huffval[len(ps)])
+			if _, ok := lengths[symbol]; ok {
+				return nil, fmt.Errorf("%w, DHT symbol %#x appears more than once", ErrInvalidModel, symbol)
+			}
+			lengths[symbol] = ByteSeq{0, l}
+			ps = append(ps, symbolByteSeqPair{symbol, ByteSeq{0, l}})
+		}
+	}
+	err := checkKraft(lengths, false)
+	if err != nil {
+		return nil, err
+	}
+
+	patternDict := sequentialCodebook(ps)
+	tree, err := canonicalHuffmanTree(patternDict)
+	if err != nil {
+		return nil, err
+	}
+	return &Model{tree: tree, patternDict: patternDict}, nil
+}
+
+// The JPEG huffman table of the model, the inverse of CreateModelFromDHT.
+// Fails if a symbol is not a byte, a pattern is longer than 16 bits, or a
+// pattern is all 1 bits, which JPEG reserves.
+func (this *Model) DHT() ([kJPEG_MAX_CODE_LEN]uint8, []byte, error) {
+	var bits [kJPEG_MAX_CODE_LEN]uint8
+	ps := make(symbolByteSeqPairPatternSort, 0, len(this.patternDict))
+	for k, v := range this.patternDict {
+		ps = append(ps, symbolByteSeqPair{k, v})
+	}
+	sort.Sort(ps)
+
+	huffval := make([]byte, 0, len(ps))
+	code := uint64(0)
+	l := uint(1)
+	for _, p := range ps {
+		if p.symbol > 0xff {
+			return bits, nil, fmt.Errorf("Symbol %d does not fit in a DHT table", p.symbol)
+		}
+		if p.byteSeq.Len > kJPEG_MAX_CODE_LEN {
+			return bits, nil, fmt.Errorf("Pattern for symbol %#x is %d bits, DHT allows at most %d",
+				p.symbol, p.byteSeq.Len, kJPEG_MAX_CODE_LEN)
+		}
+		for l < p.byteSeq.Len {
+			code <<= 1
+			l += 1
+		}
+		if p.byteSeq.Pattern != code {
+			return bits, nil, errors.New("Model patterns are not assigned in DHT order")
+		}
+		if code == 1<<l-1 {
+			return bits, nil, fmt.Errorf("Pattern for symbol %#x is all 1 bits, which JPEG reserves",
+				p.symbol)
+		}
+		bits[l-1] += 1
+		huffval = append(huffval, byte(p.symbol))
+		code += 1
+	}
+	return bits, huffval, nil
+}
+
+// A huffman table of a DHT segment with its class (JPEG_DC_TABLE or
+// JPEG_AC_TABLE) and destination ID.
+type DHTTable struct {
+	Class uint8
+	ID    uint8
+	Model *Model
+}
+
+// Read the tables of a DHT segment. p is the segment after its marker and
+// length.
+func ParseDHT(p []byte) ([]DHTTable, error) {
+	tables := make([]DHTTable, 0)
+	for len(p) > 0 {
+		if len(p) < 1+kJPEG_MAX_CODE_LEN {
+			return nil, fmt.Errorf("%w, the DHT segment is truncated", ErrInvalidModel)
+		}
+		class, id := p[0]>>4, p[0]&0x0f
+		if class > JPEG_AC_TABLE || id > kJPEG_MAX_TABLE_ID {
+			return nil, fmt.Errorf("%w, DHT table class %d and ID %d", ErrInvalidModel, class, id)
+		}
+
+		var bits [kJPEG_MAX_CODE_LEN]uint8
+		copy(bits[:], p[1:])
+		total := 0
+		for _, n := range bits {
+			total += int(n)
+		}
+		p = p[1+kJPEG_MAX_CODE_LEN:]
+		if len(p) < total {
+			return nil, fmt.Errorf("%w, the DHT segment is truncated", ErrInvalidModel)
+		}
+
+		m, err := CreateModelFromDHT(bits, p[:total])
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, DHTTable{class, id, m})
+		p = p[total:]
+	}
+	return tables, nil
+}
+
+// Append the tables as the body of a DHT segment, everything after the
+// marker and length.
+func AppendDHT(dst []byte, tables []DHTTable) ([]byte, error) {
+	for _, t := range tables {
+		if t.Class > JPEG_AC_TABLE || t.ID > kJPEG_MAX_TABLE_ID {
+			return nil, fmt.Errorf("Invalid DHT table class %d and ID %d", t.Class, t.ID)
+		}
+		bits, huffval, err := t.Model.DHT()
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, t.Class<<4|t.ID)
+		dst = append(dst, bits[:]...)
+		dst = append(dst, huffval...)
+	}
+	return dst, nil
+}
@@ -0,0 +1,207 @@
+package huffman
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestJPEG_AnnexKModels(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		m    *Model
+		spec jpegSpec
+	}{
+		{"luminance DC", JPEGLuminanceDCModel(), kJPEG_LUMINANCE_DC},
+		{"chrominance DC", JPEGChrominanceDCModel(), kJPEG_CHROMINANCE_DC},
+		{"luminance AC", JPEGLuminanceACModel(), kJPEG_LUMINANCE_AC},
+		{"chrominance AC", JPEGChrominanceACModel(), kJPEG_CHROMINANCE_AC},
+	} {
+		bits, huffval, err := tc.m.DHT()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if bits != tc.spec.bits || bytes.Compare(huffval, tc.spec.huffval) != 0 {
+			t.Errorf("%s: DHT does not round trip", tc.name)
+		}
+
+		// The Annex K tables list the symbols of each length in order, so
+		// they are the same code as the canonical code of their lengths.
+		// JPEG never uses the all 1s pattern, so the code is not complete
+		// and is not accepted by UnmarshalBinary.
+		lengths, err := tc.m.MarshalAlphabet(DefaultAlphabet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Model{}).UnmarshalBinary(DefaultAlphabet(), lengths); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("%s: expected an incomplete code error, got %v", tc.name, err)
+		}
+		canonicalLengths := make(map[Symbol]uint)
+		for symbol, l := range lengths {
+			if l > 0 {
+				canonicalLengths[Symbol(symbol)] = uint(l)
+			}
+		}
+		// MarshalModel keeps the incomplete code
+		checkMarshalModel(t, tc.name, tc.m)
+
+		canonical := &Model{}
+		err = canonical.resetFromLengths(canonicalLengths, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for symbol, seq := range tc.m.patternDict {
+			if canonical.patternDict[symbol] != seq {
+				t.Errorf("%s: pattern of %#x is %v, canonical is %v",
+					tc.name, symbol, seq, canonical.patternDict[symbol])
+			}
+		}
+	}
+
+	// Patterns from ITU T.81 Tables K.3 and K.5
+	for _, tc := range []struct {
+		m      *Model
+		symbol byte
+		want   string
+	}{
+		{JPEGLuminanceDCModel(), 0, "00"},
+		{JPEGLuminanceDCModel(), 11, "111111110"},
+		{JPEGLuminanceACModel(), 0x00, "1010"},
+		{JPEGLuminanceACModel(), 0xf0, "11111111001"},
+		{JPEGLuminanceACModel(), 0xfa, "1111111111111110"},
+	} {
+		got, err := tc.m.GetPattern(tc.symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tc.want {
+			t.Errorf("Pattern of %#x = %v, want %s", tc.symbol, got, tc.want)
+		}
+	}
+}
+
+func TestJPEG_HuffvalOrder(t *testing.T) {
+	// Symbols of the same length get patterns in HUFFVAL order
+	bits := [kJPEG_MAX_CODE_LEN]uint8{0, 3}
+	m, err := CreateModelFromDHT(bits, []byte{'c', 'a', 'b'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for symbol, want := range map[byte]string{'c': "00", 'a': "01", 'b': "10"} {
+		got, _ := m.GetPattern(symbol)
+		if got.String() != want {
+			t.Errorf("Pattern of %c = %v, want %s", symbol, got, want)
+		}
+	}
+
+	_, huffval, err := m.DHT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(huffval) != "cab" {
+		t.Errorf("HUFFVAL = %q, want \"cab\"", huffval)
+	}
+	checkMarshalModel(t, "HUFFVAL order", m)
+
+	// 'a' 'b' 'c' = 01 10 00, padded with 1s
+	r, err := NewTableReader(bytes.NewReader([]byte{0x63}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 3)
+	if _, err := r.Read(got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abc" {
+		t.Errorf("Decoded %q, want \"abc\"", got)
+	}
+}
+
+func TestJPEG_Segment(t *testing.T) {
+	tables := []DHTTable{
+		{JPEG_DC_TABLE, 0, JPEGLuminanceDCModel()},
+		{JPEG_AC_TABLE, 0, JPEGLuminanceACModel()},
+		{JPEG_DC_TABLE, 1, JPEGChrominanceDCModel()},
+		{JPEG_AC_TABLE, 1, JPEGChrominanceACModel()},
+	}
+	p, err := AppendDHT(nil, tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each table is its class and ID byte, the 16 BITS and then HUFFVAL
+	if len(p) != 4*17+12+162+12+162 || p[0] != 0x00 || p[29] != 0x10 {
+		t.Errorf("DHT segment has the wrong layout")
+	}
+
+	got, err := ParseDHT(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(tables) {
+		t.Fatalf("Parsed %d tables, want %d", len(got), len(tables))
+	}
+	for i := range tables {
+		if got[i].Class != tables[i].Class || got[i].ID != tables[i].ID {
+			t.Errorf("Table %d is class %d ID %d", i, got[i].Class, got[i].ID)
+		}
+		want, _ := tables[i].Model.MarshalModel()
+		have, _ := got[i].Model.MarshalModel()
+		if bytes.Compare(want, have) != 0 {
+			t.Errorf("Table %d has different patterns", i)
+		}
+	}
+
+	for n := 1; n < len(p); n++ {
+		if _, err := ParseDHT(p[:n]); err == nil && n != 29 && n != 29+179 && n != 2*29+179 {
+			t.Errorf("Expected an error parsing %d of %d bytes", n, len(p))
+		}
+	}
+}
+
+func TestJPEG_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		bits    [kJPEG_MAX_CODE_LEN]uint8
+		huffval []byte
+	}{
+		{"count mismatch", [kJPEG_MAX_CODE_LEN]uint8{0, 2}, []byte{1}},
+		{"empty", [kJPEG_MAX_CODE_LEN]uint8{}, []byte{}},
+		{"duplicate", [kJPEG_MAX_CODE_LEN]uint8{0, 2}, []byte{1, 1}},
+		{"too many patterns", [kJPEG_MAX_CODE_LEN]uint8{3}, []byte{1, 2, 3}},
+	} {
+		if _, err := CreateModelFromDHT(tc.bits, tc.huffval); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("%s: expected ErrInvalidModel, got %v", tc.name, err)
+		}
+	}
+
+	// 'b' gets the all 1s pattern
+	full, err := CreateModelFromText([]byte("aab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := CreateModelFromText([]byte("aaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HPACK has patterns over 16 bits and EOS
+	for _, m := range []*Model{full, HPACKModel()} {
+		if _, _, err := m.DHT(); err == nil {
+			t.Errorf("Expected an error writing a DHT table")
+		}
+	}
+	if _, _, err := single.DHT(); err != nil {
+		t.Errorf("A one symbol model should fit a DHT table, got %v", err)
+	}
+
+	if _, err := AppendDHT(nil, []DHTTable{{2, 0, JPEGLuminanceDCModel()}}); err == nil {
+		t.Errorf("Expected an error for table class 2")
+	}
+	if _, err := ParseDHT([]byte{0x04, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}); !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected ErrInvalidModel for table ID 4, got %v", err)
+	}
+	for _, p := range [][]byte{{0x00, 1}, {0x00, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}} {
+		if _, err := ParseDHT(p); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("Expected ErrInvalidModel for a truncated segment, got %v", err)
+		}
+	}
+}
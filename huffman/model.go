@@ -9,30 +9,80 @@ import (
 	"sort"
 )
 
+// A symbol of a model's alphabet. The byte values are symbols 0 to 255, the
+// values above are symbols which do not stand for a byte, like EOS.
+type Symbol uint16
+
+const (
+	// The end-of-string symbol of the HPACK code (RFC 7541)
+	EOS Symbol = 256
+	// Stands in for any byte which is not in the model. The Writer writes
+	// the pattern of ESCAPE followed by the 8 bits of the byte. Like EOS it
+	// is not part of a byte alphabet, so MarshalAlphabet can not write it.
+	ESCAPE Symbol = 257
+	// Marks the end of the stream in-band, so a stream can be read back
+	// without knowing how many symbols it has. The Writer writes it on Close
+	// and the readers stop with io.EOF once they decode it.
+	EOB Symbol = 258
+)
+
 type Model struct {
 	tree *Node
 	// freqDict    map[byte]*Freq
-	patternDict map[byte]ByteSeq
+	patternDict map[Symbol]ByteSeq
+	// The longest pattern allowed in the model, 0 if there is no limit
+	maxLen uint
 }
 
 const (
-	kDEFAULT_ALPHABET_LEN = 128
+	// Every possible byte value, used for arbitrary binary payloads
+	kDEFAULT_ALPHABET_LEN = 256
+	// The original 7-bit ASCII alphabet
+	kASCII_ALPHABET_LEN = 128
+	// The start of the output of MarshalModel, and the version of its layout
+	kMODEL_MAGIC   = "IKUM"
+	kMODEL_VERSION = 1
 )
 
+// The alphabet of all 256 byte values in sorted order (0x00 --> 0xff)
 func DefaultAlphabet() []byte {
-	a := make([]byte, 0)
-	for i := 0; i < kDEFAULT_ALPHABET_LEN; i++ {
+	return makeAlphabet(kDEFAULT_ALPHABET_LEN)
+}
+
+// The 7-bit ASCII alphabet in sorted order (0x00 --> 0x7f).
+// Kept around so that packets encoded against the original 128 symbol
+// alphabet can still be decoded.
+func ASCIIAlphabet() []byte {
+	return makeAlphabet(kASCII_ALPHABET_LEN)
+}
+
+func makeAlphabet(n int) []byte {
+	a := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
 		a = append(a, byte(i))
 	}
 	return a
 }
 
+// The default model covers every byte value so that any payload can be
+// encoded with it.
 func DefaultModel() *Model {
-	src := []byte(typicalDefaultText)
-	for i := 0; i < kDEFAULT_ALPHABET_LEN; i++ {
-		src = append(src, byte(i))
+	return defaultModelFromLengths(kDEFAULT_MODEL_LENGTHS[:])
+}
+
+// The model used before the alphabet was extended to 256 symbols. It only
+// has patterns for the 7-bit ASCII characters.
+func ASCIIModel() *Model {
+	return defaultModelFromLengths(kASCII_MODEL_LENGTHS[:])
+}
+
+func defaultModelFromLengths(table []uint8) *Model {
+	lengths := make(map[Symbol]uint)
+	for symbol, l := range table {
+		lengths[Symbol(symbol)] = uint(l)
 	}
-	m, err := CreateModelFromText(src)
+	m := &Model{}
+	err := m.resetFromLengths(lengths, 0)
 	if err != nil {
 		log.Fatalf("Failed to create the default model")
 	}
@@ -49,19 +99,129 @@ func CreateModelFromText(src []byte) (*Model, error) {
 	return m, nil
 }
 
+// Create a model from the text with an ESCAPE symbol counted escapeCount
+// times, see ResetWithEscape.
+func CreateModelWithEscape(src []byte, escapeCount uint64) (*Model, error) {
+	m := &Model{}
+	freqDict := BuildFrequencyDict(src)
+	err := m.ResetWithEscape(freqDict, escapeCount)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create a model from the text with an EOB symbol, see ResetWithEOB.
+func CreateModelWithEOB(src []byte) (*Model, error) {
+	m := &Model{}
+	freqDict := BuildFrequencyDict(src)
+	err := m.ResetWithEOB(freqDict)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create a model from the text where no pattern is longer than maxLen bits.
+func CreateModelWithMaxLen(src []byte, maxLen uint) (*Model, error) {
+	m := &Model{}
+	freqDict := BuildFrequencyDict(src)
+	err := m.ResetWithMaxLen(freqDict, maxLen)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (this *Model) Reset(freqDict map[byte]*Freq) error {
-	var err error
-	// this.freqDict = freqDict
-	tree, err := buildHuffmanTree(freqDict)
+	return this.resetFromCounts(symbolCounts(freqDict))
+}
+
+// Rebuild the model from the frequencies with an ESCAPE symbol counted
+// escapeCount times, so bytes missing from the freqDict can still be
+// written. A higher count makes escaped bytes cheaper at the cost of the
+// patterns of the other symbols.
+func (this *Model) ResetWithEscape(freqDict map[byte]*Freq, escapeCount uint64) error {
+	if escapeCount == 0 {
+		return errors.New("Escape count must be at least 1")
+	}
+	counts := symbolCounts(freqDict)
+	counts[ESCAPE] = escapeCount
+	return this.resetFromCounts(counts)
+}
+
+// Rebuild the model from the frequencies with an EOB symbol, which is
+// written once at the end of every stream so it is counted once.
+func (this *Model) ResetWithEOB(freqDict map[byte]*Freq) error {
+	counts := symbolCounts(freqDict)
+	counts[EOB] = 1
+	return this.resetFromCounts(counts)
+}
+
+func (this *Model) resetFromCounts(counts map[Symbol]uint64) error {
+	tree, err := buildSymbolHuffmanTree(counts)
 	if err != nil {
 		return err
 	}
-	patternDict, err := buildPatternDict(tree)
+
+	lengths := treeCodeLengths(tree)
+	for _, l := range lengths {
+		if l > kMAX_PATTERN_LEN {
+			// A very skewed dict can make patterns too long to fit in a
+			// ByteSeq. Fall back to the best code which does fit.
+			return this.resetLimited(counts, kMAX_PATTERN_LEN, 0)
+		}
+	}
+	return this.resetFromLengths(lengths, 0)
+}
+
+// Rebuild the model from the frequencies using the minimum-redundancy code
+// where no pattern is longer than maxLen bits. The limit is kept with the
+// model and recorded by MarshalModel.
+func (this *Model) ResetWithMaxLen(freqDict map[byte]*Freq, maxLen uint) error {
+	return this.resetWithMaxLen(symbolCounts(freqDict), maxLen)
+}
+
+func (this *Model) resetWithMaxLen(counts map[Symbol]uint64, maxLen uint) error {
+	if maxLen == 0 || maxLen > kMAX_PATTERN_LEN {
+		return fmt.Errorf("Max pattern length must be between 1 and %d, got %d",
+			kMAX_PATTERN_LEN, maxLen)
+	}
+	return this.resetLimited(counts, maxLen, maxLen)
+}
+
+func (this *Model) resetLimited(counts map[Symbol]uint64, limit uint, maxLen uint) error {
+	sortedKeys := make(symbolFreqPairSlice, 0)
+	for k, v := range counts {
+		sortedKeys = append(sortedKeys, symbolFreqPair{k, Freq{v, 0, 0}})
+	}
+	sort.Stable(sortedKeys)
+
+	weights := make([]uint64, len(sortedKeys))
+	for i := 0; i < len(sortedKeys); i++ {
+		weights[i] = sortedKeys[i].freq.Nume
+	}
+	codeLengths, err := limitedCodeLengths(weights, limit)
 	if err != nil {
 		return err
 	}
 
-	// Create the pattern dict and huffman tree to be canonical
+	lengths := make(map[Symbol]uint)
+	for i := 0; i < len(sortedKeys); i++ {
+		lengths[sortedKeys[i].symbol] = codeLengths[i]
+	}
+	return this.resetFromLengths(lengths, maxLen)
+}
+
+// Create the canonical pattern dict and huffman tree from the length of each
+// symbol's pattern.
+func (this *Model) resetFromLengths(lengths map[Symbol]uint, maxLen uint) error {
+	patternDict := make(map[Symbol]ByteSeq)
+	for k, v := range lengths {
+		patternDict[k] = ByteSeq{0, v}
+	}
+
+	var err error
 	this.patternDict, err = canonicalCodebook(patternDict)
 	if err != nil {
 		return err
@@ -70,9 +230,15 @@ func (this *Model) Reset(freqDict map[byte]*Freq) error {
 	if err != nil {
 		return err
 	}
+	this.maxLen = maxLen
 	return nil
 }
 
+// The longest pattern allowed in this model, or 0 if there is no limit.
+func (this *Model) MaxLen() uint {
+	return this.maxLen
+}
+
 func (this *Model) String() string {
 	// we want it to appear in sorted order (first by len, the by symbol order)
 	ps := make(symbolByteSeqPairLenNameSort, 0)
@@ -89,63 +255,252 @@ func (this *Model) String() string {
 }
 
 func (this *Model) GetPattern(symbol byte) (ByteSeq, error) {
-	_, ok := this.patternDict[symbol]
+	return this.GetSymbolPattern(Symbol(symbol))
+}
+
+// True if the model has an ESCAPE pattern for bytes which are not in it.
+func (this *Model) HasEscape() bool {
+	_, ok := this.patternDict[ESCAPE]
+	return ok
+}
+
+// True if the model has an EOB pattern to end its streams with.
+func (this *Model) HasEOB() bool {
+	_, ok := this.patternDict[EOB]
+	return ok
+}
+
+// Like GetPattern but also finds the patterns of symbols past the bytes, such
+// as EOS.
+func (this *Model) GetSymbolPattern(symbol Symbol) (ByteSeq, error) {
+	s, ok := this.patternDict[symbol]
 	if !ok {
-		return ByteSeq{}, errors.New(fmt.Sprintf("Failed to find symbold %v in dict", symbol))
+		return ByteSeq{}, &SymbolError{symbol, -1, ErrSymbolNotInModel}
 	}
-	s, _ := this.patternDict[symbol]
 	return s, nil
 }
 
-// Write out the canonical versin of this model
-// 1. Sort by the alphabet
-// 2. Sort by the length of the pattern
-// 3. Write out as uint32 the length of the patterns in this order
-func (this *Model) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer([]byte{})
-
-	// 1,2 sort the model
-	ps := make(symbolByteSeqPairNameLenSort, 0)
+// Write out the pattern lengths of every symbol of the model, including the
+// ones past the bytes such as ESCAPE, along with its max pattern length. The
+// inverse of UnmarshalModel. The HuffmanTree of a packet is written with
+// MarshalAlphabet instead.
+//  1. kMODEL_MAGIC, 4 bytes
+//  2. kMODEL_VERSION, 1 byte
+//  3. The max pattern length, 1 byte, 0 if there is no limit
+//  4. The number of symbols N, LittleEndian uint16
+//  5. N times, in the order of their patterns, the symbol as a LittleEndian
+//     uint16 followed by the length of its pattern, 1 byte
+//
+// The patterns are given out in that order as by canonicalCodebook, so a
+// model whose symbols of the same length are not in symbol order, like a
+// JPEG model, comes back unchanged.
+func (this *Model) MarshalModel() ([]byte, error) {
+	ps := make(symbolByteSeqPairPatternSort, 0)
 	for k, v := range this.patternDict {
 		ps = append(ps, symbolByteSeqPair{k, v})
 	}
-	sort.Stable(ps)
+	sort.Sort(ps)
 
+	buf := bytes.NewBuffer([]byte{})
+	buf.WriteString(kMODEL_MAGIC)
+	buf.WriteByte(kMODEL_VERSION)
+	buf.WriteByte(uint8(this.maxLen))
+	binary.Write(buf, binary.LittleEndian, uint16(len(ps)))
 	for i := 0; i < len(ps); i++ {
-		binary.Write(buf, binary.LittleEndian, uint8(ps[i].byteSeq.Len))
+		binary.Write(buf, binary.LittleEndian, uint16(ps[i].symbol))
+		buf.WriteByte(uint8(ps[i].byteSeq.Len))
+	}
+	return buf.Bytes(), nil
+}
+
+// True if p starts like the output of MarshalModel rather than a list of
+// lengths for an alphabet, whose bytes are never over kMAX_PATTERN_LEN.
+func IsMarshalledModel(p []byte) bool {
+	return bytes.HasPrefix(p, []byte(kMODEL_MAGIC))
+}
+
+// Rebuild the model written by MarshalModel. The code does not need to be
+// complete, as the JPEG ones are not, see Validate.
+func (this *Model) UnmarshalModel(p []byte) error {
+	if !IsMarshalledModel(p) {
+		return fmt.Errorf("%w, it does not start with %q", ErrInvalidModel, kMODEL_MAGIC)
+	}
+	p = p[len(kMODEL_MAGIC):]
+	if len(p) < 4 {
+		return fmt.Errorf("%w, the model is truncated", ErrInvalidModel)
+	}
+	if p[0] != kMODEL_VERSION {
+		return fmt.Errorf("%w, unknown model version %d", ErrInvalidModel, p[0])
+	}
+	maxLen := uint(p[1])
+	if maxLen > kMAX_PATTERN_LEN {
+		return fmt.Errorf("%w, max pattern length %d is longer than %d bits",
+			ErrInvalidModel, maxLen, kMAX_PATTERN_LEN)
+	}
+	n := int(binary.LittleEndian.Uint16(p[2:]))
+	p = p[4:]
+	if len(p) != 3*n {
+		return fmt.Errorf("%w, %d bytes for %d symbols", ErrInvalidModel, len(p), n)
+	}
+
+	if n == 0 {
+		return ErrNoSymbols
+	}
+	ps := make([]symbolByteSeqPair, n)
+	lengths := make(map[Symbol]ByteSeq)
+	for i := range ps {
+		symbol := Symbol(binary.LittleEndian.Uint16(p[3*i:]))
+		l := uint(p[3*i+2])
+		if l == 0 || l > kMAX_PATTERN_LEN || (maxLen > 0 && l > maxLen) {
+			return fmt.Errorf("%w, invalid pattern length %d for symbol %#x", ErrInvalidModel, l, symbol)
+		}
+		if i > 0 && l < ps[i-1].byteSeq.Len {
+			return fmt.Errorf("%w, symbol %#x is out of order", ErrInvalidModel, symbol)
+		}
+		if _, ok := lengths[symbol]; ok {
+			return fmt.Errorf("%w, symbol %#x appears more than once", ErrInvalidModel, symbol)
+		}
+		ps[i] = symbolByteSeqPair{symbol, ByteSeq{0, l}}
+		lengths[symbol] = ps[i].byteSeq
+	}
+	err := checkKraft(lengths, false)
+	if err != nil {
+		return err
 	}
 
+	patternDict := sequentialCodebook(ps)
+	tree, err := canonicalHuffmanTree(patternDict)
+	if err != nil {
+		return err
+	}
+	this.tree = tree
+	this.patternDict = patternDict
+	this.maxLen = maxLen
+	return nil
+}
+
+// Write out the length of the pattern for every symbol in the alphabet, in
+// the order of the alphabet. Symbols which are not in this model are written
+// with a length of 0. This is the inverse of UnmarshalBinary. Fails with a
+// SymbolError of ErrSymbolNotInAlphabet if the model has a symbol outside of
+// the alphabet, such as ESCAPE.
+func (this *Model) MarshalAlphabet(alphabet []byte) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	numFound := 0
+	for i := 0; i < len(alphabet); i++ {
+		seq, ok := this.patternDict[Symbol(alphabet[i])]
+		if ok {
+			numFound += 1
+		}
+		binary.Write(buf, binary.LittleEndian, uint8(seq.Len))
+	}
+
+	if numFound != len(this.patternDict) {
+		// Report the smallest symbol missing from the alphabet, so the error
+		// does not depend on the order of the map
+		inAlphabet := make(map[Symbol]bool)
+		for _, b := range alphabet {
+			inAlphabet[Symbol(b)] = true
+		}
+		missing := Symbol(0)
+		found := false
+		for symbol := range this.patternDict {
+			if !inAlphabet[symbol] && (!found || symbol < missing) {
+				missing = symbol
+				found = true
+			}
+		}
+		return nil, &SymbolError{missing, -1, ErrSymbolNotInAlphabet}
+	}
 	return buf.Bytes(), nil
 }
 
+// Rebuild the model from the list of pattern lengths for each symbol in
+// the alphabet, the output of MarshalAlphabet. A length of 0 means the symbol
+// is not part of the model. Use UnmarshalModel for the output of
+// MarshalModel.
 func (this *Model) UnmarshalBinary(alphabet []byte, p []byte) error {
-	buf := bytes.NewBuffer(p)
-	if buf.Len() != len(alphabet) {
-		return fmt.Errorf(`Number of uint8 in buffer (%d) does not match the 
-expected number of symbols in our alphabet (%d)`, buf.Len()/4, len(alphabet))
+	if len(p) != len(alphabet) {
+		return fmt.Errorf("%w, it has %d lengths for an alphabet of %d symbols",
+			ErrInvalidModel, len(p), len(alphabet))
 	}
 
-	patternDict := make(map[byte]ByteSeq)
+	lengths := make(map[Symbol]uint)
 	for i := 0; i < len(alphabet); i++ {
-		var num uint8
-		err := binary.Read(buf, binary.LittleEndian, &num)
-		if err != nil {
-			return err
+		if p[i] == 0 {
+			continue
+		}
+		if p[i] > kMAX_PATTERN_LEN {
+			return fmt.Errorf("%w, pattern length %d for symbol %#x is longer than %d bits",
+				ErrInvalidModel, p[i], alphabet[i], kMAX_PATTERN_LEN)
 		}
-		patternDict[alphabet[i]] = ByteSeq{0, uint(num)}
+		lengths[Symbol(alphabet[i])] = uint(p[i])
 	}
+	return this.resetFromValidLengths(lengths, 0)
+}
 
-	// fill in the pattern dict and tree
-	var err error
-	this.patternDict, err = canonicalCodebook(patternDict)
-	if err != nil {
-		return err
+// Like resetFromLengths but for lengths read from outside, which must make
+// a complete code.
+func (this *Model) resetFromValidLengths(lengths map[Symbol]uint, maxLen uint) error {
+	if len(lengths) == 0 {
+		return ErrNoSymbols
 	}
-	this.tree, err = canonicalHuffmanTree(this.patternDict)
+	patternDict := make(map[Symbol]ByteSeq)
+	for k, v := range lengths {
+		patternDict[k] = ByteSeq{0, v}
+	}
+	err := checkKraft(patternDict, true)
 	if err != nil {
 		return err
 	}
+	return this.resetFromLengths(lengths, maxLen)
+}
 
+// Check that the model is a complete prefix code, one which UnmarshalBinary
+// would accept. Fails with ErrInvalidModel otherwise, e.g. for the JPEG
+// models.
+func (this *Model) Validate() error {
+	if len(this.patternDict) == 0 {
+		return ErrNoSymbols
+	}
+	return checkKraft(this.patternDict, true)
+}
+
+// Check that the pattern lengths make a complete prefix code, one where the
+// sum of 2^-length over the symbols (the Kraft sum) is exactly 1. Longer
+// lengths would give some symbols the same pattern, shorter ones leave
+// patterns which decode to nothing. The only incomplete code allowed is a
+// single symbol with a pattern of 1 bit, unless complete is false, which
+// allows unused patterns like those of the JPEG codes.
+func checkKraft(patternDict map[Symbol]ByteSeq, complete bool) error {
+	var counts [kMAX_PATTERN_LEN + 1]int
+	for _, seq := range patternDict {
+		counts[seq.Len] += 1
+	}
+	if len(patternDict) == 1 && counts[1] == 1 {
+		return nil
+	}
+
+	// The number of patterns of each length which are still free, and the
+	// symbols left to take them. More free patterns than symbols can never
+	// be filled, which also keeps the count from overflowing.
+	free := 1
+	remaining := len(patternDict)
+	for l := 1; l <= kMAX_PATTERN_LEN; l++ {
+		free = free*2 - counts[l]
+		remaining -= counts[l]
+		if free < 0 {
+			return fmt.Errorf("%w, the pattern lengths have more symbols of %d bits than there are patterns",
+				ErrInvalidModel, l)
+		}
+		if free > remaining {
+			if !complete {
+				// The rest of the symbols all fit
+				return nil
+			}
+			return fmt.Errorf("%w, the pattern lengths do not make a complete code", ErrInvalidModel)
+		}
+	}
 	return nil
 }
 
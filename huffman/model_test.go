@@ -1,6 +1,9 @@
 package huffman
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"sort"
 	"testing"
 )
@@ -58,19 +61,86 @@ func TestModel_TestSort(t *testing.T) {
 	sort.Stable(symbolByteSeqPairLenNameSort(ps))
 }
 
-func TestModel_MarhsalBinary(t *testing.T) {
+// Check that the model comes back unchanged from MarshalModel
+func checkMarshalModel(t *testing.T, name string, m *Model) {
+	b, err := m.MarshalModel()
+	if err != nil {
+		t.Fatalf("%s: failed to marshal model to binary format %v", name, err)
+	}
+	if len(b) != 8+3*len(m.patternDict) {
+		t.Errorf("%s: expected %d bytes for %d symbols, got %d", name, 8+3*len(m.patternDict), len(m.patternDict), len(b))
+	}
+	m2 := &Model{}
+	err = m2.UnmarshalModel(b)
+	if err != nil {
+		t.Fatalf("%s: failed to unmarshal model %v", name, err)
+	}
+	if m2.MaxLen() != m.MaxLen() {
+		t.Errorf("%s: max len is %d, want %d", name, m2.MaxLen(), m.MaxLen())
+	}
+	if len(m2.patternDict) != len(m.patternDict) {
+		t.Errorf("%s: expected %d symbols but got %d", name, len(m.patternDict), len(m2.patternDict))
+	}
+	for k, v := range m.patternDict {
+		if m2.patternDict[k] != v {
+			t.Errorf("%s: pattern for %#x does not match. got %v, want %v", name, k, m2.patternDict[k], v)
+		}
+	}
+}
+
+func TestModel_MarshalModel(t *testing.T) {
 	src := []byte(modelTestText)
-	m, err := CreateModelFromText(src)
+	partial, err := CreateModelFromText(src)
 	if err != nil {
-		t.Errorf("Failed to create a basic model from the text")
+		t.Fatal(err)
+	}
+	limited, err := CreateModelWithMaxLen(src, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escape, err := CreateModelWithEscape(src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trainer := NewTrainer()
+	trainer.SetEscape(1)
+	trainer.SetEOB(true)
+	trainer.Write(src)
+	extra, err := trainer.ModelWithMaxLen(20)
+	if err != nil {
+		t.Fatal(err)
 	}
+	single, err := CreateModelFromText([]byte("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMarshalModel(t, "partial", partial)
+	checkMarshalModel(t, "limited", limited)
+	checkMarshalModel(t, "escape", escape)
+	checkMarshalModel(t, "escape and eob", extra)
+	checkMarshalModel(t, "single", single)
+	checkMarshalModel(t, "default", DefaultModel())
+	checkMarshalModel(t, "hpack", HPACKModel())
 
-	b, err := m.MarshalBinary()
+	b, err := partial.MarshalModel()
 	if err != nil {
-		t.Errorf("Failed to marshal model to binary format %v", err)
+		t.Fatal(err)
 	}
-	if len(b) != 6 {
-		t.Errorf("Not enough numbers %v", len(b))
+	// The first two symbols are the same
+	dup := append([]byte{}, b...)
+	copy(dup[11:13], dup[8:10])
+	for _, broken := range [][]byte{
+		nil,
+		dup,
+		b[:len(b)-1],
+		append(append([]byte{}, b...), 0),
+		// A list of lengths for an alphabet
+		b[8:],
+	} {
+		if err := (&Model{}).UnmarshalModel(broken); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("Expected ErrInvalidModel for %v, got %v", broken, err)
+		}
 	}
 }
 
@@ -94,15 +164,15 @@ func TestModel_UnmarhsalBinary(t *testing.T) {
 			len(m.patternDict))
 	}
 	for i := 0; i < len(alphabet); i++ {
-		if m.patternDict[alphabet[i]].Len != uint(binary[i]) {
+		if m.patternDict[Symbol(alphabet[i])].Len != uint(binary[i]) {
 			t.Errorf("Symbol %c is pattern dict does not have the correct length. got %d, want %d",
-				alphabet[i], m.patternDict[alphabet[i]].Len, uint(binary[i]))
+				alphabet[i], m.patternDict[Symbol(alphabet[i])].Len, uint(binary[i]))
 		}
 	}
 
 	symbols := make([]byte, 0)
 	m.tree.InOrderTraversal(func(n *Node) {
-		symbols = append(symbols, n.symbol)
+		symbols = append(symbols, byte(n.symbol))
 	})
 	for i := 0; i < len(alphabet); i++ {
 		found := false
@@ -117,3 +187,347 @@ func TestModel_UnmarhsalBinary(t *testing.T) {
 		}
 	}
 }
+
+func TestModel_DefaultModelCoversAllBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		m        *Model
+		alphabet []byte
+	}{
+		{"DefaultModel", DefaultModel(), DefaultAlphabet()},
+		{"ASCIIModel", ASCIIModel(), ASCIIAlphabet()},
+	} {
+		if len(tc.m.patternDict) != len(tc.alphabet) {
+			t.Errorf("%s has %d symbols but the alphabet has %d",
+				tc.name, len(tc.m.patternDict), len(tc.alphabet))
+		}
+		for _, b := range tc.alphabet {
+			if _, err := tc.m.GetPattern(b); err != nil {
+				t.Errorf("%s is missing a pattern for %#x", tc.name, b)
+			}
+		}
+	}
+
+	if _, err := ASCIIModel().GetPattern(0x80); err == nil {
+		t.Errorf("ASCIIModel should not have a pattern for 0x80")
+	}
+}
+
+func TestModel_MarshalAlphabet(t *testing.T) {
+	m, err := CreateModelFromText([]byte(modelTestText))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alphabet := DefaultAlphabet()
+	b, err := m.MarshalAlphabet(alphabet)
+	if err != nil {
+		t.Fatalf("Failed to marshal model %v", err)
+	}
+	if len(b) != len(alphabet) {
+		t.Errorf("Expected %d lengths but got %d", len(alphabet), len(b))
+	}
+	if b[0] != 0 || b['A'] == 0 {
+		t.Errorf("Lengths do not match the symbols in the model")
+	}
+
+	m2 := &Model{}
+	err = m2.UnmarshalBinary(alphabet, b)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal model %v", err)
+	}
+	if len(m2.patternDict) != len(m.patternDict) {
+		t.Errorf("Expected %d symbols but got %d",
+			len(m.patternDict), len(m2.patternDict))
+	}
+	for k, v := range m.patternDict {
+		if m2.patternDict[k] != v {
+			t.Errorf("Pattern for %c does not match. got %v, want %v",
+				k, m2.patternDict[k], v)
+		}
+	}
+
+	_, err = m.MarshalAlphabet([]byte("ABC"))
+	var serr *SymbolError
+	if !errors.As(err, &serr) || serr.Symbol != 'D' || !errors.Is(err, ErrSymbolNotInAlphabet) {
+		t.Errorf("Expected a SymbolError for 'D' outside the alphabet, got %v", err)
+	}
+
+	// ESCAPE is never in a byte alphabet
+	escape, err := CreateModelWithEscape([]byte(modelTestText), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = escape.MarshalAlphabet(alphabet)
+	if !errors.As(err, &serr) || serr.Symbol != ESCAPE || !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected a SymbolError for ESCAPE, got %v", err)
+	}
+}
+
+func TestModel_UnmarshalBinaryKraft(t *testing.T) {
+	alphabet := []byte("abcd")
+	for _, test := range []struct {
+		lengths []byte
+		ok      bool
+	}{
+		{[]byte{1, 2, 3, 3}, true},
+		{[]byte{2, 2, 2, 2}, true},
+		{[]byte{1, 0, 0, 0}, true},
+		// Two 1 bit patterns do not leave room for the rest
+		{[]byte{1, 1, 2, 0}, false},
+		{[]byte{1, 2, 2, 2}, false},
+		// 11 and 111 decode to nothing
+		{[]byte{1, 2, 3, 0}, false},
+		{[]byte{2, 0, 0, 0}, false},
+		{[]byte{1, 2, 65, 0}, false},
+	} {
+		err := (&Model{}).UnmarshalBinary(alphabet, test.lengths)
+		if test.ok && err != nil {
+			t.Errorf("Lengths %v failed: %v", test.lengths, err)
+		}
+		if !test.ok && !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("Expected an invalid model error for lengths %v, got %v", test.lengths, err)
+		}
+	}
+
+	// Validate applies the same check to models which were built directly
+	if err := DefaultModel().Validate(); err != nil {
+		t.Errorf("Default model failed to validate: %v", err)
+	}
+	if err := JPEGLuminanceDCModel().Validate(); !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected the incomplete JPEG code to be invalid, got %v", err)
+	}
+	if err := (&Model{}).Validate(); err != ErrNoSymbols {
+		t.Errorf("Expected ErrNoSymbols for an empty model, got %v", err)
+	}
+}
+
+func TestModel_SingleSymbol(t *testing.T) {
+	m, err := CreateModelFromText([]byte("zzzz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetPattern('z')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len != 1 {
+		t.Errorf("A single symbol should have a 1 bit pattern, got %v", got)
+	}
+}
+
+func TestModel_CreateModelWithMaxLen(t *testing.T) {
+	src := make([]byte, 0)
+	for i, w := range fibonacciWeights(20) {
+		src = append(src, bytes.Repeat([]byte{byte('a' + i)}, int(w))...)
+	}
+
+	m, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := m.GetPattern('a'); seq.Len != 19 {
+		t.Fatalf("Expected the unlimited model to have a 19 bit pattern, got %d", seq.Len)
+	}
+
+	limited, err := CreateModelWithMaxLen(src, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited.MaxLen() != 12 {
+		t.Errorf("Expected a max len of 12, got %d", limited.MaxLen())
+	}
+	for k, v := range limited.patternDict {
+		if v.Len > 12 {
+			t.Errorf("Pattern for %c is %d bits, over the limit", k, v.Len)
+		}
+	}
+	compareReaders(t, limited, src)
+
+	if _, err := CreateModelWithMaxLen(src, 4); err == nil {
+		t.Errorf("Expected an error when 20 symbols can't fit in 4 bits")
+	}
+	if _, err := CreateModelWithMaxLen(src, 65); err == nil {
+		t.Errorf("Expected an error for a limit longer than a ByteSeq")
+	}
+}
+
+func TestModel_MarshalModelMaxLen(t *testing.T) {
+	m, err := CreateModelWithMaxLen([]byte(modelTestText), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.MarshalModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[5] != 3 || b[6] != 6 || b[7] != 0 {
+		t.Fatalf("Expected the limit of 3 and 6 symbols, got %v", b)
+	}
+
+	m2 := &Model{}
+	err = m2.UnmarshalModel(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.MaxLen() != 3 {
+		t.Errorf("Limit was not read back, got %d", m2.MaxLen())
+	}
+
+	// A length over the recorded limit is rejected, the first symbol's length
+	// is the 11th byte
+	b[10] = 4
+	if err := m2.UnmarshalModel(b); !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected an error for a length over the limit, got %v", err)
+	}
+
+	// Lists of lengths never have a limit, an extra byte is an error
+	lengths, err := m.MarshalAlphabet([]byte("ABCDE_"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.UnmarshalBinary([]byte("ABCDE_"), append(lengths, 3)); !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected an error for a trailing byte, got %v", err)
+	}
+}
+
+func TestModel_ResetTooDeepForByteSeq(t *testing.T) {
+	// 80 fibonacci weights would make a tree 79 levels deep
+	dict := make(map[byte]*Freq)
+	for i, w := range fibonacciWeights(80) {
+		dict[byte(i)] = &Freq{w, 0, float64(w)}
+	}
+	m := &Model{}
+	err := m.Reset(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range m.patternDict {
+		if v.Len > kMAX_PATTERN_LEN {
+			t.Errorf("Pattern for %#x is %d bits, longer than a ByteSeq", k, v.Len)
+		}
+	}
+}
+
+func TestModel_Escape(t *testing.T) {
+	m, err := CreateModelWithEscape([]byte(modelTestText), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasEscape() {
+		t.Fatalf("Model does not have an ESCAPE pattern")
+	}
+	if _, err := m.GetPattern('z'); err == nil {
+		t.Errorf("Expected 'z' to not have a pattern")
+	}
+
+	// Bytes missing from the model, including at the start and end
+	src := append([]byte("zA_DEAD\x00_DAD\xff"), []byte(modelTestText)...)
+	src = append(src, 'q')
+	compareReaders(t, m, src)
+
+	// A model without ESCAPE still fails on the missing byte
+	plain, err := CreateModelFromText([]byte(modelTestText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := NewWriter(bytes.NewBuffer([]byte{}), plain)
+	if _, err := w.Write([]byte("z")); err == nil {
+		t.Errorf("Expected an error writing a byte which is not in the model")
+	}
+	if _, err := CreateModelWithEscape([]byte(modelTestText), 0); err == nil {
+		t.Errorf("Expected an error for an escape count of 0")
+	}
+}
+
+func TestModel_EscapeCost(t *testing.T) {
+	src := []byte(modelTestText)
+	escapeLen := func(count uint64) uint {
+		m, err := CreateModelWithEscape(src, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, err := m.GetSymbolPattern(ESCAPE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seq.Len
+	}
+	// A higher count makes the escape cheaper
+	if cheap, dear := escapeLen(uint64(len(src))), escapeLen(1); cheap >= dear {
+		t.Errorf("ESCAPE is %d bits with a high count and %d with a count of 1", cheap, dear)
+	}
+}
+
+func TestModel_EOB(t *testing.T) {
+	m, err := CreateModelWithEOB([]byte(modelTestText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasEOB() || m.HasEscape() {
+		t.Fatalf("Model should have an EOB pattern and no ESCAPE pattern")
+	}
+
+	readers := map[string]func(r io.Reader) (io.Reader, error){
+		"Reader": func(r io.Reader) (io.Reader, error) {
+			return NewReader(r, m)
+		},
+		"TableReader": func(r io.Reader) (io.Reader, error) {
+			return NewTableReader(r, m)
+		},
+	}
+
+	// Each stream ends with EOB, and is followed by data which must not be
+	// read
+	for _, src := range []string{"", "A", modelTestText} {
+		encoded := bytes.NewBuffer([]byte{})
+		w, _ := NewWriter(encoded, m)
+		w.Write([]byte(src))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		stream := append(encoded.Bytes(), "after"...)
+
+		for name, newReader := range readers {
+			rest := bytes.NewReader(stream)
+			r, err := newReader(rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := bytes.NewBuffer([]byte{})
+			if _, err := got.ReadFrom(r); err != nil {
+				t.Fatalf("%s failed to read up to EOB: %v", name, err)
+			}
+			if got.String() != src {
+				t.Errorf("%s decoded %q, want %q", name, got.String(), src)
+			}
+			if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("%s read %d bytes and %v after EOB, want io.EOF", name, n, err)
+			}
+			if name == "TableReader" && rest.Len() != len("after") {
+				t.Errorf("%s read %d bytes past the end of the stream", name, len("after")-rest.Len())
+			}
+		}
+	}
+
+	// Set bits after EOB are not padding
+	eob, _ := m.GetSymbolPattern(EOB)
+	buf := bytes.NewBuffer([]byte{})
+	w, _ := NewByteSeqWriter(buf)
+	w.Write(eob)
+	w.Write(ByteSeq{1, 1})
+	w.Flush()
+	if eob.Len%8 == 0 {
+		t.Fatalf("EOB fills a whole byte, there is no padding to test")
+	}
+	for name, newReader := range readers {
+		r, err := newReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Read(make([]byte, 1))
+		if !errors.Is(err, ErrInvalidPadding) {
+			t.Errorf("%s: expected ErrInvalidPadding after EOB, got %v", name, err)
+		}
+	}
+}
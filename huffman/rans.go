@@ -0,0 +1,325 @@
+package huffman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+)
+
+const (
+	// The frequencies of a RANSModel add up to 1 << kRANS_PROB_BITS
+	kRANS_PROB_BITS  = 15
+	kRANS_PROB_SCALE = 1 << kRANS_PROB_BITS
+	// The coder state is kept in [kRANS_LOWER_BOUND, kRANS_LOWER_BOUND << 8)
+	// and moves a byte at a time in and out of the stream.
+	kRANS_LOWER_BOUND = 1 << 23
+	// The final state is written before the bytes of the symbols
+	kRANS_STATE_LEN = 4
+)
+
+// RANSModel is a range asymmetric numeral system (rANS) Coder. Each symbol
+// gets a frequency out of 1 << 15 instead of a pattern. Huffman spends at
+// least one bit on every symbol while rANS spends close to -log2(p) bits, so
+// it does much better on very skewed payloads such as sensor booleans.
+type RANSModel struct {
+	// The scaled frequency of each symbol, 0 if it is not in the model
+	freqs [kDEFAULT_ALPHABET_LEN]uint32
+	// The sum of the frequencies of the symbols before each symbol
+	starts [kDEFAULT_ALPHABET_LEN]uint32
+	// The symbol which owns each of the kRANS_PROB_SCALE slots
+	slots []byte
+}
+
+// The rANS version of DefaultModel. Each symbol is given a frequency in
+// proportion to 2^-length of its pattern in DefaultModel.
+func DefaultRANSModel() *RANSModel {
+	var counts [kDEFAULT_ALPHABET_LEN]uint64
+	for symbol, l := range kDEFAULT_MODEL_LENGTHS {
+		counts[symbol] = 1 << (32 - uint(l))
+	}
+	m := &RANSModel{}
+	err := m.resetFromCounts(counts)
+	if err != nil {
+		log.Fatalf("Failed to create the default rANS model")
+	}
+	return m
+}
+
+func CreateRANSModelFromText(src []byte) (*RANSModel, error) {
+	m := &RANSModel{}
+	err := m.Reset(BuildFrequencyDict(src))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Rebuild the model from the counts (Nume) of the symbols.
+func (this *RANSModel) Reset(freqDict map[byte]*Freq) error {
+	var counts [kDEFAULT_ALPHABET_LEN]uint64
+	for symbol, f := range freqDict {
+		counts[symbol] = f.Nume
+	}
+	return this.resetFromCounts(counts)
+}
+
+// Scale the counts so they add up to kRANS_PROB_SCALE. Every symbol which was
+// counted keeps a frequency of at least 1. The rounding error is taken from
+// the symbol with the highest frequency, or given to the symbol with the
+// highest count, ties going to the lower symbol.
+func (this *RANSModel) resetFromCounts(counts [kDEFAULT_ALPHABET_LEN]uint64) error {
+	total := uint64(0)
+	for _, c := range counts {
+		var carry uint64
+		total, carry = bits.Add64(total, c, 0)
+		if carry != 0 {
+			return errors.New("Sum of the symbol counts overflows a uint64")
+		}
+	}
+	if total == 0 {
+		return ErrNoSymbols
+	}
+
+	var freqs [kDEFAULT_ALPHABET_LEN]uint32
+	sum := uint32(0)
+	largest := 0
+	for symbol, c := range counts {
+		if c == 0 {
+			continue
+		}
+		hi, lo := bits.Mul64(c, kRANS_PROB_SCALE)
+		f, _ := bits.Div64(hi, lo, total)
+		if f == 0 {
+			f = 1
+		}
+		freqs[symbol] = uint32(f)
+		sum += uint32(f)
+		if c > counts[largest] {
+			largest = symbol
+		}
+	}
+	for sum > kRANS_PROB_SCALE {
+		highest := 0
+		for symbol, f := range freqs {
+			if f > freqs[highest] {
+				highest = symbol
+			}
+		}
+		freqs[highest] -= 1
+		sum -= 1
+	}
+	freqs[largest] += kRANS_PROB_SCALE - sum
+	return this.resetFromFreqs(freqs)
+}
+
+// Fill in the starts and slots from frequencies which add up to
+// kRANS_PROB_SCALE.
+func (this *RANSModel) resetFromFreqs(freqs [kDEFAULT_ALPHABET_LEN]uint32) error {
+	slots := make([]byte, 0, kRANS_PROB_SCALE)
+	var starts [kDEFAULT_ALPHABET_LEN]uint32
+	sum := uint32(0)
+	for symbol, f := range freqs {
+		starts[symbol] = sum
+		sum += f
+		if sum > kRANS_PROB_SCALE {
+			break
+		}
+		for i := uint32(0); i < f; i++ {
+			slots = append(slots, byte(symbol))
+		}
+	}
+	if sum != kRANS_PROB_SCALE {
+		return fmt.Errorf("%w, rANS frequencies must add up to %d", ErrInvalidModel, kRANS_PROB_SCALE)
+	}
+	this.freqs = freqs
+	this.starts = starts
+	this.slots = slots
+	return nil
+}
+
+// The scaled frequency of the symbol, out of 1 << 15.
+func (this *RANSModel) Freq(symbol byte) uint32 {
+	return this.freqs[symbol]
+}
+
+// Write out the frequency of every symbol in the alphabet as a LittleEndian
+// uint16, in the order of the alphabet. Symbols which are not in this model
+// are written as 0. The inverse of UnmarshalBinary.
+func (this *RANSModel) MarshalAlphabet(alphabet []byte) ([]byte, error) {
+	p := make([]byte, 2*len(alphabet))
+	sum := uint32(0)
+	for i, symbol := range alphabet {
+		binary.LittleEndian.PutUint16(p[2*i:], uint16(this.freqs[symbol]))
+		sum += this.freqs[symbol]
+	}
+	if sum != kRANS_PROB_SCALE {
+		inAlphabet := make(map[byte]bool)
+		for _, symbol := range alphabet {
+			inAlphabet[symbol] = true
+		}
+		for symbol, f := range this.freqs {
+			if f > 0 && !inAlphabet[byte(symbol)] {
+				return nil, &SymbolError{Symbol(symbol), -1, ErrSymbolNotInAlphabet}
+			}
+		}
+		return nil, ErrNoSymbols
+	}
+	return p, nil
+}
+
+// Rebuild the model from the frequency of each symbol in the alphabet.
+func (this *RANSModel) UnmarshalBinary(alphabet []byte, p []byte) error {
+	if len(p) != 2*len(alphabet) {
+		return fmt.Errorf("%w, rANS model must be %d bytes for %d symbols, got %d", ErrInvalidModel,
+			2*len(alphabet), len(alphabet), len(p))
+	}
+	var freqs [kDEFAULT_ALPHABET_LEN]uint32
+	for i, symbol := range alphabet {
+		freqs[symbol] = uint32(binary.LittleEndian.Uint16(p[2*i:]))
+	}
+	return this.resetFromFreqs(freqs)
+}
+
+func (this *RANSModel) NewSymbolWriter(w io.Writer) (io.WriteCloser, error) {
+	return &RANSWriter{w: w, m: this}, nil
+}
+
+func (this *RANSModel) NewSymbolReader(r io.Reader) (SymbolReader, error) {
+	if len(this.slots) != kRANS_PROB_SCALE {
+		return nil, ErrNoSymbols
+	}
+	rr := &RANSReader{m: this}
+	rr.Reset(r)
+	return rr, nil
+}
+
+// RANSWriter encodes symbols with a RANSModel. rANS encodes the symbols in
+// reverse, so they are held until Close, which writes the final state as a
+// LittleEndian uint32 followed by the bytes the decoder reads in order.
+// Nothing is written if there were no symbols.
+type RANSWriter struct {
+	w       io.Writer
+	m       *RANSModel
+	symbols []byte
+	// Number of symbols written before the buffered ones
+	written int64
+}
+
+func (this *RANSWriter) Write(p []byte) (int, error) {
+	for i, symbol := range p {
+		if this.m.freqs[symbol] == 0 {
+			index := this.written + int64(len(this.symbols))
+			return i, &SymbolError{Symbol(symbol), index, ErrSymbolNotInModel}
+		}
+		this.symbols = append(this.symbols, symbol)
+	}
+	return len(p), nil
+}
+
+func (this *RANSWriter) Close() error {
+	if len(this.symbols) == 0 {
+		return nil
+	}
+
+	// The bytes come out last first, they are reversed at the end
+	out := make([]byte, 0, len(this.symbols)/2+kRANS_STATE_LEN)
+	x := uint64(kRANS_LOWER_BOUND)
+	for i := len(this.symbols) - 1; i >= 0; i-- {
+		symbol := this.symbols[i]
+		f := uint64(this.m.freqs[symbol])
+		max := (kRANS_LOWER_BOUND >> kRANS_PROB_BITS << 8) * f
+		for x >= max {
+			out = append(out, byte(x))
+			x >>= 8
+		}
+		x = (x/f)<<kRANS_PROB_BITS + x%f + uint64(this.m.starts[symbol])
+	}
+
+	p := make([]byte, kRANS_STATE_LEN, kRANS_STATE_LEN+len(out))
+	binary.LittleEndian.PutUint32(p, uint32(x))
+	for i := len(out) - 1; i >= 0; i-- {
+		p = append(p, out[i])
+	}
+	this.written += int64(len(this.symbols))
+	this.symbols = this.symbols[:0]
+	_, err := this.w.Write(p)
+	return err
+}
+
+// RANSReader decodes symbols written by a RANSWriter. Bytes are only read as
+// the state needs them, so nothing past the last symbol is read.
+type RANSReader struct {
+	r       io.ByteReader
+	m       *RANSModel
+	x       uint32
+	started bool
+	// Bytes read and symbols decoded, for DecodeError
+	bytesRead uint64
+	symbols   int64
+}
+
+// Start reading a new stream with the same model.
+func (this *RANSReader) Reset(r io.Reader) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+	this.r = br
+	this.x = 0
+	this.started = false
+	this.bytesRead = 0
+	this.symbols = 0
+}
+
+// Check that the state is back where the writer started it. Decoding the
+// last symbol written undoes the first step of the writer, so anything else
+// means the stream was not all read or is corrupt.
+func (this *RANSReader) Finish() error {
+	if this.started && this.x != kRANS_LOWER_BOUND {
+		return &DecodeError{this.symbols, this.bytesRead * 8,
+			fmt.Errorf("%w, the rANS state did not end where it started", ErrInvalidCode)}
+	}
+	return nil
+}
+
+func (this *RANSReader) Read(p []byte) (int, error) {
+	if len(p) > 0 && !this.started {
+		for i := 0; i < kRANS_STATE_LEN; i++ {
+			b, err := this.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			this.x |= uint32(b) << (8 * uint(i))
+			this.bytesRead += 1
+		}
+		if this.x < kRANS_LOWER_BOUND {
+			return 0, &DecodeError{0, 0,
+				fmt.Errorf("%w, the rANS state is too small", ErrInvalidCode)}
+		}
+		if this.x >= kRANS_LOWER_BOUND<<8 {
+			return 0, &DecodeError{0, 0,
+				fmt.Errorf("%w, the rANS state is too large", ErrInvalidCode)}
+		}
+		this.started = true
+	}
+
+	for i := range p {
+		slot := this.x & (kRANS_PROB_SCALE - 1)
+		symbol := this.m.slots[slot]
+		this.x = this.m.freqs[symbol]*(this.x>>kRANS_PROB_BITS) + slot - this.m.starts[symbol]
+		for this.x < kRANS_LOWER_BOUND {
+			b, err := this.r.ReadByte()
+			if err != nil {
+				return i, err
+			}
+			this.x = this.x<<8 | uint32(b)
+			this.bytesRead += 1
+		}
+		p[i] = symbol
+		this.symbols += 1
+	}
+	return len(p), nil
+}
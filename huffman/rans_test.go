@@ -0,0 +1,184 @@
+package huffman
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func encodeWithCoder(t *testing.T, c Coder, p []byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	w, err := c.NewSymbolWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Skewed booleans, like a sensor which is nearly always off
+func sensorBooleans(n int) []byte {
+	rnd := rand.New(rand.NewSource(11))
+	p := make([]byte, n)
+	for i := range p {
+		if rnd.Intn(100) < 2 {
+			p[i] = 1
+		}
+	}
+	return p
+}
+
+func TestRANS_EncodeDecode(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(5)).Read(random)
+
+	for _, src := range [][]byte{
+		[]byte(loremText), []byte("a"), []byte("aaaaaaaa"), random, sensorBooleans(10000),
+	} {
+		m, err := CreateRANSModelFromText(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []Coder{m, DefaultRANSModel()} {
+			encoded := encodeWithCoder(t, c, src)
+
+			// Two streams back to back to check only the first is read
+			br := bytes.NewReader(append(encoded, encoded...))
+			r, err := c.NewSymbolReader(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				got := make([]byte, len(src))
+				_, err = io.ReadFull(r, got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Compare(src, got) != 0 {
+					t.Errorf("Failed to round trip %d bytes", len(src))
+				}
+				if err := r.Finish(); err != nil {
+					t.Errorf("Stream of %d bytes did not end cleanly: %v", len(src), err)
+				}
+				r.Reset(br)
+			}
+		}
+	}
+}
+
+func TestRANS_Empty(t *testing.T) {
+	if p := encodeWithCoder(t, DefaultRANSModel(), nil); len(p) != 0 {
+		t.Errorf("Empty payload was encoded to %d bytes", len(p))
+	}
+}
+
+func TestRANS_Skewed(t *testing.T) {
+	src := sensorBooleans(100000)
+	rm, err := CreateRANSModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hm, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rans := len(encodeWithCoder(t, rm, src))
+	huffman := len(encodeWithCoder(t, hm, src))
+	// Huffman needs a bit per symbol, the entropy is about 0.14 bits
+	if huffman < len(src)/8 || rans > len(src)/40 {
+		t.Errorf("Encoded to %d bytes with rANS and %d with huffman", rans, huffman)
+	}
+}
+
+func TestRANS_Frequencies(t *testing.T) {
+	// Lots of rare symbols which each need to be bumped up to 1
+	dict := make(map[byte]*Freq)
+	for i := 0; i < 256; i++ {
+		dict[byte(i)] = &Freq{1, 0, 0}
+	}
+	dict['a'] = &Freq{1 << 40, 0, 0}
+
+	m := &RANSModel{}
+	err := m.Reset(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := uint32(0)
+	for i := 0; i < 256; i++ {
+		if m.Freq(byte(i)) == 0 {
+			t.Errorf("Symbol %d lost its frequency", i)
+		}
+		sum += m.Freq(byte(i))
+	}
+	if sum != kRANS_PROB_SCALE || m.Freq('a') != kRANS_PROB_SCALE-255 {
+		t.Errorf("Frequencies add up to %d, 'a' has %d", sum, m.Freq('a'))
+	}
+
+	p, err := m.MarshalAlphabet(DefaultAlphabet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &RANSModel{}
+	err = other.UnmarshalBinary(DefaultAlphabet(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.freqs != m.freqs {
+		t.Errorf("Frequencies do not round trip")
+	}
+}
+
+func TestRANS_Errors(t *testing.T) {
+	m, err := CreateRANSModelFromText([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := m.NewSymbolWriter(ioutil.Discard)
+	if _, err := w.Write([]byte("abd")); err == nil {
+		t.Errorf("Expected an error writing a symbol which is not in the model")
+	}
+	if _, err := m.MarshalAlphabet([]byte("ab")); err == nil {
+		t.Errorf("Expected an error marshalling with symbols missing from the alphabet")
+	}
+	if err := m.UnmarshalBinary([]byte("ab"), []byte{1, 0, 1, 0}); err == nil {
+		t.Errorf("Expected an error for frequencies which do not add up")
+	}
+	if _, err := CreateRANSModelFromText(nil); err == nil {
+		t.Errorf("Expected an error for a model without symbols")
+	}
+
+	m, err = CreateRANSModelFromText([]byte(loremText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := encodeWithCoder(t, m, []byte(loremText[:100]))
+	r, _ := m.NewSymbolReader(bytes.NewReader(encoded))
+	io.ReadFull(r, make([]byte, 99))
+	if err := r.Finish(); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Expected an error finishing before the last symbol, got %v", err)
+	}
+	// The initial state must be in [kRANS_LOWER_BOUND, kRANS_LOWER_BOUND << 8)
+	for _, state := range [][]byte{{0xff, 0xff, 0x7f, 0x00}, {0x00, 0x00, 0x00, 0x80}, {0xff, 0xff, 0xff, 0xff}} {
+		r, _ := m.NewSymbolReader(bytes.NewReader(append(state, encoded[kRANS_STATE_LEN:]...)))
+		if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Expected ErrInvalidCode for the initial state %x, got %v", state, err)
+		}
+	}
+	for n := 0; n < len(encoded); n++ {
+		r, _ := m.NewSymbolReader(bytes.NewReader(encoded[:n]))
+		if _, err := io.ReadFull(r, make([]byte, 100)); err == nil {
+			t.Errorf("Expected an error reading %d of %d bytes", n, len(encoded))
+		}
+	}
+}
@@ -8,48 +8,112 @@ import (
 )
 
 type Reader struct {
-	r bitreader.Interface
+	r *countingBitReader
 	m *Model
+	// Number of symbols decoded, the Index of a DecodeError
+	symbols int64
+	// Set once EOB has been decoded, nothing more is read after it
+	eob bool
 }
 
 func NewReader(r io.Reader, m *Model) (*Reader, error) {
+	if m.tree == nil {
+		return nil, fmt.Errorf("%w, it does not have a huffman tree", ErrInvalidModel)
+	}
 	b, err := bitreader.NewBitReader(r)
 	if err != nil {
 		return nil, err
 	}
-	return &Reader{b, m}, nil
+	return &Reader{r: &countingBitReader{r: b}, m: m}, nil
 }
 
+// Decode bytes into p. Returns io.EOF once the EOB symbol has been decoded,
+// after checking that the padding bits which follow it are 0.
 func (this *Reader) Read(p []byte) (int, error) {
+	if this.eob {
+		return 0, io.EOF
+	}
 	numBytes := 0
-	node := this.m.tree
 	for numBytes < len(p) {
-		if node.IsLeaf() {
-			p[numBytes] = node.symbol
-			node = this.m.tree
-			numBytes += 1
-		}
-
-		b, err := this.r.ReadBit()
-		if err != nil {
-			return numBytes, err
-		}
+		// Walk down the tree until we reach a symbol. Only read as many bits
+		// as the symbol needs so that nothing past the last symbol is consumed.
+		node := this.m.tree
+		start := this.r.n
+		for !node.IsLeaf() {
+			b, err := this.r.ReadBit()
+			if err != nil {
+				return numBytes, err
+			}
 
-		if b == 1 {
-			if node.right != nil {
+			if b == 1 {
 				node = node.right
 			} else {
-				return numBytes, fmt.Errorf(
-					"Invalid huffman tree, expecting a right child but found nil")
-			}
-		} else {
-			if node.left != nil {
 				node = node.left
-			} else {
-				return numBytes, fmt.Errorf(
-					"Invalid huffman tree, expecting a left child but found nil")
 			}
+			if node == nil {
+				return numBytes, this.decodeError(start, ErrInvalidCode)
+			}
+		}
+		if node.symbol == ESCAPE {
+			// The byte follows as 8 raw bits
+			b := 0
+			for i := 0; i < 8; i++ {
+				bit, err := this.r.ReadBit()
+				if err != nil {
+					return numBytes, err
+				}
+				b = b<<1 | bit
+			}
+			p[numBytes] = byte(b)
+			numBytes += 1
+			this.symbols += 1
+			continue
+		}
+		if node.symbol == EOB {
+			return numBytes, this.readPadding()
 		}
+		if node.symbol > 0xff {
+			return numBytes, this.decodeError(start, fmt.Errorf("%w, got symbol %d", ErrNotAByte, node.symbol))
+		}
+		p[numBytes] = byte(node.symbol)
+		numBytes += 1
+		this.symbols += 1
 	}
 	return numBytes, nil
 }
+
+// Read the rest of the current byte, which must be 0 bits. Returns io.EOF
+// if it is.
+func (this *Reader) readPadding() error {
+	start := this.r.n
+	for this.r.n%8 != 0 {
+		b, err := this.r.ReadBit()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return this.decodeError(start, ErrInvalidPadding)
+		}
+	}
+	this.eob = true
+	return io.EOF
+}
+
+func (this *Reader) decodeError(start uint64, err error) error {
+	return &DecodeError{this.symbols, start, err}
+}
+
+// Counts the bits read, for the BitOffset of a DecodeError.
+type countingBitReader struct {
+	r bitreader.Interface
+	n uint64
+}
+
+func (this *countingBitReader) ReadBit() (int, error) {
+	b, err := this.r.ReadBit()
+	if err != nil {
+		return b, err
+	}
+	this.n += 1
+	return b, nil
+}
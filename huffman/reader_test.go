@@ -29,3 +29,26 @@ func TestReader_SimpleRead(t *testing.T) {
 		t.Errorf("Failed to read in expected 9 bytes, got %d", n)
 	}
 }
+
+func TestReader_ReadByteAligned(t *testing.T) {
+	// 'a' is one bit, so eight of them fill exactly one byte. The reader must
+	// not try to read past the last symbol.
+	m, err := CreateModelFromText([]byte("aaaaaaaaaabbbbbccccc"))
+	if err != nil {
+		t.Fatal("Failed to create model")
+	}
+	src := bytes.NewBuffer([]byte{0x00})
+	r, err := NewReader(src, m)
+	if err != nil {
+		t.Fatal("Failed to create reader")
+	}
+
+	dest := make([]byte, 8)
+	n, err := r.Read(dest)
+	if err != nil {
+		t.Errorf("Failed to decode symbols: %v", err)
+	}
+	if n != 8 || bytes.Compare(dest, []byte("aaaaaaaa")) != 0 {
+		t.Errorf("Failed to read back the symbols, got %q", dest[:n])
+	}
+}
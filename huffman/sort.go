@@ -12,7 +12,7 @@ import (
 // generics.
 
 type symbolByteSeqPair struct {
-	symbol  byte
+	symbol  Symbol
 	byteSeq ByteSeq
 }
 type symbolByteSeqPairNameLenSort []symbolByteSeqPair
@@ -47,8 +47,26 @@ func (this symbolByteSeqPairLenNameSort) Swap(i int, j int) {
 	this[i], this[j] = this[j], this[i]
 }
 
+// Sorts by the patterns themselves, (length, pattern), which is the order the
+// codes were assigned in even if the symbols were not in order.
+type symbolByteSeqPairPatternSort []symbolByteSeqPair
+
+func (this symbolByteSeqPairPatternSort) Len() int {
+	return len(this)
+}
+func (this symbolByteSeqPairPatternSort) Less(i int, j int) bool {
+	if this[i].byteSeq.Len != this[j].byteSeq.Len {
+		return this[i].byteSeq.Len < this[j].byteSeq.Len
+	} else {
+		return this[i].byteSeq.Pattern < this[j].byteSeq.Pattern
+	}
+}
+func (this symbolByteSeqPairPatternSort) Swap(i int, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
 type symbolFreqPair struct {
-	symbol byte
+	symbol Symbol
 	freq   Freq
 }
 type symbolFreqPairSlice []symbolFreqPair
@@ -60,7 +78,7 @@ func (this symbolFreqPairSlice) Less(i int, j int) bool {
 	if this[i].freq.Nume == this[j].freq.Nume {
 		return this[i].symbol < this[j].symbol
 	} else {
-		return this[i].freq.Freq < this[j].freq.Freq
+		return this[i].freq.Nume < this[j].freq.Nume
 	}
 }
 func (this symbolFreqPairSlice) Swap(i int, j int) {
@@ -0,0 +1,343 @@
+package huffman
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// Number of bits looked up at once in the primary table. Codes up to this
+	// length are resolved with a single table hit.
+	kPRIMARY_TABLE_BITS = 9
+	// Maximum number of bits looked up in a secondary table. Codes longer
+	// than kPRIMARY_TABLE_BITS + kSECONDARY_TABLE_BITS fall back to walking the
+	// huffman tree for the remaining bits.
+	kSECONDARY_TABLE_BITS = 12
+)
+
+// A single slot in a lookup table.
+// If length > 0 then the bits used to index the table start with the pattern
+// for 'symbol' and the pattern is 'length' bits long (counted from the start
+// of this table).
+// If sub >= 0 then the pattern is longer than the table and the next bits are
+// looked up in the secondary table 'sub'.
+// If node != nil then the pattern is too long for any table and the remaining
+// bits are decoded by walking the tree from 'node'.
+// Otherwise no pattern in the model starts with these bits.
+type tableEntry struct {
+	symbol Symbol
+	length uint8
+	sub    int
+	node   *Node
+}
+
+type lookupTable struct {
+	bits    uint
+	entries []tableEntry
+}
+
+func newLookupTable(bits uint) *lookupTable {
+	t := &lookupTable{bits, make([]tableEntry, 1<<bits)}
+	for i := range t.entries {
+		t.entries[i].sub = -1
+	}
+	return t
+}
+
+// Set every entry whose index starts with the given prefix.
+func (this *lookupTable) fill(prefix uint64, prefixLen uint, e tableEntry) {
+	start := prefix << (this.bits - prefixLen)
+	end := start + (1 << (this.bits - prefixLen))
+	for i := start; i < end; i++ {
+		this.entries[i] = e
+	}
+}
+
+// The primary and secondary tables built from the canonical code of a model.
+type decodeTable struct {
+	primary   *lookupTable
+	secondary []*lookupTable
+}
+
+func buildDecodeTable(m *Model) *decodeTable {
+	t := &decodeTable{newLookupTable(kPRIMARY_TABLE_BITS), nil}
+
+	// Find out how many bits each secondary table needs. The secondary table
+	// is indexed by the bits following the primary prefix.
+	subBits := make(map[uint64]uint)
+	for _, seq := range m.patternDict {
+		if seq.Len <= kPRIMARY_TABLE_BITS {
+			continue
+		}
+		prefix := seq.Pattern >> (seq.Len - kPRIMARY_TABLE_BITS)
+		rest := seq.Len - kPRIMARY_TABLE_BITS
+		if rest > kSECONDARY_TABLE_BITS {
+			rest = kSECONDARY_TABLE_BITS
+		}
+		if rest > subBits[prefix] {
+			subBits[prefix] = rest
+		}
+	}
+	for prefix := uint64(0); prefix < 1<<kPRIMARY_TABLE_BITS; prefix++ {
+		bits, ok := subBits[prefix]
+		if !ok {
+			continue
+		}
+		t.primary.entries[prefix].sub = len(t.secondary)
+		t.secondary = append(t.secondary, newLookupTable(bits))
+	}
+
+	for symbol, seq := range m.patternDict {
+		if seq.Len <= kPRIMARY_TABLE_BITS {
+			t.primary.fill(seq.Pattern, seq.Len, tableEntry{symbol, uint8(seq.Len), -1, nil})
+			continue
+		}
+
+		rest := seq.Len - kPRIMARY_TABLE_BITS
+		prefix := seq.Pattern >> rest
+		sub := t.secondary[t.primary.entries[prefix].sub]
+		if rest <= sub.bits {
+			pattern := seq.Pattern & (1<<rest - 1)
+			sub.fill(pattern, rest, tableEntry{symbol, uint8(rest), -1, nil})
+			continue
+		}
+
+		// Too long for the secondary table, find the node in the tree that
+		// the remaining bits should be decoded from.
+		pattern := (seq.Pattern >> (rest - sub.bits)) & (1<<sub.bits - 1)
+		if sub.entries[pattern].node == nil {
+			sub.entries[pattern].node = m.tree.walk(
+				seq.Pattern>>(rest-sub.bits), seq.Len-(rest-sub.bits))
+		}
+	}
+	return t
+}
+
+// Follow the first n bits of the pattern down from this node.
+func (this *Node) walk(pattern uint64, n uint) *Node {
+	node := this
+	for i := int(n) - 1; i >= 0 && node != nil; i-- {
+		if pattern&(1<<uint(i)) > 0 {
+			node = node.right
+		} else {
+			node = node.left
+		}
+	}
+	return node
+}
+
+// TableReader decodes the same stream as Reader but looks up several bits at
+// a time in tables built from the canonical code of the model, instead of
+// walking the tree one bit at a time. Only the bytes needed to decode the
+// requested symbols are read from the underlying reader.
+type TableReader struct {
+	r io.ByteReader
+	t *decodeTable
+
+	// Bits read from the stream but not yet decoded, right aligned.
+	bits  uint64
+	nbits uint
+
+	// Bytes read from the stream and symbols decoded, for DecodeError
+	bytesRead uint64
+	symbols   int64
+	// Set once EOB has been decoded, nothing more is read after it
+	eob bool
+}
+
+func NewTableReader(r io.Reader, m *Model) (*TableReader, error) {
+	if m.tree == nil {
+		return nil, fmt.Errorf("%w, it does not have a huffman tree", ErrInvalidModel)
+	}
+	t := &TableReader{t: buildDecodeTable(m)}
+	t.Reset(r)
+	return t, nil
+}
+
+// Start reading from a new stream with the same model, dropping any bits left
+// over from the previous stream. Saves rebuilding the lookup tables.
+func (this *TableReader) Reset(r io.Reader) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+	this.r = br
+	this.bits = 0
+	this.nbits = 0
+	this.bytesRead = 0
+	this.symbols = 0
+	this.eob = false
+}
+
+// Decode bytes into p. Returns io.EOF once the EOB symbol has been decoded,
+// after checking that the padding bits which follow it are 0.
+func (this *TableReader) Read(p []byte) (int, error) {
+	if this.eob {
+		return 0, io.EOF
+	}
+	for i := 0; i < len(p); i++ {
+		b, err := this.readByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
+
+// Decode the next symbol as a byte, reading the 8 bits which follow an
+// ESCAPE as the byte itself.
+func (this *TableReader) readByte() (byte, error) {
+	start := this.offset()
+	symbol, err := this.readSymbol()
+	if err == ErrInvalidCode {
+		return 0, this.decodeError(start, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if symbol == ESCAPE {
+		for this.nbits < 8 {
+			err = this.fill()
+			if err != nil {
+				return 0, err
+			}
+		}
+		this.nbits -= 8
+		this.symbols += 1
+		return byte(this.bits >> this.nbits), nil
+	}
+	if symbol == EOB {
+		err = this.Finish()
+		if err != nil {
+			return 0, err
+		}
+		this.eob = true
+		return 0, io.EOF
+	}
+	if symbol > 0xff {
+		return 0, this.decodeError(start, fmt.Errorf("%w, got symbol %d", ErrNotAByte, symbol))
+	}
+	this.symbols += 1
+	return byte(symbol), nil
+}
+
+// The number of bits decoded so far, not counting bits read ahead.
+func (this *TableReader) offset() uint64 {
+	return this.bytesRead*8 - uint64(this.nbits)
+}
+
+// Check that only 0 padding bits are left of the last byte read. The padding
+// is dropped, so the next symbol read starts on a new byte.
+func (this *TableReader) Finish() error {
+	padding := this.bits & (1<<this.nbits - 1)
+	if this.nbits >= 8 || padding != 0 {
+		return this.decodeError(this.offset(), ErrInvalidPadding)
+	}
+	this.nbits = 0
+	return nil
+}
+
+func (this *TableReader) decodeError(start uint64, err error) error {
+	return &DecodeError{this.symbols, start, err}
+}
+
+func (this *TableReader) readSymbol() (Symbol, error) {
+	e, err := this.lookup(this.t.primary)
+	if err != nil {
+		return 0, err
+	}
+	if e.sub >= 0 {
+		e, err = this.lookup(this.t.secondary[e.sub])
+		if err != nil {
+			return 0, err
+		}
+	}
+	if e.node != nil {
+		return this.walk(e.node)
+	}
+	return e.symbol, nil
+}
+
+// Find the entry for the next bits in the stream and consume its bits.
+// Bytes are only read from the stream when the bits already buffered are not
+// enough to tell which entry applies, so nothing past the end of the last
+// symbol is ever read.
+func (this *TableReader) lookup(t *lookupTable) (tableEntry, error) {
+	for {
+		var index uint64
+		if this.nbits >= t.bits {
+			index = this.bits >> (this.nbits - t.bits)
+		} else {
+			index = this.bits << (t.bits - this.nbits)
+		}
+		e := t.entries[index&(1<<t.bits-1)]
+
+		if e.length > 0 && uint(e.length) <= this.nbits {
+			this.nbits -= uint(e.length)
+			return e, nil
+		}
+		if this.nbits >= t.bits {
+			if e.length == 0 && e.sub < 0 && e.node == nil {
+				return e, ErrInvalidCode
+			}
+			this.nbits -= t.bits
+			return e, nil
+		}
+
+		err := this.fill()
+		if err != nil {
+			return e, err
+		}
+	}
+}
+
+// Decode the rest of a very long pattern one bit at a time.
+func (this *TableReader) walk(node *Node) (Symbol, error) {
+	for !node.IsLeaf() {
+		if this.nbits == 0 {
+			err := this.fill()
+			if err != nil {
+				return 0, err
+			}
+		}
+		this.nbits -= 1
+		if this.bits&(1<<this.nbits) > 0 {
+			node = node.right
+		} else {
+			node = node.left
+		}
+		if node == nil {
+			return 0, ErrInvalidCode
+		}
+	}
+	return node.symbol, nil
+}
+
+// Read one more byte from the stream into the bit buffer.
+func (this *TableReader) fill() error {
+	b, err := this.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	this.bits = this.bits<<8 | uint64(b)
+	this.nbits += 8
+	this.bytesRead += 1
+	// Drop the bits which have already been consumed
+	this.bits &= 1<<this.nbits - 1
+	return nil
+}
+
+// Adapts an io.Reader to an io.ByteReader without reading ahead.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (this *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(this.r, this.buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return this.buf[0], nil
+}
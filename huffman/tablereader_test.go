@@ -0,0 +1,195 @@
+package huffman
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// Encode the source with the model, then decode it with both the Reader and
+// the TableReader and make sure they agree.
+func compareReaders(t *testing.T, m *Model, src []byte) {
+	encoded := bytes.NewBuffer([]byte{})
+	w, err := NewWriter(encoded, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(encoded.Bytes()), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, len(src))
+	_, err = r.Read(want)
+	if err != nil {
+		t.Fatalf("Reader failed to decode: %v", err)
+	}
+
+	// Read one byte at a time from the stream and one symbol at a time from
+	// the reader so that state has to carry over between calls.
+	tr, err := NewTableReader(iotest.OneByteReader(bytes.NewReader(encoded.Bytes())), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(src))
+	for i := 0; i < len(got); i++ {
+		n, err := tr.Read(got[i : i+1])
+		if err != nil || n != 1 {
+			t.Fatalf("TableReader failed to decode symbol %d: %v", i, err)
+		}
+	}
+
+	if bytes.Compare(got, want) != 0 {
+		t.Errorf("TableReader does not match Reader.\ngot  = %v\nwant = %v", got, want)
+	}
+	if bytes.Compare(got, src) != 0 {
+		t.Errorf("TableReader did not decode the source.\ngot  = %v\nwant = %v", got, src)
+	}
+}
+
+func TestTableReader_MatchesReader(t *testing.T) {
+	compareReaders(t, DefaultModel(), []byte(loremText))
+
+	src := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(src)
+	compareReaders(t, DefaultModel(), src)
+
+	m, err := CreateModelFromText([]byte(codebookTestText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareReaders(t, m, []byte(codebookTestText))
+}
+
+func TestTableReader_LongCodes(t *testing.T) {
+	// Fibonacci weights produce a maximally skewed tree with codes which are
+	// much longer than the primary and secondary tables.
+	src := make([]byte, 0)
+	a, b := 1, 1
+	for i := 0; i < 28; i++ {
+		src = append(src, bytes.Repeat([]byte{byte('A' + i)}, a)...)
+		a, b = b, a+b
+	}
+	m, err := CreateModelFromText(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := m.GetPattern('A')
+	if seq.Len <= kPRIMARY_TABLE_BITS+kSECONDARY_TABLE_BITS {
+		t.Fatalf("Expected a pattern longer than the tables, got %d bits", seq.Len)
+	}
+
+	compareReaders(t, m, []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\ZYXWVUTSRQPONMLKJIHGFEDCBA"))
+}
+
+func TestTableReader_ReadsOnlyWhatItNeeds(t *testing.T) {
+	m, err := CreateModelFromText([]byte("aaaaaaaaaabbbbbccccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 'a' is a single bit so the first byte holds 8 symbols. The second byte
+	// must be left in the stream.
+	src := bytes.NewBuffer([]byte{0x00, 0xff})
+	r, err := NewTableReader(src, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]byte, 8)
+	n, err := r.Read(dest)
+	if err != nil || n != 8 {
+		t.Errorf("Failed to read 8 symbols: %d, %v", n, err)
+	}
+	if src.Len() != 1 {
+		t.Errorf("TableReader read past the last symbol, %d bytes left", src.Len())
+	}
+}
+
+func TestTableReader_InvalidCode(t *testing.T) {
+	m := &Model{}
+	err := m.resetFromLengths(map[Symbol]uint{'a': 2, 'b': 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 'a' = 00 and 'b' = 01, nothing starts with a 1 bit
+	r, err := NewTableReader(bytes.NewBuffer([]byte{0xff}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("Expected an error for bits which don't match any symbol")
+	}
+}
+
+func TestTableReader_Padding(t *testing.T) {
+	m, err := CreateModelFromText([]byte("aaaaaaaaaabbbbbccccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 'a' = 0, 'b' = 10 and 'c' = 11, so "abc" is 01011 and 3 bits of padding
+	for _, test := range []struct {
+		last byte
+		err  error
+	}{{0x58, nil}, {0x59, ErrInvalidPadding}, {0x5c, ErrInvalidPadding}} {
+		r, err := NewTableReader(bytes.NewBuffer([]byte{test.last}), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 3)
+		_, err = r.Read(got)
+		if err != nil || string(got) != "abc" {
+			t.Fatalf("Failed to read abc from %#x: %q, %v", test.last, got, err)
+		}
+		err = r.Finish()
+		if !errors.Is(err, test.err) {
+			t.Errorf("Padding of %#x gave %v, want %v", test.last, err, test.err)
+		}
+	}
+}
+
+func benchmarkDecode(b *testing.B, newReader func(*bytes.Reader, *Model) (func([]byte) (int, error), error)) {
+	m := DefaultModel()
+	src := bytes.Repeat([]byte(loremText), 4)
+	encoded := bytes.NewBuffer([]byte{})
+	w, _ := NewWriter(encoded, m)
+	w.Write(src)
+	w.Close()
+
+	dest := make([]byte, len(src))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		read, err := newReader(bytes.NewReader(encoded.Bytes()), m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		read(dest)
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	benchmarkDecode(b, func(r *bytes.Reader, m *Model) (func([]byte) (int, error), error) {
+		hr, err := NewReader(r, m)
+		if err != nil {
+			return nil, err
+		}
+		return hr.Read, nil
+	})
+}
+
+func BenchmarkTableReader(b *testing.B) {
+	benchmarkDecode(b, func(r *bytes.Reader, m *Model) (func([]byte) (int, error), error) {
+		hr, err := NewTableReader(r, m)
+		if err != nil {
+			return nil, err
+		}
+		return hr.Read, nil
+	})
+}
@@ -0,0 +1,210 @@
+package huffman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// Counts stop growing at this value so that the total of all 256 counts
+	// can never overflow a uint64.
+	kMAX_TRAINER_COUNT = math.MaxUint64 >> 8
+	// Size of the buffer used to read samples from an io.Reader
+	kTRAINER_READ_SIZE = 32 * 1024
+)
+
+// Trainer accumulates symbol counts over any number of samples and builds a
+// Model from them. Counts gathered by separate trainers, e.g. on different
+// machines, can be combined with Merge or shipped around with MarshalBinary.
+//
+// Every symbol of the alphabet gets the smoothing count added to it when the
+// model is built, so the model can encode symbols which never appeared in the
+// samples. Alternatively the model can be given an ESCAPE pattern with
+// SetEscape, which covers every byte missing from the samples at once.
+type Trainer struct {
+	counts    [kDEFAULT_ALPHABET_LEN]uint64
+	alphabet  []byte
+	smoothing uint64
+	// The count of the ESCAPE symbol, 0 for no ESCAPE
+	escape uint64
+	eob    bool
+}
+
+// Create a Trainer for the DefaultAlphabet with a smoothing count of 1.
+func NewTrainer() *Trainer {
+	return NewTrainerWithAlphabet(DefaultAlphabet())
+}
+
+// Create a Trainer which smooths the given alphabet instead of every byte.
+func NewTrainerWithAlphabet(alphabet []byte) *Trainer {
+	return &Trainer{alphabet: alphabet, smoothing: 1}
+}
+
+// Set the count added to every symbol of the alphabet when building the
+// model. 0 turns smoothing off, so only symbols in the samples get patterns.
+func (this *Trainer) SetSmoothing(count uint64) {
+	this.smoothing = count
+}
+
+// Give the model an ESCAPE symbol with this count, so bytes without a pattern
+// can still be written. Usually used with a smoothing of 0. The higher the
+// count the shorter the ESCAPE pattern. 0 leaves ESCAPE out of the model.
+func (this *Trainer) SetEscape(count uint64) {
+	this.escape = count
+}
+
+// Give the model an EOB symbol so that its streams end in-band, see EOB.
+func (this *Trainer) SetEOB(enabled bool) {
+	this.eob = enabled
+}
+
+// Count every byte of the sample once. Implements io.Writer so samples can
+// be copied straight into the trainer.
+func (this *Trainer) Write(p []byte) (int, error) {
+	this.AddWeighted(p, 1)
+	return len(p), nil
+}
+
+// Count every byte of the sample 'weight' times.
+func (this *Trainer) AddWeighted(p []byte, weight uint64) {
+	for _, b := range p {
+		this.counts[b] = addCount(this.counts[b], weight)
+	}
+}
+
+// Count every byte read from r 'weight' times until io.EOF. Returns the
+// number of bytes read.
+func (this *Trainer) AddReader(r io.Reader, weight uint64) (int64, error) {
+	buf := make([]byte, kTRAINER_READ_SIZE)
+	total := int64(0)
+	for {
+		n, err := r.Read(buf)
+		this.AddWeighted(buf[:n], weight)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Add the counts of the other trainer to this one. The alphabet and smoothing
+// of this trainer are kept.
+func (this *Trainer) Merge(other *Trainer) {
+	for i, c := range other.counts {
+		this.counts[i] = addCount(this.counts[i], c)
+	}
+}
+
+// The number of times the symbol has been counted, without smoothing.
+func (this *Trainer) Count(symbol byte) uint64 {
+	return this.counts[symbol]
+}
+
+// Build a model from the counts.
+func (this *Trainer) Model() (*Model, error) {
+	counts, err := this.symbolCounts()
+	if err != nil {
+		return nil, err
+	}
+	m := &Model{}
+	err = m.resetFromCounts(counts)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Build a model from the counts where no pattern is longer than maxLen bits.
+func (this *Trainer) ModelWithMaxLen(maxLen uint) (*Model, error) {
+	counts, err := this.symbolCounts()
+	if err != nil {
+		return nil, err
+	}
+	m := &Model{}
+	err = m.resetWithMaxLen(counts, maxLen)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// The smoothed counts in the same form as BuildFrequencyDict.
+func (this *Trainer) freqDict() (map[byte]*Freq, error) {
+	counts := this.counts
+	for _, symbol := range this.alphabet {
+		counts[symbol] = addCount(counts[symbol], this.smoothing)
+	}
+
+	total := uint64(0)
+	for _, c := range counts {
+		total += c
+	}
+
+	dict := make(map[byte]*Freq)
+	for symbol, c := range counts {
+		if c == 0 {
+			continue
+		}
+		dict[byte(symbol)] = &Freq{c, total, float64(c) / float64(total)}
+	}
+	if len(dict) == 0 {
+		return nil, errors.New("Trainer has not counted any symbols")
+	}
+	return dict, nil
+}
+
+// The smoothed counts along with the ESCAPE and EOB counts, if any.
+func (this *Trainer) symbolCounts() (map[Symbol]uint64, error) {
+	dict, err := this.freqDict()
+	if err != nil {
+		return nil, err
+	}
+	counts := symbolCounts(dict)
+	if this.escape > 0 {
+		counts[ESCAPE] = this.escape
+	}
+	if this.eob {
+		counts[EOB] = 1
+	}
+	return counts, nil
+}
+
+// Write out the counts, without smoothing, as 256 LittleEndian uint64s.
+func (this *Trainer) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 8*len(this.counts))
+	for i, c := range this.counts {
+		binary.LittleEndian.PutUint64(p[8*i:], c)
+	}
+	return p, nil
+}
+
+// Replace the counts with ones written by MarshalBinary. Use Merge to add
+// them to existing counts instead.
+func (this *Trainer) UnmarshalBinary(p []byte) error {
+	if len(p) != 8*len(this.counts) {
+		return fmt.Errorf("Trainer counts must be %d bytes, got %d", 8*len(this.counts), len(p))
+	}
+	var counts [kDEFAULT_ALPHABET_LEN]uint64
+	for i := range counts {
+		counts[i] = binary.LittleEndian.Uint64(p[8*i:])
+		if counts[i] > kMAX_TRAINER_COUNT {
+			return errors.New("Trainer count is too large")
+		}
+	}
+	this.counts = counts
+	return nil
+}
+
+// Add to a count, stopping at kMAX_TRAINER_COUNT instead of overflowing.
+func addCount(count uint64, n uint64) uint64 {
+	if n > kMAX_TRAINER_COUNT-count {
+		return kMAX_TRAINER_COUNT
+	}
+	return count + n
+}
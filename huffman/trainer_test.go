@@ -0,0 +1,187 @@
+package huffman
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func marshalModel(t *testing.T, m *Model) []byte {
+	b, err := m.MarshalAlphabet(DefaultAlphabet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTrainer_SmoothingMatchesAppendedAlphabet(t *testing.T) {
+	src := []byte(typicalDefaultText)
+	want, err := CreateModelFromText(append(append([]byte{}, src...), DefaultAlphabet()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trainer := NewTrainer()
+	trainer.Write(src)
+	got, err := trainer.Model()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalModel(t, want), marshalModel(t, got)) {
+		t.Errorf("Smoothed model differs from the model with the alphabet appended")
+	}
+}
+
+func TestTrainer_WeightedAndReaders(t *testing.T) {
+	a := NewTrainer()
+	a.Write([]byte("abcabc"))
+	a.AddWeighted([]byte("z"), 3)
+
+	b := NewTrainer()
+	n, err := b.AddReader(iotest.OneByteReader(strings.NewReader("abcabc")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("AddReader read %d bytes, want 6", n)
+	}
+	b.AddWeighted([]byte("zzz"), 1)
+
+	for _, symbol := range []byte("abcz") {
+		if a.Count(symbol) != b.Count(symbol) {
+			t.Errorf("Count(%c) = %d and %d", symbol, a.Count(symbol), b.Count(symbol))
+		}
+	}
+	if a.Count('z') != 3 || a.Count('a') != 2 || a.Count('d') != 0 {
+		t.Errorf("Unexpected counts a=%d z=%d d=%d", a.Count('a'), a.Count('z'), a.Count('d'))
+	}
+}
+
+func TestTrainer_Merge(t *testing.T) {
+	samples := []string{"the quick brown fox", "jumps over", "the lazy dog"}
+
+	all := NewTrainer()
+	merged := NewTrainer()
+	for _, s := range samples {
+		all.Write([]byte(s))
+
+		// Pass the counts through MarshalBinary as if trained elsewhere
+		part := NewTrainer()
+		part.Write([]byte(s))
+		b, err := part.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := NewTrainer()
+		err = remote.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged.Merge(remote)
+	}
+
+	want, err := all.Model()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := merged.Model()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalModel(t, want), marshalModel(t, got)) {
+		t.Errorf("Merged model differs from training on all samples")
+	}
+
+	if NewTrainer().UnmarshalBinary([]byte{1, 2, 3}) == nil {
+		t.Errorf("Expected an error unmarshalling short counts")
+	}
+}
+
+func TestTrainer_Smoothing(t *testing.T) {
+	trainer := NewTrainer()
+	trainer.SetSmoothing(0)
+	if _, err := trainer.Model(); err == nil {
+		t.Errorf("Expected an error building a model without any counts")
+	}
+
+	trainer.Write([]byte("aab"))
+	m, err := trainer.Model()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetPattern('c'); err == nil {
+		t.Errorf("Expected no pattern for an unseen symbol without smoothing")
+	}
+
+	trainer = NewTrainerWithAlphabet(ASCIIAlphabet())
+	trainer.Write([]byte("aab"))
+	m, err = trainer.ModelWithMaxLen(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range ASCIIAlphabet() {
+		seq, err := m.GetPattern(symbol)
+		if err != nil {
+			t.Errorf("Missing pattern for %#x", symbol)
+		}
+		if seq.Len > 12 {
+			t.Errorf("Pattern for %#x is %d bits long", symbol, seq.Len)
+		}
+	}
+	if _, err := m.GetPattern(0x80); err == nil {
+		t.Errorf("Expected no pattern for a symbol outside the alphabet")
+	}
+}
+
+func TestTrainer_CountsSaturate(t *testing.T) {
+	trainer := NewTrainer()
+	trainer.AddWeighted([]byte("ab"), kMAX_TRAINER_COUNT-1)
+	trainer.AddWeighted([]byte("ab"), kMAX_TRAINER_COUNT-1)
+	if trainer.Count('a') != kMAX_TRAINER_COUNT {
+		t.Errorf("Count = %d, want %d", trainer.Count('a'), uint64(kMAX_TRAINER_COUNT))
+	}
+	if _, err := trainer.Model(); err != nil {
+		t.Errorf("Failed to build a model from saturated counts: %v", err)
+	}
+}
+
+func TestTrainer_Escape(t *testing.T) {
+	trainer := NewTrainer()
+	trainer.SetSmoothing(0)
+	trainer.SetEscape(2)
+	trainer.Write([]byte(typicalDefaultText))
+
+	for _, maxLen := range []uint{0, 9} {
+		var m *Model
+		var err error
+		if maxLen > 0 {
+			m, err = trainer.ModelWithMaxLen(maxLen)
+		} else {
+			m, err = trainer.Model()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.HasEscape() {
+			t.Fatalf("Trained model does not have an ESCAPE pattern")
+		}
+		compareReaders(t, m, []byte("\x00\x01"+typicalDefaultText+"\xfe\xff"))
+	}
+}
+
+func TestTrainer_EOB(t *testing.T) {
+	trainer := NewTrainer()
+	trainer.SetSmoothing(0)
+	trainer.SetEscape(2)
+	trainer.SetEOB(true)
+	trainer.Write([]byte(typicalDefaultText))
+	m, err := trainer.Model()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasEOB() || !m.HasEscape() {
+		t.Fatalf("Trained model should have both an EOB and an ESCAPE pattern")
+	}
+	compareReaders(t, m, []byte("\x00"+typicalDefaultText+"\xff"))
+}
@@ -8,10 +8,16 @@ type Writer struct {
 	w           *ByteSeqWriter
 	m           *Model
 	bitsWritten uint64
+	// Number of symbols written, the Index of a SymbolError
+	symbols int64
 }
 
 func NewWriter(w io.Writer, m *Model) (*Writer, error) {
-	return &Writer{NewByteSeqWriter(w), m, 0}, nil
+	bw, err := NewByteSeqWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{bw, m, 0, 0}, nil
 }
 
 func (this *Writer) Write(p []byte) (int, error) {
@@ -19,7 +25,18 @@ func (this *Writer) Write(p []byte) (int, error) {
 	for i := 0; i < len(p); i++ {
 		symbol, err := this.m.GetPattern(p[i])
 		if err != nil {
-			return numBytesWritten, err
+			// Bytes missing from the model are written as ESCAPE and then
+			// the byte itself
+			escape, ok := this.m.patternDict[ESCAPE]
+			if !ok {
+				return numBytesWritten, &SymbolError{Symbol(p[i]), this.symbols, ErrSymbolNotInModel}
+			}
+			bitsWritten, err := this.w.Write(escape)
+			if err != nil {
+				return numBytesWritten, err
+			}
+			this.bitsWritten += uint64(bitsWritten)
+			symbol = ByteSeq{uint64(p[i]), 8}
 		}
 
 		bitsWritten, err := this.w.Write(symbol)
@@ -27,12 +44,24 @@ func (this *Writer) Write(p []byte) (int, error) {
 			return numBytesWritten, err
 		}
 		this.bitsWritten += uint64(bitsWritten)
+		this.symbols += 1
 		numBytesWritten += 1
 	}
 	return numBytesWritten, nil
 }
 
+// Write out the last bits, padded with 0 bits to a byte. Models with an EOB
+// pattern end the stream with EOB first.
 func (this *Writer) Close() error {
+	eob, ok := this.m.patternDict[EOB]
+	if ok {
+		bitsWritten, err := this.w.Write(eob)
+		if err != nil {
+			return err
+		}
+		this.bitsWritten += uint64(bitsWritten)
+	}
+
 	bitsWritten, err := this.w.Flush()
 	if err != nil {
 		return err